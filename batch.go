@@ -0,0 +1,119 @@
+package rprof
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// readBatch accumulates the reads of a wrapper, so they are recorded at once
+// rather than one by one. See WithBatching.
+type readBatch struct {
+	reads    int
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending pendingRead
+	// bucket is the size bucket of the pending reads.
+	bucket uint8
+	// since is the time the first pending read was added.
+	since time.Time
+	// owner is the profiler the batch is registered with while it holds
+	// pending reads, so they are flushed before its samples are taken.
+	owner *Rprof
+}
+
+// pendingRead is a read, or the aggregate of several reads, to be recorded
+// with the configuration of the wrapper at the time of the read.
+type pendingRead struct {
+	ev  readEvent
+	cfg wrapConfig
+	// stack is the stack of the read that started an aggregate, nil for a
+	// single read, which is recorded with the stack of its caller.
+	stack []uintptr
+}
+
+// add adds a read in the given size bucket to the batch, and appends the
+// reads that are due to be recorded to dst. Reads are aggregated as long as
+// they fall in the same size bucket and have the same labels. Failed reads
+// and the end of streams are never aggregated.
+func (b *readBatch) add(p *Rprof, ev readEvent, bucket uint8, cfg *wrapConfig, dst []pendingRead) []pendingRead {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ev.failed() || ev.eof {
+		dst = b.flushLocked(dst)
+		return append(dst, pendingRead{ev: ev, cfg: *cfg})
+	}
+
+	if b.pending.ev.batched > 0 && (bucket != b.bucket || cfg.labelKey != b.pending.cfg.labelKey || cfg.traceKey != b.pending.cfg.traceKey) {
+		dst = b.flushLocked(dst)
+	}
+
+	now := time.Now()
+	if b.pending.ev.batched == 0 {
+		b.pending.cfg = *cfg
+		b.bucket = bucket
+		b.since = now
+		// The stack is taken now, since the batch may be flushed by the
+		// profiler rather than by a read of the wrapper.
+		w := stackWalk{p: p, cfg: cfg}
+		b.pending.stack = slices.Clone(w.stack())
+		w.release()
+		b.register(p)
+	}
+	b.pending.ev.n += ev.n
+	b.pending.ev.requested += ev.requested
+	b.pending.ev.latency += ev.latency
+	for i, v := range ev.extra {
+		b.pending.ev.extra[i] += v
+	}
+	b.pending.ev.batched++
+
+	if b.pending.ev.batched >= b.reads || (b.interval > 0 && now.Sub(b.since) >= b.interval) {
+		dst = b.flushLocked(dst)
+	}
+	return dst
+}
+
+// flush appends the pending reads, if any, to dst and empties the batch.
+func (b *readBatch) flush(dst []pendingRead) []pendingRead {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flushLocked(dst)
+}
+
+// flushLocked is like flush, b.mu must be held.
+func (b *readBatch) flushLocked(dst []pendingRead) []pendingRead {
+	if b.pending.ev.batched == 0 {
+		return dst
+	}
+
+	dst = append(dst, b.pending)
+	b.pending = pendingRead{}
+	b.register(nil)
+	return dst
+}
+
+// register registers the batch with the profiler p, or unregisters it from
+// its owner if p is nil. b.mu must be held.
+func (b *readBatch) register(p *Rprof) {
+	if b.owner == p {
+		return
+	}
+	if o := b.owner; o != nil {
+		o.batchesMu.Lock()
+		delete(o.batches, b)
+		o.batchesMu.Unlock()
+	}
+	if p != nil {
+		p.batchesMu.Lock()
+		if p.batches == nil {
+			p.batches = map[*readBatch]struct{}{}
+		}
+		p.batches[b] = struct{}{}
+		p.batchesMu.Unlock()
+	}
+	b.owner = p
+}
@@ -0,0 +1,56 @@
+package rprof
+
+import (
+	"math"
+	"slices"
+)
+
+// sizeBuckets maps read sizes to the buckets that samples are aggregated in.
+type sizeBuckets interface {
+	// bucket returns the bucket of a read of the given size.
+	bucket(size int) uint8
+	// label returns the value of the "bytes" label of samples in the given
+	// bucket. If ok is false samples are not labeled.
+	label(bucket uint8) (num int64, ok bool)
+}
+
+// powerOfTwoBuckets buckets reads by the next power of two of their size.
+type powerOfTwoBuckets struct{}
+
+func (powerOfTwoBuckets) bucket(size int) uint8 {
+	return nextPowerOfTwo(size)
+}
+
+func (powerOfTwoBuckets) label(bucket uint8) (int64, bool) {
+	return 1 << bucket, true
+}
+
+// noSizeBuckets puts all reads in the same bucket, so samples are aggregated
+// by stack only.
+type noSizeBuckets struct{}
+
+func (noSizeBuckets) bucket(int) uint8 {
+	return 0
+}
+
+func (noSizeBuckets) label(uint8) (int64, bool) {
+	return 0, false
+}
+
+// boundedBuckets buckets reads by user supplied inclusive upper bounds. Reads
+// larger than the largest bound go into an additional overflow bucket.
+type boundedBuckets struct {
+	bounds []int
+}
+
+func (b boundedBuckets) bucket(size int) uint8 {
+	i, _ := slices.BinarySearch(b.bounds, size)
+	return uint8(i)
+}
+
+func (b boundedBuckets) label(bucket uint8) (int64, bool) {
+	if int(bucket) >= len(b.bounds) {
+		return math.MaxInt64, true
+	}
+	return int64(b.bounds[bucket]), true
+}
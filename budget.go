@@ -0,0 +1,99 @@
+package rprof
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// budgetErrorStacks is the number of stacks listed in a BudgetError.
+const budgetErrorStacks = 5
+
+// SetReadBudget sets the read budget of the default profiler. See
+// Rprof.SetReadBudget.
+func SetReadBudget(limit int64, onExceed func(*BudgetError)) {
+	profiler.SetReadBudget(limit, onExceed)
+}
+
+// SetReadBudget limits the number of bytes that may be read within a single
+// Start/Stop window. This is intended for tests that want to catch read
+// amplification regressions. Once more than limit bytes were read, Stop
+// returns a *BudgetError alongside the profile. If onExceed is not nil it is
+// additionally called with the error as soon as the budget is exceeded, from
+// the goroutine performing the offending read. A limit of zero or less
+// disables the budget.
+func (p *Rprof) SetReadBudget(limit int64, onExceed func(*BudgetError)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.budget.limit = limit
+	p.budget.onExceed = onExceed
+}
+
+// BudgetError reports that more bytes were read than the read budget allows.
+type BudgetError struct {
+	// Limit is the configured budget in bytes.
+	Limit int64
+	// Bytes is the number of bytes read when the error was produced.
+	Bytes int64
+	// Top are the stacks that read the most bytes.
+	Top []StackSummary
+}
+
+// Error lists the stacks that read the most bytes.
+func (e *BudgetError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "read budget of %d bytes exceeded: %d bytes read; top stacks:", e.Limit, e.Bytes)
+	writeStacks(&sb, e.Top)
+	return sb.String()
+}
+
+// writeStacks writes the stacks to sb, each on its own lines.
+func writeStacks(sb *strings.Builder, top []StackSummary) {
+	for _, s := range top {
+		fmt.Fprintf(sb, "\n%d bytes in %d reads:", s.Bytes, s.Reads)
+		for _, f := range s.Frames {
+			sb.WriteString("\n\t")
+			sb.WriteString(f)
+		}
+	}
+}
+
+// readBudget tracks the bytes read within a window against a limit.
+type readBudget struct {
+	limit    int64
+	onExceed func(*BudgetError)
+
+	bytes    atomic.Int64
+	exceeded atomic.Bool
+}
+
+// reset starts tracking a new window.
+func (b *readBudget) reset() {
+	b.bytes.Store(0)
+	b.exceeded.Store(false)
+}
+
+// add adds n bytes to the window and reports whether the budget got exceeded
+// for the first time.
+func (b *readBudget) add(n int64) bool {
+	if b.limit <= 0 {
+		return false
+	}
+	if b.bytes.Add(n) <= b.limit {
+		return false
+	}
+	return b.exceeded.CompareAndSwap(false, true)
+}
+
+// err returns the error describing the exceeded budget without its top
+// stacks, nil if the budget wasn't exceeded.
+func (b *readBudget) err() *BudgetError {
+	if !b.exceeded.Load() {
+		return nil
+	}
+	return &BudgetError{
+		Limit: b.limit,
+		Bytes: b.bytes.Load(),
+	}
+}
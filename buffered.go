@@ -0,0 +1,89 @@
+package rprof
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// BufferedReader returns a new buffered reader profiled by the default
+// profiler. See Rprof.BufferedReader.
+func BufferedReader(r io.Reader, size int, opts ...WrapOption) *RprofBufferedReader {
+	return profiler.BufferedReader(r, size, opts...)
+}
+
+// RprofBufferedReader is an io.Reader that reads from a source through a
+// buffer and profiles the effectiveness of the buffer along with the reads.
+type RprofBufferedReader struct {
+	p   *Rprof
+	buf *bufio.Reader
+	src *countingReader
+	cfg wrapConfig
+	// fetched and hits are the indices of the values of the fetched and hits
+	// sample types, -1 if they aren't recorded.
+	fetched, hits int
+
+	// eof is true once a read returned io.EOF.
+	eof bool
+}
+
+// BufferedReader returns a new reader that reads from r through a
+// bufio.Reader with a buffer of at least size bytes, and profiles the reads
+// of its consumer. Besides the bytes read, each read records in the "fetched"
+// sample type the bytes the buffer fetched from r to serve it, and counts in
+// the "hits" sample type if it was served from the buffer alone. Both sample
+// types are added to the profiles of the profiler once a buffered reader is
+// created. Per stack,
+// hits divided by reads is the hit ratio of the buffer, which is low if the
+// buffer is too small for the consumer's reads, and fetched divided by read
+// bytes is how much more the buffer pulled from r than the consumer used,
+// which is also attached to the samples as the "amplification" label.
+func (p *Rprof) BufferedReader(r io.Reader, size int, opts ...WrapOption) *RprofBufferedReader {
+	src := &countingReader{r: r}
+	b := &RprofBufferedReader{
+		p:   p,
+		buf: bufio.NewReaderSize(src, size),
+		src: src,
+		cfg: newWrapConfig(context.Background(), opts),
+	}
+	b.fetched = p.registerValueType(fetchedType, &b.cfg)
+	b.hits = p.registerValueType(hitsType, &b.cfg)
+	return b
+}
+
+// hitsType is the sample type of the reads served from a buffer without
+// fetching from its source.
+var hitsType = valueType{ValueType: ValueType{Type: "hits", Unit: "count"}}
+
+// Read reads from the buffer, which fetches from the source if needed, and
+// records the sample in the profiler.
+// Implements io.Reader.
+func (r *RprofBufferedReader) Read(buf []byte) (int, error) {
+	before := r.src.n
+	ev := r.p.read(r.buf, buf, &r.cfg, &r.eof)
+	fetched := r.src.n - before
+	setValue(&ev, r.fetched, fetched)
+	if fetched == 0 && ev.n > 0 {
+		setValue(&ev, r.hits, 1)
+	}
+	r.p.recordSample(ev, &r.cfg)
+	return ev.n, ev.err
+}
+
+// Buffered returns the number of bytes that can be read from the buffer
+// without fetching from the source.
+func (r *RprofBufferedReader) Buffered() int {
+	return r.buf.Buffered()
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,79 @@
+package rprof
+
+import "sync"
+
+// localBuffer holds samples recorded by a single goroutine at a time without
+// locking, until they are flushed to the shards.
+type localBuffer struct {
+	samples map[sampleKey]*sampleValue
+	// stacks interns the stacks of the buffer's samples, which use the IDs
+	// of shard 0.
+	stacks stackTable
+}
+
+// resetBuffers discards all local buffers and their samples. p.mu must be
+// held exclusively, so no buffer is in use.
+func (p *Rprof) resetBuffers() {
+	if !p.cfg.localBuffers {
+		return
+	}
+
+	// Buffers dropped from the pool by the garbage collector are still
+	// referenced by p.buffers, so their samples aren't lost. Replacing the
+	// pool rather than reusing its buffers bounds the number of buffers to
+	// those created within a window.
+	p.buffers = nil
+	p.localBufs = &sync.Pool{
+		New: func() any {
+			b := &localBuffer{samples: map[sampleKey]*sampleValue{}}
+
+			p.buffersMu.Lock()
+			p.buffers = append(p.buffers, b)
+			p.buffersMu.Unlock()
+
+			return b
+		},
+	}
+}
+
+// flushBuffers merges the samples of all local buffers into the shards and
+// discards the buffers. p.mu must be held exclusively, so no buffer is in
+// use.
+func (p *Rprof) flushBuffers() {
+	if p.localBufs == nil {
+		return
+	}
+
+	for _, b := range p.buffers {
+		stacks := stackIndex{b.stacks.list}
+		for k, v := range b.samples {
+			sh := &p.shards[0]
+			if k.stack != 0 {
+				pcs := stacks.pcs(k.stack)
+				h := hashStack(pcs)
+
+				var shardIdx uint32
+				sh, shardIdx = p.shardFor(h)
+				local, ok := sh.stacks.lookup(h, pcs)
+				if !ok {
+					local = sh.stacks.insert(h, pcs)
+				}
+				k.stack = stackID(shardIdx, local)
+			}
+
+			if s, ok := sh.samples[k]; ok {
+				s.add(*v)
+				continue
+			}
+			sh.samples[k] = v
+		}
+	}
+
+	var n int64
+	for i := range p.shards {
+		n += int64(len(p.shards[i].samples))
+	}
+	p.numSamples.Store(n)
+
+	p.resetBuffers()
+}
@@ -0,0 +1,365 @@
+package rprof
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+const (
+	// numValues is the number of built-in sample types, and so values per
+	// sample, in a profile.
+	numValues = 9
+	// parallelBuildSamples is the number of samples from which profiles are
+	// built by several goroutines.
+	parallelBuildSamples = 1 << 14
+	// maxBuildWorkers is the maximum number of goroutines building a profile.
+	maxBuildWorkers = 16
+)
+
+// builderScratch holds the state of a profileBuilder that doesn't end up in
+// the profile, so it can be reused by the next profile. This matters in
+// continuous mode, which builds a profile per window.
+type builderScratch struct {
+	// locIdx maps PCs to their location IDs.
+	locIdx map[uintptr]uint64
+	// pcs is the buffer the PCs of a stack are copied into.
+	pcs []uintptr
+	// numLocations is the number of locations in the last profile, used to
+	// size the locations of the next one.
+	numLocations int
+}
+
+var builderScratchPool = sync.Pool{
+	New: func() any {
+		return &builderScratch{locIdx: map[uintptr]uint64{}}
+	},
+}
+
+// getBuilderScratch returns a builderScratch from the pool.
+func getBuilderScratch() *builderScratch {
+	return builderScratchPool.Get().(*builderScratch)
+}
+
+// putBuilderScratch clears s and returns it to the pool.
+func putBuilderScratch(s *builderScratch) {
+	clear(s.locIdx)
+	s.pcs = s.pcs[:0]
+	builderScratchPool.Put(s)
+}
+
+// slab allocates values in chunks rather than one at a time. The values are
+// never moved, so pointers to them stay valid.
+type slab[T any] struct {
+	buf  []T
+	next int
+}
+
+// newSlab returns a slab whose first chunk holds n values.
+func newSlab[T any](n int) slab[T] {
+	return slab[T]{next: max(n, 1)}
+}
+
+// new returns a pointer to a new zero value.
+func (s *slab[T]) new() *T {
+	if len(s.buf) == 0 {
+		s.buf = make([]T, s.next)
+		s.next = min(2*s.next, 4096)
+	}
+	v := &s.buf[0]
+	s.buf = s.buf[1:]
+	return v
+}
+
+// buildPart is the share of the samples of a profile built by one goroutine.
+type buildPart struct {
+	keys   []sampleKey
+	values []*sampleValue
+	// pcs are the distinct PCs of the stacks of the samples.
+	pcs []uintptr
+	// numLocs is the number of location indices of the samples.
+	numLocs int
+	samples []*proto.Sample
+}
+
+// labelTemplate is a decoded label whose strings were added to the string
+// table, so it can be turned into a proto.Label without the builder.
+type labelTemplate struct {
+	key, str, num, unit int64
+}
+
+// buildParallel builds the samples and locations of the profile on the given
+// number of goroutines. The samples are partitioned by stack, so that the
+// samples sharing a stack, and so its locations, are in the same part. The
+// goroutines find the distinct PCs of their part, which are then assigned
+// locations in order, and build the samples of their part. Everything that
+// adds to the string table or to the synthetic locations is done up front by
+// the calling goroutine.
+func (b *profileBuilder) buildParallel(samples map[sampleKey]*sampleValue, stacks stackIndex, workers int) {
+	scratch := getBuilderScratch()
+	defer putBuilderScratch(scratch)
+
+	parts := make([]buildPart, workers)
+	for i := range parts {
+		parts[i].keys = make([]sampleKey, 0, len(samples)/workers+1)
+		parts[i].values = make([]*sampleValue, 0, len(samples)/workers+1)
+	}
+
+	var truncated int64
+	var truncatedLoc, droppedLoc uint64
+	var goroutineKey, timeKey int64
+	labels := map[string][]labelTemplate{}
+	links := map[string]uint64{}
+	callers := map[uint32][]labelTemplate{}
+	sizeLocs := map[uint8]uint64{}
+	for k, v := range samples {
+		part := &parts[(k.stack^k.stack>>shardBits)%uint32(workers)]
+		part.keys = append(part.keys, k)
+		part.values = append(part.values, v)
+
+		if k.truncated {
+			if truncatedLoc == 0 {
+				truncatedLoc = b.addSyntheticLocation("[truncated]")
+			}
+			truncated += v.reads
+		}
+		if k.dropped {
+			droppedLoc = b.addSyntheticLocation("[dropped]")
+			b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+				"rprof: dropped %d reads exceeding the maximum of %d samples",
+				v.reads, b.cfg.maxSamples,
+			)))
+		}
+		if _, ok := sizeLocs[k.sizeBucket]; !ok {
+			if loc, ok := b.sizeLocation(k); ok {
+				sizeLocs[k.sizeBucket] = loc
+			}
+		}
+		if k.goroutine != 0 && goroutineKey == 0 {
+			goroutineKey = b.addString("goroutine")
+		}
+		if k.timeBucket != 0 && timeKey == 0 {
+			timeKey = b.addString("time")
+		}
+		if _, ok := labels[k.labels]; !ok {
+			var list []labelTemplate
+			var traceID, spanID string
+			decodeLabels(k.labels, func(l label) {
+				t := labelTemplate{key: b.addString(l.key)}
+				if l.numeric {
+					t.num = l.num
+					if l.unit != "" {
+						t.unit = b.addString(l.unit)
+					}
+				} else {
+					t.str = b.addString(l.value)
+					traceID, spanID = traceLabel(l, traceID, spanID)
+				}
+				list = append(list, t)
+			})
+			labels[k.labels] = list
+			links[k.labels] = b.addLink(traceID, spanID)
+		}
+		if _, ok := callers[k.stack]; !ok && b.cfg.callerLabels > 0 {
+			callers[k.stack] = b.callers(stacks, k.stack, nil)
+		}
+	}
+
+	// Find the distinct PCs of each part.
+	parallel(workers, func(i int) {
+		part := &parts[i]
+		seen := map[uintptr]struct{}{}
+		var pcs []uintptr
+		for _, k := range part.keys {
+			pcs = stacks.appendPCs(pcs[:0], k.stack)
+			part.numLocs += len(pcs) + 2
+			for _, pc := range pcs {
+				if _, ok := seen[pc]; !ok {
+					seen[pc] = struct{}{}
+					part.pcs = append(part.pcs, pc)
+				}
+			}
+		}
+	})
+
+	// Assign the locations, then look up their mappings in parallel.
+	first := len(b.p.Location)
+	locationSlab := newSlab[proto.Location](scratch.numLocations)
+	for i := range parts {
+		for _, pc := range parts[i].pcs {
+			if _, ok := scratch.locIdx[pc]; ok {
+				continue
+			}
+			location := locationSlab.new()
+			location.Id = uint64(len(b.p.Location)) + 1
+			location.Address = uint64(pc)
+			scratch.locIdx[pc] = location.Id
+			b.p.Location = append(b.p.Location, location)
+		}
+	}
+	locations := b.p.Location[first:]
+	chunk := (len(locations) + workers - 1) / workers
+	parallel(workers, func(i int) {
+		for _, location := range locations[min(i*chunk, len(locations)):min((i+1)*chunk, len(locations))] {
+			location.MappingIndex = b.mappingID(location.Address)
+		}
+	})
+
+	// Build the samples of each part.
+	buckets := b.cfg.buckets()
+	parallel(workers, func(i int) {
+		part := &parts[i]
+		allLocs := make([]uint64, 0, part.numLocs)
+		n := b.numValues()
+		allValues := make([]int64, n*len(part.keys))
+		sampleSlab := newSlab[proto.Sample](len(part.keys))
+		labelSlab := newSlab[proto.Label](len(part.keys))
+		part.samples = make([]*proto.Sample, 0, len(part.keys))
+
+		var pcs []uintptr
+		for j, k := range part.keys {
+			v := part.values[j]
+			start := len(allLocs)
+			sizeLoc, sizeFrame := sizeLocs[k.sizeBucket]
+			sizeFrame = sizeFrame && !k.unsized
+			if sizeFrame {
+				allLocs = append(allLocs, sizeLoc)
+			}
+			pcs = stacks.appendPCs(pcs[:0], k.stack)
+			for _, pc := range pcs {
+				allLocs = append(allLocs, scratch.locIdx[pc])
+			}
+			if k.truncated {
+				allLocs = append(allLocs, truncatedLoc)
+			}
+			if k.dropped {
+				allLocs = append(allLocs, droppedLoc)
+			}
+
+			values := allValues[:n:n]
+			allValues = allValues[n:]
+			v.fill(values)
+
+			sample := sampleSlab.new()
+			sample.LocationIndex = allLocs[start:len(allLocs):len(allLocs)]
+			sample.Value = values
+			if num, ok := buckets.label(k.sizeBucket); ok && !k.unsized && !sizeFrame {
+				l := addLabel(sample, &labelSlab)
+				l.Key = 4 // "bytes"
+				l.Num = num
+			}
+			if k.goroutine != 0 {
+				l := addLabel(sample, &labelSlab)
+				l.Key = goroutineKey
+				l.Num = int64(k.goroutine)
+			}
+			if k.timeBucket != 0 {
+				l := addLabel(sample, &labelSlab)
+				l.Key = timeKey
+				l.Num = k.timeBucket
+				l.NumUnit = 6 // "nanoseconds"
+			}
+			b.addDerivedLabels(sample, v, &labelSlab)
+			sample.Link = links[k.labels]
+			for _, t := range labels[k.labels] {
+				l := addLabel(sample, &labelSlab)
+				l.Key = t.key
+				l.Str = t.str
+				l.Num = t.num
+				l.NumUnit = t.unit
+			}
+			for _, t := range callers[k.stack] {
+				l := addLabel(sample, &labelSlab)
+				l.Key = t.key
+				l.Str = t.str
+			}
+			part.samples = append(part.samples, sample)
+		}
+	})
+
+	b.p.Sample = make([]*proto.Sample, 0, len(samples))
+	for i := range parts {
+		b.p.Sample = append(b.p.Sample, parts[i].samples...)
+	}
+	if truncated > 0 {
+		b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+			"rprof: truncated the stacks of %d reads exceeding the maximum depth of %d frames",
+			truncated, b.cfg.stackDepth(),
+		)))
+	}
+	scratch.numLocations = len(b.p.Location)
+}
+
+// parallel calls fn with each of 0 to n-1 on its own goroutine and waits for
+// them to return.
+func parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// forEachSample calls fn with each sample, in canonical order if configured.
+// See WithCanonicalOrder.
+func (b *profileBuilder) forEachSample(samples map[sampleKey]*sampleValue, stacks stackIndex, fn func(sampleKey, *sampleValue)) {
+	if !b.cfg.canonical {
+		for k, v := range samples {
+			fn(k, v)
+		}
+		return
+	}
+
+	type entry struct {
+		k   sampleKey
+		pcs []uintptr
+	}
+	// The stacks are copied into a single buffer that is sized up front, so
+	// it is never reallocated.
+	depth := 0
+	for k := range samples {
+		depth += stacks.depth(k.stack)
+	}
+	entries := make([]entry, 0, len(samples))
+	buf := make([]uintptr, 0, depth)
+	for k := range samples {
+		start := len(buf)
+		buf = stacks.appendPCs(buf, k.stack)
+		entries = append(entries, entry{k: k, pcs: buf[start:len(buf):len(buf)]})
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Or(
+			slices.Compare(a.pcs, b.pcs),
+			cmp.Compare(a.k.sizeBucket, b.k.sizeBucket),
+			compareBool(a.k.unsized, b.k.unsized),
+			cmp.Compare(a.k.labels, b.k.labels),
+			cmp.Compare(a.k.goroutine, b.k.goroutine),
+			cmp.Compare(a.k.timeBucket, b.k.timeBucket),
+			compareBool(a.k.truncated, b.k.truncated),
+			compareBool(a.k.dropped, b.k.dropped),
+		)
+	})
+	for _, e := range entries {
+		fn(e.k, samples[e.k])
+	}
+}
+
+// compareBool compares booleans with false before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,76 @@
+package rprof
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// callerLabel is the label key of the leaf frame attached by
+// WithCallerLabels, deeper frames have their depth appended.
+const callerLabel = "caller"
+
+// WithCallerLabels attaches the file and line of the n leaf-most frames of
+// each sample's stack as labels, "caller" for the leaf frame and "caller.1"
+// to "caller.<n-1>" for its callers, formatted as "dir/file.go:line". Only the
+// distinct frames of the profile are resolved, when it is built, which gives
+// profiles that are mostly readable without the binary at a fraction of the
+// cost of WithSymbolization.
+func WithCallerLabels(n int) Option {
+	return func(p *Rprof) {
+		p.cfg.callerLabels = n
+	}
+}
+
+// callers appends the caller labels of the stack with the given ID to dst,
+// resolving the frames of PCs seen for the first time.
+func (b *profileBuilder) callers(stacks stackIndex, id uint32, dst []labelTemplate) []labelTemplate {
+	n := b.cfg.callerLabels
+	if n <= 0 {
+		return dst
+	}
+	for len(b.callerKeys) < n {
+		key := callerLabel
+		if i := len(b.callerKeys); i > 0 {
+			key += "." + strconv.Itoa(i)
+		}
+		b.callerKeys = append(b.callerKeys, b.addString(key))
+	}
+	if b.callerFrames == nil {
+		b.callerFrames = map[uintptr][]int64{}
+	}
+
+	b.callerPCs = stacks.appendPCs(b.callerPCs[:0], id)
+	for _, pc := range b.callerPCs {
+		frames, ok := b.callerFrames[pc]
+		if !ok {
+			frames = b.resolveCaller(pc)
+			b.callerFrames[pc] = frames
+		}
+		for _, f := range frames {
+			if len(dst) == n {
+				return dst
+			}
+			dst = append(dst, labelTemplate{key: b.callerKeys[len(dst)], str: f})
+		}
+	}
+	return dst
+}
+
+// resolveCaller returns the string table indices of the file and line of
+// the frames at pc, the inlined ones first.
+func (b *profileBuilder) resolveCaller(pc uintptr) []int64 {
+	var res []int64
+	// The PCs are return addresses, which CallersFrames accounts for.
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		f, more := frames.Next()
+		if f.File != "" {
+			file := filepath.Join(filepath.Base(filepath.Dir(f.File)), filepath.Base(f.File))
+			res = append(res, b.addString(filepath.ToSlash(file)+":"+strconv.Itoa(f.Line)))
+		}
+		if !more {
+			return res
+		}
+	}
+}
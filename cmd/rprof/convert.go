@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// convert implements the convert command.
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := fs.String("from", formatPprof, "input format")
+	to := fs.String("to", formatPprof, "output format")
+	sample := fs.String("sample", "", "sample type of folded and speedscope output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("convert takes an input and optionally an output file")
+	}
+
+	r, err := open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	prof, err := readProfile(r, *from)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	w, err := create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	err = writeProfile(w, prof, *to, *sample)
+	return errors.Join(err, w.Close())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// fetch implements the fetch command.
+func fetch(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	out := fs.String("o", "-", "output file, - for stdout")
+	to := fs.String("format", formatPprof, "output format")
+	sample := fs.String("sample", "", "sample type of folded and speedscope output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("fetch takes exactly one URL")
+	}
+
+	resp, err := http.Get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s: %s", fs.Arg(0), resp.Status, bytes.TrimSpace(body))
+	}
+
+	prof, err := readProfile(bytes.NewReader(body), formatPprof)
+	if err != nil {
+		return err
+	}
+
+	w, err := create(*out)
+	if err != nil {
+		return err
+	}
+	if *to == formatPprof {
+		// Keep the profile as served.
+		_, err = w.Write(body)
+	} else {
+		err = writeProfile(w, prof, *to, *sample)
+	}
+	return errors.Join(err, w.Close())
+}
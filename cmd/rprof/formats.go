@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	formatPprof      = "pprof"
+	formatOTLP       = "otlp"
+	formatFolded     = "folded"
+	formatSpeedscope = "speedscope"
+)
+
+// readProfile reads a profile in the given format from r. Input may be gzip
+// compressed in any format.
+func readProfile(r io.Reader, format string) (*proto.Profile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case formatPprof:
+		// rprof's profiles are wire compatible with pprof's.
+		prof := &proto.Profile{}
+		if err := protobuf.Unmarshal(data, prof); err != nil {
+			return nil, err
+		}
+		return prof, nil
+	case formatOTLP:
+		var pd proto.ProfilesData
+		if err := protobuf.Unmarshal(data, &pd); err != nil {
+			return nil, err
+		}
+		var profs []*proto.Profile
+		for _, rp := range pd.ResourceProfiles {
+			for _, sp := range rp.ScopeProfiles {
+				for _, c := range sp.Profiles {
+					profs = append(profs, c.Profile)
+				}
+			}
+		}
+		if len(profs) != 1 {
+			return nil, fmt.Errorf("expected a single profile but found %d", len(profs))
+		}
+		return profs[0], nil
+	case formatFolded, formatSpeedscope:
+		return nil, fmt.Errorf("reading %s is not supported", format)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// writeProfile writes the profile in the given format to w. sample is the
+// sample type written in formats that hold a single one.
+func writeProfile(w io.Writer, prof *proto.Profile, format, sample string) error {
+	switch format {
+	case formatPprof:
+		data, err := protobuf.Marshal(prof)
+		if err != nil {
+			return err
+		}
+		gz := gzip.NewWriter(w)
+		if _, err := gz.Write(data); err != nil {
+			return err
+		}
+		return gz.Close()
+	case formatOTLP:
+		data, err := protobuf.Marshal(&proto.ProfilesData{
+			ResourceProfiles: []*proto.ResourceProfiles{{
+				ScopeProfiles: []*proto.ScopeProfiles{{
+					Profiles: []*proto.ProfileContainer{{
+						StartTimeUnixNano: uint64(prof.TimeNanos),
+						EndTimeUnixNano:   uint64(prof.TimeNanos + prof.DurationNanos),
+						Profile:           prof,
+					}},
+				}},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case formatFolded:
+		return writeFolded(w, prof, sample)
+	case formatSpeedscope:
+		return writeSpeedscope(w, prof, sample)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// sampleIndex returns the index of the values of the sample type with the
+// given name, or of the default sample type if name is empty.
+func sampleIndex(prof *proto.Profile, name string) (int, error) {
+	for i, st := range prof.SampleType {
+		if name == "" && st.Type == prof.DefaultSampleType || name != "" && str(prof, st.Type) == name {
+			return i, nil
+		}
+	}
+	if name == "" {
+		if len(prof.SampleType) == 0 {
+			return 0, errors.New("profile has no sample types")
+		}
+		// Consumers such as pprof default to the last sample type.
+		return len(prof.SampleType) - 1, nil
+	}
+	return 0, fmt.Errorf("no sample type %q", name)
+}
+
+// str returns the string at index i of the string table of the profile.
+func str(prof *proto.Profile, i int64) string {
+	if i < 0 || i >= int64(len(prof.StringTable)) {
+		return ""
+	}
+	return prof.StringTable[i]
+}
+
+// frame is a single frame of a stack.
+type frame struct {
+	name string
+	file string
+	line int64
+}
+
+// stacks calls fn with the frames of the stack of each sample, root first,
+// and the value of the sample at index i. Locations that aren't symbolized
+// are named by their address.
+func stacks(prof *proto.Profile, i int, fn func(frames []frame, value int64)) {
+	locs := make(map[uint64]*proto.Location, len(prof.Location))
+	for _, loc := range prof.Location {
+		locs[loc.Id] = loc
+	}
+	funcs := make(map[uint64]*proto.Function, len(prof.Function))
+	for _, f := range prof.Function {
+		funcs[f.Id] = f
+	}
+
+	var frames []frame
+	for _, s := range prof.Sample {
+		if i >= len(s.Value) || s.Value[i] == 0 {
+			continue
+		}
+
+		// Locations are leaf first, as are their inlined lines.
+		frames = frames[:0]
+		for _, id := range s.LocationIndex {
+			loc := locs[id]
+			if loc == nil {
+				continue
+			}
+			if len(loc.Line) == 0 {
+				frames = append(frames, frame{name: fmt.Sprintf("%#x", loc.Address)})
+				continue
+			}
+			for _, line := range loc.Line {
+				f := funcs[line.FunctionIndex]
+				if f == nil {
+					continue
+				}
+				frames = append(frames, frame{name: str(prof, f.Name), file: str(prof, f.Filename), line: line.Line})
+			}
+		}
+		slices.Reverse(frames)
+		fn(frames, s.Value[i])
+	}
+}
+
+// foldedReplacer replaces the characters that separate frames and values in
+// folded stacks.
+var foldedReplacer = strings.NewReplacer(";", ":", " ", "_")
+
+// writeFolded writes the stacks of the profile as folded stacks, one line of
+// semicolon separated frames, root first, and the value per stack.
+func writeFolded(w io.Writer, prof *proto.Profile, sample string) error {
+	i, err := sampleIndex(prof, sample)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]int64{}
+	var b strings.Builder
+	stacks(prof, i, func(frames []frame, value int64) {
+		b.Reset()
+		for j, f := range frames {
+			if j > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(foldedReplacer.Replace(f.name))
+		}
+		if b.Len() == 0 {
+			b.WriteString("[unknown]")
+		}
+		values[b.String()] += value
+	})
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range keys {
+		fmt.Fprintf(bw, "%s %d\n", k, values[k])
+	}
+	return bw.Flush()
+}
+
+// speedscopeFile is the JSON file format of speedscope, see
+// https://www.speedscope.app/file-format-schema.json.
+type speedscopeFile struct {
+	Schema   string              `json:"$schema"`
+	Shared   speedscopeShared    `json:"shared"`
+	Profiles []speedscopeProfile `json:"profiles"`
+	Exporter string              `json:"exporter"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	Line int64  `json:"line,omitempty"`
+}
+
+type speedscopeProfile struct {
+	Type       string  `json:"type"`
+	Name       string  `json:"name"`
+	Unit       string  `json:"unit"`
+	StartValue int64   `json:"startValue"`
+	EndValue   int64   `json:"endValue"`
+	Samples    [][]int `json:"samples"`
+	Weights    []int64 `json:"weights"`
+}
+
+// writeSpeedscope writes the stacks of the profile as a sampled profile in
+// speedscope's file format.
+func writeSpeedscope(w io.Writer, prof *proto.Profile, sample string) error {
+	i, err := sampleIndex(prof, sample)
+	if err != nil {
+		return err
+	}
+
+	st := prof.SampleType[i]
+	unit := str(prof, st.Unit)
+	switch unit {
+	case "bytes", "nanoseconds":
+	default:
+		unit = "none"
+	}
+
+	file := speedscopeFile{
+		Schema:   "https://www.speedscope.app/file-format-schema.json",
+		Exporter: "rprof",
+		Shared:   speedscopeShared{Frames: []speedscopeFrame{}},
+	}
+	p := speedscopeProfile{
+		Type:    "sampled",
+		Name:    str(prof, st.Type),
+		Unit:    unit,
+		Samples: [][]int{},
+		Weights: []int64{},
+	}
+
+	index := map[frame]int{}
+	stacks(prof, i, func(frames []frame, value int64) {
+		s := make([]int, len(frames))
+		for j, f := range frames {
+			idx, ok := index[f]
+			if !ok {
+				idx = len(file.Shared.Frames)
+				index[f] = idx
+				file.Shared.Frames = append(file.Shared.Frames, speedscopeFrame{Name: f.name, File: f.file, Line: f.line})
+			}
+			s[j] = idx
+		}
+		p.Samples = append(p.Samples, s)
+		p.Weights = append(p.Weights, value)
+		p.EndValue += value
+	})
+	file.Profiles = []speedscopeProfile{p}
+
+	return json.NewEncoder(w).Encode(file)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// testProfile returns a profile with two symbolized stacks, one of which
+// holds an inlined call, and one unsymbolized stack.
+func testProfile() *proto.Profile {
+	return &proto.Profile{
+		StringTable: []string{"", "reads", "count", "read", "bytes", "main", "main.go", "f", "g"},
+		SampleType: []*proto.ValueType{
+			{Type: 1, Unit: 2},
+			{Type: 3, Unit: 4},
+		},
+		DefaultSampleType: 3,
+		Function: []*proto.Function{
+			{Id: 1, Name: 5, Filename: 6},
+			{Id: 2, Name: 7, Filename: 6},
+			{Id: 3, Name: 8, Filename: 6},
+		},
+		Location: []*proto.Location{
+			{Id: 1, Address: 0x10, Line: []*proto.Line{{FunctionIndex: 1, Line: 10}}},
+			// g is inlined into f.
+			{Id: 2, Address: 0x20, Line: []*proto.Line{{FunctionIndex: 3, Line: 30}, {FunctionIndex: 2, Line: 20}}},
+			{Id: 3, Address: 0x30},
+		},
+		Sample: []*proto.Sample{
+			{LocationIndex: []uint64{2, 1}, Value: []int64{1, 100}},
+			{LocationIndex: []uint64{1}, Value: []int64{2, 50}},
+			{LocationIndex: []uint64{3, 1}, Value: []int64{3, 0}},
+		},
+		TimeNanos:     1,
+		DurationNanos: 2,
+	}
+}
+
+func TestFolded(t *testing.T) {
+	for _, tc := range []struct {
+		sample string
+		want   string
+	}{
+		{"", "main 50\nmain;f;g 100\n"},
+		{"reads", "main 2\nmain;0x30 3\nmain;f;g 1\n"},
+	} {
+		var buf bytes.Buffer
+		if err := writeProfile(&buf, testProfile(), formatFolded, tc.sample); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("sample %q: got\n%s\nwant\n%s", tc.sample, buf.String(), tc.want)
+		}
+	}
+
+	if err := writeProfile(&bytes.Buffer{}, testProfile(), formatFolded, "missing"); err == nil {
+		t.Error("expected error for a missing sample type")
+	}
+}
+
+func TestSpeedscope(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeProfile(&buf, testProfile(), formatSpeedscope, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var file speedscopeFile
+	if err := json.Unmarshal(buf.Bytes(), &file); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Profiles) != 1 {
+		t.Fatalf("expected 1 profile, got %d", len(file.Profiles))
+	}
+	p := file.Profiles[0]
+	if p.Unit != "bytes" || p.EndValue != 150 {
+		t.Errorf("got unit %q and end value %d", p.Unit, p.EndValue)
+	}
+	if len(p.Samples) != 2 || len(p.Weights) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(p.Samples))
+	}
+	var names []string
+	for _, i := range p.Samples[0] {
+		names = append(names, file.Shared.Frames[i].Name)
+	}
+	if want := []string{"main", "f", "g"}; !slices.Equal(names, want) {
+		t.Errorf("got stack %v, want %v", names, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{formatPprof, formatOTLP} {
+		var buf bytes.Buffer
+		if err := writeProfile(&buf, testProfile(), format, ""); err != nil {
+			t.Fatal(err)
+		}
+		prof, err := readProfile(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !protobuf.Equal(prof, testProfile()) {
+			t.Errorf("%s: profile changed in round trip", format)
+		}
+	}
+}
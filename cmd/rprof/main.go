@@ -0,0 +1,115 @@
+// Command rprof fetches, converts and inspects read profiles collected by
+// github.com/polarsignals/rprof.
+//
+// Usage:
+//
+//	rprof fetch [-o file] [-format format] url
+//	rprof convert [-from format] [-to format] [-sample type] in [out]
+//	rprof merge [-o file] [-from format] [-to format] [-sample type] in...
+//	rprof diff [-o file] [-from format] [-to format] [-sample type] base new
+//	rprof top [-from format] [-sample type] [-n count] [-cum] in
+//
+// fetch downloads a profile from the endpoint of a running service, for
+// example http://host/debug/rprof?seconds=30, and writes it to the given file,
+// or stdout by default. convert reads the profile in, or stdin if it is "-",
+// and writes it to out, or stdout by default.
+//
+// merge aggregates the samples of the given profiles, for example the
+// profiles fetched from all instances of a service, into a single profile.
+// diff subtracts the base profile from the new one, so the result holds the
+// growth between them as positive and the shrinkage as negative values. Both
+// write to the given file, or stdout by default. The profiles must have the
+// same sample types.
+//
+// top prints the functions of the profile ranked by the value of the samples
+// they are the leaf of, or with -cum by the value of the samples they are on
+// the stack of.
+//
+// The formats are:
+//
+//	pprof       the gzip compressed profile served by rprof, which go tool pprof reads
+//	otlp        an OTLP ProfilesData message holding the profile
+//	folded      the folded stacks read by flamegraph.pl, written only
+//	speedscope  the JSON file format of speedscope, written only
+//
+// Folded stacks and speedscope files hold a single sample type, which is
+// chosen with -sample, for example "reads" or "latency", and defaults to the
+// default sample type of the profile, the bytes read.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "fetch":
+		err = fetch(args)
+	case "convert":
+		err = convert(args)
+	case "merge":
+		err = merge(args)
+	case "diff":
+		err = diff(args)
+	case "top":
+		err = top(args)
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "rprof: unknown command %q\n", cmd)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rprof: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// usage writes the usage of the command to w.
+func usage(w io.Writer) {
+	fmt.Fprint(w, `usage:
+	rprof fetch [-o file] [-format format] url
+	rprof convert [-from format] [-to format] [-sample type] in [out]
+	rprof merge [-o file] [-from format] [-to format] [-sample type] in...
+	rprof diff [-o file] [-from format] [-to format] [-sample type] base new
+	rprof top [-from format] [-sample type] [-n count] [-cum] in
+
+formats: pprof, otlp, folded, speedscope
+`)
+}
+
+// create returns the file to write the output to, stdout if name is empty or
+// "-".
+func create(name string) (io.WriteCloser, error) {
+	if name == "" || name == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+// open returns the file to read the input from, stdin if name is "-".
+func open(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// nopCloser is a writer whose Close does nothing, so stdout isn't closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
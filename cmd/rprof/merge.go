@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+
+	"github.com/google/pprof/profile"
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// merge implements the merge command.
+func merge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	out := fs.String("o", "-", "output file, - for stdout")
+	from := fs.String("from", formatPprof, "input format")
+	to := fs.String("to", formatPprof, "output format")
+	sample := fs.String("sample", "", "sample type of folded and speedscope output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("merge takes at least one input file")
+	}
+
+	profs := make([]*profile.Profile, 0, fs.NArg())
+	for _, name := range fs.Args() {
+		p, err := readPprof(name, *from)
+		if err != nil {
+			return err
+		}
+		profs = append(profs, p)
+	}
+
+	merged, err := profile.Merge(profs)
+	if err != nil {
+		return err
+	}
+	return writePprof(*out, merged, *to, *sample)
+}
+
+// diff implements the diff command.
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	out := fs.String("o", "-", "output file, - for stdout")
+	from := fs.String("from", formatPprof, "input format")
+	to := fs.String("to", formatPprof, "output format")
+	sample := fs.String("sample", "", "sample type of folded and speedscope output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("diff takes a base and a new profile")
+	}
+
+	base, err := readPprof(fs.Arg(0), *from)
+	if err != nil {
+		return err
+	}
+	p, err := readPprof(fs.Arg(1), *from)
+	if err != nil {
+		return err
+	}
+
+	// Samples present in both profiles cancel out and are dropped by the
+	// merge, leaving the growth as positive and the shrinkage as negative
+	// values.
+	base.Scale(-1)
+	d, err := profile.Merge([]*profile.Profile{p, base})
+	if err != nil {
+		return err
+	}
+	return writePprof(*out, d, *to, *sample)
+}
+
+// readPprof reads the profile in the named file in the given format, as a
+// pprof profile.
+func readPprof(name, format string) (*profile.Profile, error) {
+	r, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	prof, err := readProfile(r, format)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	return toPprof(prof)
+}
+
+// writePprof writes the pprof profile to the named file in the given format.
+func writePprof(name string, p *profile.Profile, format, sample string) error {
+	prof, err := fromPprof(p)
+	if err != nil {
+		return err
+	}
+	w, err := create(name)
+	if err != nil {
+		return err
+	}
+	err = writeProfile(w, prof, format, sample)
+	return errors.Join(err, w.Close())
+}
+
+// toPprof converts the profile to a pprof profile, which it is wire
+// compatible with.
+func toPprof(prof *proto.Profile) (*profile.Profile, error) {
+	data, err := protobuf.Marshal(prof)
+	if err != nil {
+		return nil, err
+	}
+	return profile.ParseData(data)
+}
+
+// fromPprof converts the pprof profile back to a profile.
+func fromPprof(p *profile.Profile) (*proto.Profile, error) {
+	var buf bytes.Buffer
+	if err := p.WriteUncompressed(&buf); err != nil {
+		return nil, err
+	}
+	prof := &proto.Profile{}
+	if err := protobuf.Unmarshal(buf.Bytes(), prof); err != nil {
+		return nil, err
+	}
+	return prof, nil
+}
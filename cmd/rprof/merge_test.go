@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestMergeDiff(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.pb.gz"), filepath.Join(dir, "b.pb.gz")
+	for _, name := range []string{a, b} {
+		var buf bytes.Buffer
+		if err := writeProfile(&buf, testProfile(), formatPprof, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merged := filepath.Join(dir, "merged.pb.gz")
+	if err := merge([]string{"-o", merged, a, b}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPprof(merged, formatPprof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := total(p, 1); got != 300 {
+		t.Errorf("expected 300 bytes in the merged profile, got %d", got)
+	}
+
+	// Diffing the merged profile against one of its inputs leaves the other.
+	diffed := filepath.Join(dir, "diff.pb.gz")
+	if err := diff([]string{"-o", diffed, a, merged}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = readPprof(diffed, formatPprof); err != nil {
+		t.Fatal(err)
+	}
+	if got := total(p, 1); got != 150 {
+		t.Errorf("expected 150 bytes in the diff, got %d", got)
+	}
+
+	// And the other way around the values are negative.
+	if err := diff([]string{"-o", diffed, merged, a}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = readPprof(diffed, formatPprof); err != nil {
+		t.Fatal(err)
+	}
+	if got := total(p, 1); got != -150 {
+		t.Errorf("expected -150 bytes in the diff, got %d", got)
+	}
+
+	// A profile diffed against itself is empty.
+	if err := diff([]string{"-o", diffed, a, a}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = readPprof(diffed, formatPprof); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Sample) != 0 {
+		t.Errorf("expected no samples, got %d", len(p.Sample))
+	}
+}
+
+func TestTopEntries(t *testing.T) {
+	entries, total, err := topEntries(testProfile(), "reads", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 6 {
+		t.Errorf("expected a total of 6, got %d", total)
+	}
+	want := []topEntry{
+		{name: "0x30", flat: 3, cum: 3},
+		{name: "main", flat: 2, cum: 6},
+		{name: "g", flat: 1, cum: 1},
+		{name: "f", flat: 0, cum: 1},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %v, want %v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d: got %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	entries, _, err = topEntries(testProfile(), "reads", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].name != "main" {
+		t.Errorf("expected main to rank first by cumulative value, got %s", entries[0].name)
+	}
+}
+
+// total returns the sum of the values at index i of the samples of p.
+func total(p *profile.Profile, i int) int64 {
+	var sum int64
+	for _, s := range p.Sample {
+		sum += s.Value[i]
+	}
+	return sum
+}
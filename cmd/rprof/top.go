@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// top implements the top command.
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	from := fs.String("from", formatPprof, "input format")
+	sample := fs.String("sample", "", "sample type to rank by")
+	n := fs.Int("n", 10, "number of functions to show")
+	cum := fs.Bool("cum", false, "rank by cumulative instead of flat value")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("top takes exactly one input file")
+	}
+
+	r, err := open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	prof, err := readProfile(r, *from)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	entries, total, err := topEntries(prof, *sample, *cum)
+	if err != nil {
+		return err
+	}
+	if len(entries) > *n {
+		entries = entries[:*n]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "flat\tflat%%\tcum\tcum%%\t\n")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t %s\n", e.flat, percent(e.flat, total), e.cum, percent(e.cum, total), e.name)
+	}
+	return w.Flush()
+}
+
+// topEntry is the aggregate of the values of a function.
+type topEntry struct {
+	name string
+	// flat is the value of the samples the function is the leaf of.
+	flat int64
+	// cum is the value of the samples the function is on the stack of.
+	cum int64
+}
+
+// topEntries aggregates the values of the given sample type by function and
+// ranks them by their flat, or cumulative, value. Profiles produced by diff
+// hold negative values, so the entries are ranked by their magnitude. It
+// also returns the total magnitude of the values.
+func topEntries(prof *proto.Profile, sample string, cum bool) ([]topEntry, int64, error) {
+	i, err := sampleIndex(prof, sample)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	entries := map[string]*topEntry{}
+	seen := map[string]bool{}
+	stacks(prof, i, func(frames []frame, value int64) {
+		total += abs(value)
+		clear(seen)
+		for j, f := range frames {
+			e, ok := entries[f.name]
+			if !ok {
+				e = &topEntry{name: f.name}
+				entries[f.name] = e
+			}
+			if j == len(frames)-1 {
+				e.flat += value
+			}
+			// Count recursive functions once.
+			if !seen[f.name] {
+				seen[f.name] = true
+				e.cum += value
+			}
+		}
+	})
+
+	res := make([]topEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, *e)
+	}
+	slices.SortFunc(res, func(a, b topEntry) int {
+		x, y := a.flat, b.flat
+		if cum {
+			x, y = a.cum, b.cum
+		}
+		if c := cmp.Compare(abs(y), abs(x)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.name, b.name)
+	})
+	return res, total, nil
+}
+
+// percent formats v as a percentage of total.
+func percent(v, total int64) string {
+	if total == 0 {
+		return "0.00%"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(v)/float64(total))
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,79 @@
+package rprof
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// Collect collects a profile with the default profiler until ctx is done. See
+// Rprof.Collect.
+func Collect(ctx context.Context) (*proto.Profile, error) {
+	return profiler.Collect(ctx)
+}
+
+// StartWriting starts the default profiler, writing the profile to w when it
+// is stopped. See Rprof.StartWriting.
+func StartWriting(w io.Writer) error {
+	return profiler.StartWriting(w)
+}
+
+// StartFor collects a profile with the default profiler for d. See
+// Rprof.StartFor.
+func StartFor(d time.Duration) (*proto.Profile, error) {
+	return profiler.StartFor(d)
+}
+
+// Collect starts the profiler, waits until ctx is done, then stops the
+// profiler and returns the profile. The end of ctx is how the collection
+// ends, so its error isn't returned, unless ctx is already done when Collect
+// is called, in which case the profiler isn't started at all. If the profiler
+// is already started then it returns an error and leaves the profiler
+// running. Otherwise the profiler is left stopped when Collect returns.
+func (p *Rprof) Collect(ctx context.Context) (*proto.Profile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+
+	<-ctx.Done()
+	return p.Stop()
+}
+
+// StartFor starts the profiler, waits for d, then stops the profiler and
+// returns the profile. See Collect.
+func (p *Rprof) StartFor(d time.Duration) (*proto.Profile, error) {
+	if d <= 0 {
+		return nil, errors.New("duration must be positive")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return p.Collect(ctx)
+}
+
+// StartWriting starts the profiler like Start, and makes the next Stop
+// marshal, compress and write the profile to w, like pprof.StartCPUProfile.
+// Stop returns the profile as usual, along with the error of writing it, if
+// any. If the profiler is already started then it returns an error. Options
+// are given to NewProfiler as usual, since they are fixed once a profiler is
+// created.
+func (p *Rprof) StartWriting(w io.Writer) error {
+	if w == nil {
+		return errors.New("writer must not be nil")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.startLocked(); err != nil {
+		return err
+	}
+	p.writer = w
+	return nil
+}
@@ -0,0 +1,128 @@
+package rprof
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn returns a new net.Conn whose reads are profiled by the default
+// profiler. See Rprof.Conn.
+func Conn(c net.Conn, opts ...WrapOption) net.Conn {
+	return profiler.Conn(c, opts...)
+}
+
+// Listener returns a new net.Listener whose connections are profiled by the
+// default profiler. See Rprof.Listener.
+func Listener(l net.Listener, opts ...WrapOption) net.Listener {
+	return profiler.Listener(l, opts...)
+}
+
+// RprofConn is a net.Conn whose reads are profiled if the profiler is on.
+// Writes go to the underlying connection unprofiled.
+type RprofConn struct {
+	net.Conn
+	p   *Rprof
+	cfg wrapConfig
+
+	// eof is true once a read returned io.EOF. It is atomic since the
+	// methods of a net.Conn may be called from several goroutines at once.
+	eof atomic.Bool
+	// opened is when the connection was wrapped, and reads and bytes its
+	// totals. See Rprof.Conns.
+	opened time.Time
+	reads  atomic.Int64
+	bytes  atomic.Int64
+	// closeOnce untracks the connection on the first Close.
+	closeOnce sync.Once
+}
+
+// Conn returns a new net.Conn that profiles the reads of c.
+func (p *Rprof) Conn(c net.Conn, opts ...WrapOption) net.Conn {
+	return p.newConn(c, newWrapConfig(context.Background(), opts))
+}
+
+// newConn returns a new RprofConn with the given configuration, tracked
+// until it is closed.
+func (p *Rprof) newConn(c net.Conn, cfg wrapConfig) *RprofConn {
+	rc := &RprofConn{Conn: c, p: p, cfg: cfg, opened: time.Now()}
+	p.conns.add(rc)
+	return rc
+}
+
+// Read reads from the underlying connection and records the sample in the
+// profiler.
+// Implements io.Reader.
+func (c *RprofConn) Read(buf []byte) (int, error) {
+	ev := c.p.read(c.Conn, buf, &c.cfg, nil)
+	ev.eof = ev.err == io.EOF && c.eof.CompareAndSwap(false, true)
+	c.reads.Add(1)
+	c.bytes.Add(int64(ev.n))
+	c.p.recordSample(ev, &c.cfg)
+	return ev.n, ev.err
+}
+
+// Close closes the underlying connection and stops tracking it.
+// Implements io.Closer.
+func (c *RprofConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.p.conns.remove(c)
+	})
+	return c.Conn.Close()
+}
+
+// stats returns the totals of the connection at the given time.
+func (c *RprofConn) stats(now time.Time) ConnStats {
+	s := ConnStats{
+		Opened:   c.opened,
+		Duration: now.Sub(c.opened),
+		Reads:    c.reads.Load(),
+		Bytes:    c.bytes.Load(),
+	}
+	if a := c.LocalAddr(); a != nil {
+		s.Local = a.String()
+	}
+	if a := c.RemoteAddr(); a != nil {
+		s.Remote = a.String()
+	}
+	return s
+}
+
+// ReadFrom writes the data of r to the underlying connection, using its fast
+// path, such as sendfile, if it has one.
+// Implements io.ReaderFrom.
+func (c *RprofConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// rprofListener is a net.Listener whose connections are profiled.
+type rprofListener struct {
+	net.Listener
+	p   *Rprof
+	cfg wrapConfig
+}
+
+// Listener returns a new net.Listener that profiles the reads of the
+// connections accepted by l. Serving HTTP with it, for example with
+// http.Server.Serve, captures all inbound bytes of the server including
+// request headers, which middleware wrapping request bodies misses. The hooks
+// of http.Server, ConnState and ConnContext, can only observe connections,
+// so it is the listener that has to wrap them. For TLS, l must be the
+// listener of the underlying connections, such as the one passed to
+// http.Server.ServeTLS, so the bytes read are those on the wire.
+func (p *Rprof) Listener(l net.Listener, opts ...WrapOption) net.Listener {
+	return &rprofListener{Listener: l, p: p, cfg: newWrapConfig(context.Background(), opts)}
+}
+
+// Accept waits for and returns the next connection, profiled.
+// Implements net.Listener.
+func (l *rprofListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.p.newConn(c, l.cfg), nil
+}
@@ -0,0 +1,131 @@
+package rprof
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConnStats is the totals of a single open connection profiled by Conn or
+// Listener.
+type ConnStats struct {
+	// Local is the local address of the connection.
+	Local string `json:"local"`
+	// Remote is the address of the peer.
+	Remote string `json:"remote"`
+	// Opened is when the connection was wrapped.
+	Opened time.Time `json:"opened"`
+	// Duration is how long the connection has been open.
+	Duration time.Duration `json:"duration"`
+	// Reads is the number of reads.
+	Reads int64 `json:"reads"`
+	// Bytes is the number of bytes read.
+	Bytes int64 `json:"bytes"`
+}
+
+// connTracker keeps the open connections of a profiler.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*RprofConn]struct{}
+}
+
+// add starts tracking c.
+func (t *connTracker) add(c *RprofConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[*RprofConn]struct{}{}
+	}
+	t.conns[c] = struct{}{}
+}
+
+// remove stops tracking c.
+func (t *connTracker) remove(c *RprofConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// Conns returns the top n open connections of the default profiler. See
+// Rprof.Conns.
+func Conns(n int) []ConnStats {
+	return profiler.Conns(n)
+}
+
+// Conns returns the totals of the top n open connections profiled by Conn or
+// Listener, ranked by the number of bytes read, whether or not the profiler
+// is started. Unlike the profile it tells apart individual connections, so
+// the connection responsible for a spike of reads can be found and
+// correlated with the stacks of the profile. Connections are tracked until
+// they are closed. A negative n is treated as 0.
+func (p *Rprof) Conns(n int) []ConnStats {
+	now := time.Now()
+	p.conns.mu.Lock()
+	res := make([]ConnStats, 0, len(p.conns.conns))
+	for c := range p.conns.conns {
+		res = append(res, c.stats(now))
+	}
+	p.conns.mu.Unlock()
+
+	slices.SortFunc(res, func(a, b ConnStats) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		return a.Opened.Compare(b.Opened)
+	})
+	if n = max(n, 0); len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// ConnsPage is an HTTP handler that serves the totals of the open connections
+// of a profiler as JSON.
+type ConnsPage struct {
+	p *Rprof
+}
+
+// ConnsHandler returns a new ConnsPage that uses the default profiler.
+func ConnsHandler() *ConnsPage {
+	return &ConnsPage{p: profiler}
+}
+
+// NewConnsHandler returns a new ConnsPage that uses the given profiler.
+func NewConnsHandler(p *Rprof) *ConnsPage {
+	return &ConnsPage{p: p}
+}
+
+// ServeHTTP writes the top 100 open connections as a JSON array, or as many
+// as given with the n parameter. See Rprof.Conns.
+// Implements http.Handler.
+func (h *ConnsPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Default to 100 connections.
+	n := 100
+	if r.FormValue("n") != "" {
+		var err error
+		n, err = strconv.Atoi(r.FormValue("n"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n < 0 {
+			http.Error(w, "n must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(buf).Encode(h.p.Conns(n)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
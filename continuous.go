@@ -0,0 +1,139 @@
+package rprof
+
+import (
+	"errors"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// StartContinuous starts the default profiler in continuous mode. See
+// Rprof.StartContinuous.
+func StartContinuous(interval time.Duration, fn func(*proto.Profile)) error {
+	return profiler.StartContinuous(interval, fn)
+}
+
+// StartContinuous starts the profiler and calls fn with the profile of each
+// completed window every interval. Windows are rotated by swapping the sample
+// map while holding the lock, so consecutive windows are seamless and no read
+// is lost or counted twice. fn is called from a separate goroutine, one
+// window at a time; if it takes longer than interval, subsequent windows are
+// delayed but not merged.
+//
+// Calling Stop ends continuous mode and returns the profile of the final,
+// partial window, which is not passed to fn. If the profiler is already
+// started then it returns an error.
+func (p *Rprof) StartContinuous(interval time.Duration, fn func(*proto.Profile)) error {
+	return p.startContinuous(interval, nil, func(s Snapshot) {
+		fn(s.Profile())
+	})
+}
+
+// WithAlignedWindows aligns the windows of continuous mode to wall-clock
+// multiples of their interval, so that with an interval of a minute every
+// window starts at :00 of a minute. Profiles of many instances then cover
+// identical intervals and can be merged or compared directly. The first
+// window is partial, from the start of the profiler to the first boundary,
+// and windows end at their boundary rather than at the time they were
+// rotated.
+func WithAlignedWindows() Option {
+	return func(p *Rprof) {
+		p.cfg.alignWindows = true
+	}
+}
+
+// startContinuous starts the profiler and calls fn with a snapshot of each
+// completed window every interval. onStart, if not nil, is called with p.mu
+// held once the profiler is started, before the first window is rotated,
+// with the channel that is closed when continuous mode ends.
+func (p *Rprof) startContinuous(interval time.Duration, onStart func(done chan struct{}), fn func(Snapshot)) error {
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.startLocked(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	p.stopContinuous = done
+	if onStart != nil {
+		onStart(done)
+	}
+
+	align := p.cfg.alignWindows
+	go func() {
+		if !align {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C:
+					s, ok := p.rotate(done, time.Now())
+					if !ok {
+						return
+					}
+					fn(s)
+				}
+			}
+		}
+
+		// A timer is reset to each boundary rather than using a ticker so
+		// that windows stay aligned even if fn or the scheduler is late.
+		end := time.Now().Truncate(interval).Add(interval)
+		t := time.NewTimer(time.Until(end))
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				s, ok := p.rotate(done, end)
+				if !ok {
+					return
+				}
+				fn(s)
+				end = end.Add(interval)
+				t.Reset(time.Until(end))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// rotate ends the current window at now and starts a new one. It returns a
+// snapshot of the ended window. ok is false if continuous mode was ended, as
+// identified by done, in the meantime.
+func (p *Rprof) rotate(done chan struct{}, now time.Time) (s Snapshot, ok bool) {
+	p.flushBatches()
+	p.mu.Lock()
+
+	if p.stopContinuous != done {
+		p.mu.Unlock()
+		return Snapshot{}, false
+	}
+
+	s = Snapshot{
+		Start:    time.Unix(0, p.startTime),
+		Time:     now,
+		cfg:      &p.cfg,
+		overhead: p.overhead.stats(),
+	}
+	s.samples, s.stacks = p.swapSamples()
+
+	p.startTime = now.UnixNano()
+	p.mu.Unlock()
+
+	for _, v := range s.samples {
+		s.Reads += v.reads
+		s.Bytes += v.bytes
+	}
+	return s, true
+}
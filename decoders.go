@@ -0,0 +1,121 @@
+package rprof
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+)
+
+// JSONDecoder returns a new JSON decoder profiled by the default profiler.
+// See Rprof.JSONDecoder.
+func JSONDecoder(r io.Reader, opts ...WrapOption) *RprofJSONDecoder {
+	return profiler.JSONDecoder(r, opts...)
+}
+
+// CSVReader returns a new CSV reader profiled by the default profiler. See
+// Rprof.CSVReader.
+func CSVReader(r io.Reader, opts ...WrapOption) *RprofCSVReader {
+	return profiler.CSVReader(r, opts...)
+}
+
+// RprofJSONDecoder is a json.Decoder whose reads are profiled along with the
+// number of values it decoded.
+type RprofJSONDecoder struct {
+	*json.Decoder
+	src *deferredReader
+	// records is the index of the values of the records sample type, -1 if
+	// they aren't recorded.
+	records int
+}
+
+// JSONDecoder returns a new json.Decoder reading from r, which profiles the
+// reads of r. The "records" sample type, which is added to the profiles of
+// the profiler once a decoder is created, counts the values decoded by Decode
+// off the data read, and samples with records carry the average number of
+// bytes read per record as the "record_size" label, which is high for
+// decoders that over-fetch. Reads are recorded once the decoder is done with
+// their data, so the last read is not recorded until Decode returns an
+// error, such as io.EOF.
+func (p *Rprof) JSONDecoder(r io.Reader, opts ...WrapOption) *RprofJSONDecoder {
+	src := p.newDeferredReader(r, opts)
+	return &RprofJSONDecoder{
+		Decoder: json.NewDecoder(src),
+		src:     src,
+		records: p.registerValueType(recordsType, &src.cfg),
+	}
+}
+
+// Decode reads the next JSON-encoded value from its input, stores it in the
+// value pointed to by v and counts it as a record. See json.Decoder.Decode.
+func (d *RprofJSONDecoder) Decode(v any) error {
+	err := d.Decoder.Decode(v)
+	if err != nil {
+		d.src.flush()
+		return err
+	}
+	d.src.count(d.records)
+	return nil
+}
+
+// RprofCSVReader is a csv.Reader whose reads are profiled along with the
+// number of records it decoded.
+type RprofCSVReader struct {
+	*csv.Reader
+	src *deferredReader
+	// records is the index of the values of the records sample type, -1 if
+	// they aren't recorded.
+	records int
+}
+
+// CSVReader returns a new csv.Reader reading from r, which profiles the reads
+// of r. The "records" sample type, which is added to the profiles of the
+// profiler once a reader is created, counts the records decoded by Read and
+// ReadAll off the data read, and samples with records carry the average
+// number of bytes read per record as the "record_size" label. Reads are
+// recorded once the reader is done with their data, so the last read is not
+// recorded until Read returns an error, such as io.EOF.
+func (p *Rprof) CSVReader(r io.Reader, opts ...WrapOption) *RprofCSVReader {
+	src := p.newDeferredReader(r, opts)
+	return &RprofCSVReader{
+		Reader:  csv.NewReader(src),
+		src:     src,
+		records: p.registerValueType(recordsType, &src.cfg),
+	}
+}
+
+// Read reads one record from r and counts it. See csv.Reader.Read.
+func (r *RprofCSVReader) Read() ([]string, error) {
+	record, err := r.Reader.Read()
+	if record != nil {
+		r.src.count(r.records)
+	}
+	if err != nil {
+		r.src.flush()
+	}
+	return record, err
+}
+
+// ReadAll reads all the remaining records from r and counts them. See
+// csv.Reader.ReadAll.
+func (r *RprofCSVReader) ReadAll() ([][]string, error) {
+	var records [][]string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// recordsType is the sample type of the records decoded by decoders, with
+// the average number of bytes read per record as label.
+var recordsType = valueType{
+	ValueType: ValueType{Type: "records", Unit: "count"},
+	label:     "record_size",
+	unit:      "bytes",
+	derive:    perValue,
+}
@@ -0,0 +1,52 @@
+package rprof
+
+import (
+	"context"
+	"io"
+)
+
+// deferredReader is a profiled reader whose reads are recorded once its
+// consumer, such as a scanner or decoder, is done with their data, so the
+// tokens or records the consumer got out of the data are recorded along with
+// the read.
+type deferredReader struct {
+	p   *Rprof
+	r   io.Reader
+	cfg wrapConfig
+
+	// pending is the last read, not recorded yet, if hasPending is true.
+	pending    readEvent
+	hasPending bool
+	// eof is true once a read returned io.EOF.
+	eof bool
+}
+
+// newDeferredReader returns a new deferredReader reading from r.
+func (p *Rprof) newDeferredReader(r io.Reader, opts []WrapOption) *deferredReader {
+	return &deferredReader{p: p, r: r, cfg: newWrapConfig(context.Background(), opts)}
+}
+
+// Read records the previous read, which the consumer is done with, and reads
+// from the underlying reader.
+func (d *deferredReader) Read(buf []byte) (int, error) {
+	d.flush()
+	d.pending = d.p.read(d.r, buf, &d.cfg, &d.eof)
+	d.hasPending = true
+	return d.pending.n, d.pending.err
+}
+
+// flush records the pending read, if any, in the profiler.
+func (d *deferredReader) flush() {
+	if d.hasPending {
+		d.p.recordSample(d.pending, &d.cfg)
+		d.hasPending = false
+	}
+}
+
+// count counts a token or record the consumer got out of the data of the
+// pending read in the values at index, unless index is -1.
+func (d *deferredReader) count(index int) {
+	if index >= 0 {
+		d.pending.extra[index]++
+	}
+}
@@ -9,15 +9,33 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 )
 
 var (
 	errBadELF    = errors.New("malformed ELF binary")
-	errNoBuildID = errors.New("no NT_GNU_BUILD_ID found in ELF binary")
+	errNoBuildID = errors.New("no NT_GNU_BUILD_ID or Go build ID found in ELF binary")
 )
 
-// elfBuildID returns the GNU build ID of the named ELF binary,
-// without introducing a dependency on debug/elf and its dependencies.
+// elfBuildIDs caches the build IDs of the files mapped into the process by
+// path, as every build of a profile reads the mappings again. Files without
+// a build ID are cached as "".
+var elfBuildIDs sync.Map
+
+// cachedELFBuildID returns the build ID of the named ELF binary, or "" if it
+// has none.
+func cachedELFBuildID(file string) string {
+	if id, ok := elfBuildIDs.Load(file); ok {
+		return id.(string)
+	}
+	id, _ := elfBuildID(file)
+	elfBuildIDs.Store(file, id)
+	return id
+}
+
+// elfBuildID returns the GNU build ID of the named ELF binary, or its Go build
+// ID if it has no GNU build ID, without introducing a dependency on debug/elf
+// and its dependencies.
 func elfBuildID(file string) (string, error) {
 	buf := make([]byte, 256)
 	f, err := os.Open(file)
@@ -66,6 +84,7 @@ func elfBuildID(file string) (string, error) {
 		shnum = int(byteOrder.Uint16(buf[60:]))
 	}
 
+	var goBuildID string
 	for i := 0; i < shnum; i++ {
 		if _, err := f.ReadAt(buf[:shentsize], shoff+int64(i)*shentsize); err != nil {
 			return "", err
@@ -93,6 +112,16 @@ func elfBuildID(file string) (string, error) {
 			noteType := int(byteOrder.Uint32(buf[8:]))
 			descOff := off + int64(12+(nameSize+3)&^3)
 			off = descOff + int64((descSize+3)&^3)
+			if nameSize == 4 && noteType == 4 && string(buf[12:16]) == "Go\x00\x00" { // name Go\x00\x00 type 4 is the Go build ID
+				if descSize > len(buf) {
+					return "", errBadELF
+				}
+				if _, err := f.ReadAt(buf[:descSize], descOff); err != nil {
+					return "", err
+				}
+				goBuildID = string(buf[:descSize])
+				continue
+			}
 			if nameSize != 4 || noteType != 3 || buf[12] != 'G' || buf[13] != 'N' || buf[14] != 'U' || buf[15] != '\x00' { // want name GNU\x00 type 3 (NT_GNU_BUILD_ID)
 				continue
 			}
@@ -105,5 +134,8 @@ func elfBuildID(file string) (string, error) {
 			return fmt.Sprintf("%x", buf[:descSize]), nil
 		}
 	}
+	if goBuildID != "" {
+		return goBuildID, nil
+	}
 	return "", errNoBuildID
 }
@@ -0,0 +1,84 @@
+package rprof
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// Environment variables that configure auto-start of the default profiler.
+const (
+	// EnvEnable enables continuous profiling with the default profiler when
+	// set to a true value as understood by strconv.ParseBool.
+	EnvEnable = "RPROF_ENABLE"
+	// EnvInterval is the length of each collection window as understood by
+	// time.ParseDuration. Defaults to 60s.
+	EnvInterval = "RPROF_INTERVAL"
+	// EnvOutput is a text/template for the path each window's profile is
+	// written to, executed with a KeyData. Defaults to
+	// rprof-{{.PID}}-{{.Start.Unix}}.pb.gz in os.TempDir.
+	EnvOutput = "RPROF_OUTPUT"
+)
+
+const defaultAutoStartInterval = 60 * time.Second
+
+func init() {
+	if err := autoStart(os.Getenv); err != nil {
+		fmt.Fprintf(os.Stderr, "rprof: not auto-starting: %v\n", err)
+	}
+}
+
+// autoStart starts continuous profiling with the default profiler if it is
+// enabled through the environment. Only readers wrapped with the package-level
+// functions, which use the default profiler, are profiled.
+func autoStart(getenv func(string) string) error {
+	v := getenv(EnvEnable)
+	if v == "" {
+		return nil
+	}
+
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", EnvEnable, err)
+	}
+	if !enabled {
+		return nil
+	}
+
+	interval := defaultAutoStartInterval
+	if v := getenv(EnvInterval); v != "" {
+		interval, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", EnvInterval, err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("%s must be positive", EnvInterval)
+		}
+	}
+
+	output := getenv(EnvOutput)
+	if output == "" {
+		output = filepath.Join(os.TempDir(), "rprof-{{.PID}}-{{.Start.Unix}}.pb.gz")
+	}
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(output)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", EnvOutput, err)
+	}
+
+	return profiler.StartContinuous(interval, func(prof *proto.Profile) {
+		path, err := executeKeyTemplate(tmpl, prof)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rprof: executing %s: %v\n", EnvOutput, err)
+			return
+		}
+
+		if err := writeProfileFile(path, prof); err != nil {
+			fmt.Fprintf(os.Stderr, "rprof: writing profile to %s: %v\n", path, err)
+		}
+	})
+}
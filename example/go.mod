@@ -5,6 +5,8 @@ go 1.22.1
 require github.com/polarsignals/rprof v0.0.0-20240701160231-adc1026976aa
 
 require (
+	go.opentelemetry.io/otel v1.28.0 // indirect
+	go.opentelemetry.io/otel/trace v1.28.0 // indirect
 	go.opentelemetry.io/proto/otlp v1.3.1 // indirect
 	google.golang.org/protobuf v1.34.1 // indirect
 )
@@ -0,0 +1,157 @@
+package rprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"text/template"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// DefaultKeyTemplate is the key template used by NewObjectStorageExporter when
+// an empty template is given.
+const DefaultKeyTemplate = "rprof/{{.Hostname}}/{{.Start.UTC.Format \"2006-01-02T15:04:05Z\"}}.pb.gz"
+
+// Exporter ships a completed profile to some destination.
+type Exporter interface {
+	Export(ctx context.Context, prof *proto.Profile) error
+}
+
+// ExportContinuous starts the default profiler in continuous mode, exporting
+// each completed window with e. See Rprof.ExportContinuous.
+func ExportContinuous(ctx context.Context, interval time.Duration, e Exporter, logger *slog.Logger) error {
+	return profiler.ExportContinuous(ctx, interval, e, logger)
+}
+
+// ExportContinuous starts the profiler in continuous mode, see
+// StartContinuous, and exports the profile of each completed window with e,
+// for example to upload every window to a bucket with an
+// ObjectStorageExporter. Export is called with ctx. Its errors are logged
+// with logger, since there is no caller to return them to, and don't end
+// continuous mode.
+//
+// Once ctx is done, continuous mode ends and the profiler is stopped,
+// discarding the partial window, which can't be exported with ctx anymore.
+// Calling Stop ends continuous mode as well. If the profiler is already
+// started then it returns an error.
+func (p *Rprof) ExportContinuous(ctx context.Context, interval time.Duration, e Exporter, logger *slog.Logger) error {
+	return p.startContinuous(interval, func(done chan struct{}) {
+		go func() {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				p.stop(done)
+			}
+		}()
+	}, func(s Snapshot) {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := e.Export(ctx, s.Profile()); err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "rprof export failed",
+				slog.Time("start", s.Start),
+				slog.Any("error", err),
+			)
+		}
+	})
+}
+
+// ObjectStore is the minimal interface of an S3/GCS-compatible bucket client
+// that is needed to upload profiles. Put uploads the content of body under
+// the given key, overwriting any existing object.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader) error
+}
+
+// KeyData is the data available to object key templates.
+type KeyData struct {
+	// Hostname is the hostname of the process as reported by os.Hostname.
+	Hostname string
+	// PID is the process ID.
+	PID int
+	// Start is the start time of the collection window.
+	Start time.Time
+	// End is the end time of the collection window.
+	End time.Time
+}
+
+// ObjectStorageExporter uploads each profile it is given as a gzip compressed
+// object to an object store.
+type ObjectStorageExporter struct {
+	store ObjectStore
+	key   *template.Template
+}
+
+// NewObjectStorageExporter returns a new ObjectStorageExporter that uploads to
+// the given store. The object key is produced by executing keyTemplate, a
+// text/template, with a KeyData. If keyTemplate is empty DefaultKeyTemplate is
+// used.
+func NewObjectStorageExporter(store ObjectStore, keyTemplate string) (*ObjectStorageExporter, error) {
+	if keyTemplate == "" {
+		keyTemplate = DefaultKeyTemplate
+	}
+
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(keyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectStorageExporter{
+		store: store,
+		key:   tmpl,
+	}, nil
+}
+
+// Export uploads the profile to the object store.
+// Implements Exporter.
+func (e *ObjectStorageExporter) Export(ctx context.Context, prof *proto.Profile) error {
+	key, err := executeKeyTemplate(e.key, prof)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := writeProfile(buf, prof); err != nil {
+		return err
+	}
+
+	return e.store.Put(ctx, key, buf)
+}
+
+// executeKeyTemplate renders the template for the window covered by prof.
+func executeKeyTemplate(tmpl *template.Template, prof *proto.Profile) (string, error) {
+	hostname, _ := os.Hostname()
+	data := KeyData{
+		Hostname: hostname,
+		PID:      os.Getpid(),
+		Start:    time.Unix(0, prof.TimeNanos),
+		End:      time.Unix(0, prof.TimeNanos+prof.DurationNanos),
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeProfile marshals the profile, compresses it and writes it to w.
+func writeProfile(w io.Writer, prof *proto.Profile) error {
+	content, err := protobuf.Marshal(prof)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(content); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
@@ -0,0 +1,146 @@
+package rprof_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/polarsignals/rprof"
+	profile "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+type memStore struct {
+	objects map[string][]byte
+}
+
+func (s *memStore) Put(_ context.Context, key string, body io.Reader) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = b
+	return nil
+}
+
+func TestObjectStorageExporter(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memStore{objects: map[string][]byte{}}
+	e, err := rprof.NewObjectStorageExporter(store, "profiles/{{.PID}}/{{.Start.Unix}}-{{.End.Unix}}.pb.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Export(context.Background(), prof); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.objects) != 1 {
+		t.Fatalf("expected 1 object but got %d", len(store.objects))
+	}
+	key := fmt.Sprintf("profiles/%d/%d-%d.pb.gz",
+		os.Getpid(),
+		time.Unix(0, prof.TimeNanos).Unix(),
+		time.Unix(0, prof.TimeNanos+prof.DurationNanos).Unix(),
+	)
+	if len(store.objects[key]) == 0 {
+		t.Fatalf("expected non-empty object at %q", key)
+	}
+}
+
+func TestExportContinuous(t *testing.T) {
+	p := rprof.NewProfiler()
+	store := &memStore{objects: map[string][]byte{}}
+	e, err := rprof.NewObjectStorageExporter(store, "profiles/{{.Start.UnixNano}}.pb.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store is only accessed by the exporting goroutine, which fails
+	// after the first window.
+	exported := make(chan int, 1)
+	exporter := exporterFunc(func(ctx context.Context, prof *profile.Profile) error {
+		if len(store.objects) > 0 {
+			return errors.New("bucket unavailable")
+		}
+		if err := e.Export(ctx, prof); err != nil {
+			return err
+		}
+		exported <- len(store.objects)
+		return nil
+	})
+	logs := make(chanWriter, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.ExportContinuous(ctx, 10*time.Millisecond, exporter, slog.New(slog.NewTextHandler(logs, nil))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-exported:
+		if n == 0 {
+			t.Fatal("expected the window to be uploaded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a window to be exported")
+	}
+	select {
+	case l := <-logs:
+		if !strings.Contains(l, "bucket unavailable") {
+			t.Fatalf("unexpected log %q", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the export error to be logged")
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := p.Snapshot(); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the profiler to be stopped once the context is done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// chanWriter sends every write to the channel, dropping it if the channel is
+// full.
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	select {
+	case w <- string(b):
+	default:
+	}
+	return len(b), nil
+}
+
+type exporterFunc func(ctx context.Context, prof *profile.Profile) error
+
+func (f exporterFunc) Export(ctx context.Context, prof *profile.Profile) error {
+	return f(ctx, prof)
+}
@@ -1,14 +1,30 @@
 package rprof_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/polarsignals/rprof"
+	profile "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -68,3 +84,2680 @@ func TestExternalUsage(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestReadBudget(t *testing.T) {
+	p := rprof.NewProfiler()
+
+	var exceeded *rprof.BudgetError
+	p.SetReadBudget(4096, func(err *rprof.BudgetError) {
+		exceeded = err
+	})
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := naiveCopy(io.Discard, p.Reader(bytes.NewReader(make([]byte, 8192)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if prof == nil {
+		t.Fatal("expected a profile")
+	}
+
+	var budgetErr *rprof.BudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a budget error but got %v", err)
+	}
+	if budgetErr.Bytes != 8192 || len(budgetErr.Top) != 1 {
+		t.Fatalf("unexpected budget error: %v", budgetErr)
+	}
+	if exceeded == nil || exceeded.Bytes != 4096+1024 {
+		t.Fatalf("expected callback at the first read over budget but got %v", exceeded)
+	}
+}
+
+func TestTop(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := naiveCopy(io.Discard, p.Reader(bytes.NewReader(make([]byte, 8192)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	top := p.Top(1, rprof.MetricBytes)
+	if len(top) != 1 {
+		t.Fatalf("expected 1 entry but got %d", len(top))
+	}
+	if top[0].Function != "github.com/polarsignals/rprof_test.naiveCopy" || top[0].Bytes != 8192 || top[0].Reads != 9 {
+		t.Fatalf("unexpected top entry: %+v", top[0])
+	}
+
+	if top := p.Top(-1, rprof.MetricBytes); len(top) != 0 {
+		t.Fatalf("expected no entries for a negative k but got %+v", top)
+	}
+}
+
+func TestStacks(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := naiveCopy(io.Discard, p.Reader(bytes.NewReader(make([]byte, 8192)))); err != nil {
+		t.Fatal(err)
+	}
+	r := p.Reader(bytes.NewReader(make([]byte, 20)))
+	for range 20 {
+		if err := readByte(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		by    rprof.Metric
+		leaf  string
+		reads int64
+		bytes int64
+	}{
+		{rprof.MetricBytes, "naiveCopy", 9, 8192},
+		{rprof.MetricReads, "readByte", 20, 20},
+	} {
+		top := p.Stacks(1, tc.by)
+		if len(top) != 1 {
+			t.Fatalf("expected 1 stack but got %d", len(top))
+		}
+		if !strings.HasPrefix(top[0].Frames[0], "github.com/polarsignals/rprof_test."+tc.leaf+" ") || top[0].Reads != tc.reads || top[0].Bytes != tc.bytes {
+			t.Fatalf("unexpected top stack by %v: %+v", tc.by, top[0])
+		}
+	}
+
+	if top := p.Stacks(-1, rprof.MetricBytes); len(top) != 0 {
+		t.Fatalf("expected no stacks for a negative k but got %+v", top)
+	}
+}
+
+func TestPackages(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// The reads of io.ReadAll are attributed to the package calling it.
+	readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+	bufio.NewReader(p.Reader(bytes.NewReader(make([]byte, 8192)))).WriteTo(io.Discard)
+
+	packages := p.Packages(10, rprof.MetricBytes)
+	if len(packages) != 1 {
+		t.Fatalf("expected 1 package but got %+v", packages)
+	}
+	if packages[0].Package != "github.com/polarsignals/rprof_test" || packages[0].Bytes != 1024+8192 {
+		t.Fatalf("unexpected package entry: %+v", packages[0])
+	}
+	if packages := p.Packages(-1, rprof.MetricBytes); len(packages) != 0 {
+		t.Fatalf("expected no packages for a negative k but got %+v", packages)
+	}
+
+	rec := httptest.NewRecorder()
+	rprof.NewStatusHandler(p).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "<td>github.com/polarsignals/rprof_test</td>") {
+		t.Fatalf("expected the package on the status page but got %s", rec.Body.String())
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	p := rprof.NewProfiler()
+	h := rprof.NewStatusHandler(p)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "No collection is running.") {
+		t.Fatalf("expected the page of a stopped profiler but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		contains []string
+		excludes []string
+	}{
+		{
+			query:    "",
+			code:     http.StatusOK,
+			contains: []string{`<meta http-equiv="refresh" content="5">`, "<tr><th>Bytes read</th><td>1024</td></tr>", "less than 512 bytes per read"},
+		},
+		{
+			query:    "?refresh=30&tiny=64",
+			code:     http.StatusOK,
+			contains: []string{`content="30"`, "less than 64 bytes per read"},
+		},
+		{
+			query:    "?refresh=0&tiny=0",
+			code:     http.StatusOK,
+			contains: []string{"<tr><th>Bytes read</th><td>1024</td></tr>"},
+			excludes: []string{`http-equiv="refresh"`, "bytes per read"},
+		},
+		{query: "?refresh=soon", code: http.StatusBadRequest},
+		{query: "?tiny=small", code: http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%q: expected status %d but got %d", tc.query, tc.code, rec.Code)
+		}
+		if tc.code == http.StatusOK && rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("%q: unexpected content type %q", tc.query, rec.Header().Get("Content-Type"))
+		}
+		for _, c := range tc.contains {
+			if !strings.Contains(rec.Body.String(), c) {
+				t.Fatalf("%q: expected %q on the page but got %s", tc.query, c, rec.Body.String())
+			}
+		}
+		for _, c := range tc.excludes {
+			if strings.Contains(rec.Body.String(), c) {
+				t.Fatalf("%q: expected no %q on the page but got %s", tc.query, c, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestMaxStackDepth(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithMaxStackDepth(2))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range prof.Sample {
+		// The two frames of the stack followed by the truncation marker.
+		if len(s.LocationIndex) != 3 {
+			t.Fatalf("expected 3 locations but got %d", len(s.LocationIndex))
+		}
+		loc := prof.Location[s.LocationIndex[2]-1]
+		if len(loc.Line) != 1 || prof.StringTable[prof.Function[loc.Line[0].FunctionIndex-1].Name] != "[truncated]" {
+			t.Fatal("expected the outermost frame to be the truncation marker")
+		}
+	}
+	if len(prof.Comment) != 2 {
+		t.Fatalf("expected comments about truncated stacks and overhead but got %d comments", len(prof.Comment))
+	}
+}
+
+// readAll is a helper that should not show up as the caller of Read when its
+// reader is wrapped with rprof.WithSkipFrames(1).
+func readAll(r io.Reader) error {
+	_, err := io.ReadAll(r)
+	return err
+}
+
+// sampleTypeIndex returns the index of the values of the sample type with the
+// given name in the profile, or -1 if it has no such sample type.
+func sampleTypeIndex(prof *profile.Profile, typ string) int {
+	for i, st := range prof.SampleType {
+		if prof.StringTable[st.Type] == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// sumValues returns the sum of the i-th value of the samples of prof.
+func sumValues(prof *profile.Profile, i int) int64 {
+	var n int64
+	for _, s := range prof.Sample {
+		n += s.Value[i]
+	}
+	return n
+}
+
+func TestMaxSamples(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithMaxSamples(1))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1<<i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prof.Sample) != 2 {
+		t.Fatalf("expected 1 sample and 1 dropped sample but got %d samples", len(prof.Sample))
+	}
+	if len(prof.Comment) != 2 {
+		t.Fatalf("expected comments about dropped reads and overhead but got %d comments", len(prof.Comment))
+	}
+	if c := prof.StringTable[prof.Comment[0]]; c != "rprof: dropped 2 reads exceeding the maximum of 1 samples" {
+		t.Fatalf("unexpected comment %q", c)
+	}
+}
+
+func TestWithoutRuntimeFrames(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []rprof.Option
+		runtime bool
+	}{
+		{"default", nil, true},
+		{"trimmed", []rprof.Option{rprof.WithoutRuntimeFrames()}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := rprof.NewProfiler(append(tc.opts, rprof.WithSymbolization())...)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+				t.Fatal(err)
+			}
+			prof, err := p.Stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var runtimeFrames []string
+			for _, s := range prof.Sample {
+				for _, li := range s.LocationIndex {
+					for _, l := range prof.Location[li-1].Line {
+						if name := prof.StringTable[prof.Function[l.FunctionIndex-1].Name]; strings.HasPrefix(name, "runtime.") {
+							runtimeFrames = append(runtimeFrames, name)
+						}
+					}
+				}
+			}
+			if got := len(runtimeFrames) > 0; got != tc.runtime {
+				t.Fatalf("expected runtime frames to be present: %v, but got %v", tc.runtime, runtimeFrames)
+			}
+		})
+	}
+}
+
+func TestLeafOnly(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithLeafOnly())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range prof.Sample {
+		if len(s.LocationIndex) != 1 {
+			t.Fatalf("expected only the leaf location but got %d", len(s.LocationIndex))
+		}
+	}
+	if len(prof.Comment) != 1 {
+		t.Fatalf("expected only the overhead comment but got %d comments", len(prof.Comment))
+	}
+}
+
+func TestRecordFilter(t *testing.T) {
+	// Exclude all reads through readAll.
+	p := rprof.NewProfiler(rprof.WithRecordFilter(func(size int, stack []uintptr) bool {
+		frames := runtime.CallersFrames(stack)
+		for {
+			f, more := frames.Next()
+			if f.Function == "github.com/polarsignals/rprof_test.readAll" {
+				return false
+			}
+			if !more {
+				return true
+			}
+		}
+	}))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 512)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	for _, s := range prof.Sample {
+		n += s.Value[1]
+	}
+	if n != 512 {
+		t.Fatalf("expected only the 512 unfiltered bytes but got %d", n)
+	}
+}
+
+func TestTimeBuckets(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithTimeBuckets(10 * time.Millisecond))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.Reader(bytes.NewReader(make([]byte, 1024))).Read(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buckets := map[int64]bool{}
+	for _, s := range prof.Sample {
+		for _, l := range s.Label {
+			if prof.StringTable[l.Key] == "time" {
+				buckets[l.Num] = true
+			}
+		}
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("expected reads in 2 time buckets but got %d", len(buckets))
+	}
+}
+
+func TestWithoutSizeBuckets(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithoutSizeBuckets())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Reader(bytes.NewReader(make([]byte, 4096)))
+	for _, size := range []int{1, 100, 1000} {
+		if _, err := r.Read(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reads []*profile.Sample
+	for _, s := range prof.Sample {
+		for _, l := range s.Label {
+			if prof.StringTable[l.Key] == "bytes" {
+				t.Fatalf("expected no size bucket label but got %d", l.Num)
+			}
+		}
+		if s.Value[0] > 0 {
+			reads = append(reads, s)
+		}
+	}
+	if len(reads) != 1 || reads[0].Value[0] != 3 || reads[0].Value[1] != 1101 {
+		t.Fatalf("expected the reads to be merged into 1 sample but got %v", reads)
+	}
+}
+
+func TestRequested(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		size, buf int
+		read      int64
+	}{
+		{"full", 1024, 512, 512},
+		{"short", 300, 1000, 300},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := rprof.NewProfiler()
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := p.Reader(bytes.NewReader(make([]byte, tc.size))).Read(make([]byte, tc.buf)); err != nil {
+				t.Fatal(err)
+			}
+
+			prof, err := p.Stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := sampleTypeIndex(prof, "requested")
+			if i < 0 {
+				t.Fatal("expected a requested sample type")
+			}
+			if got := sumValues(prof, i); got != int64(tc.buf) {
+				t.Errorf("expected %d bytes requested but got %d", tc.buf, got)
+			}
+			if got := sumValues(prof, 1); got != tc.read {
+				t.Errorf("expected %d bytes read but got %d", tc.read, got)
+			}
+		})
+	}
+}
+
+// slowReader delays every read by delay.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestLatency(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const delay = 10 * time.Millisecond
+	r := p.Reader(slowReader{r: bytes.NewReader(make([]byte, 3072)), delay: delay})
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(sumValues(prof, sampleTypeIndex(prof, "latency"))); got < 3*delay {
+		t.Fatalf("expected a latency of at least %v but got %v", 3*delay, got)
+	}
+}
+
+func TestSkipFrames(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)), rprof.WithSkipFrames(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	top := p.Top(1, rprof.MetricReads)
+	if len(top) != 1 || top[0].Function != "github.com/polarsignals/rprof_test.readAll" {
+		t.Fatalf("unexpected top entries: %+v", top)
+	}
+}
+
+func readByte(r io.Reader) error {
+	_, err := r.Read(make([]byte, 1))
+	return err
+}
+
+func TestStackCache(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	r := p.Reader(bytes.NewReader(make([]byte, 1024)), rprof.WithStackCache(100))
+	for i := 0; i < 10; i++ {
+		if err := readByte(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Attributed to the cached stack until it is walked again.
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	top := p.Top(2, rprof.MetricReads)
+	if len(top) != 1 || top[0].Function != "github.com/polarsignals/rprof_test.readByte" || top[0].Reads != 11 {
+		t.Fatalf("unexpected top entries: %+v", top)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	r := p.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 1024))), rprof.WithBatching(10, 0))
+	for i := 0; i < 25; i++ {
+		if err := readByte(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reads := func() (n int64) {
+		for _, e := range p.Top(10, rprof.MetricReads) {
+			n += e.Reads
+		}
+		return n
+	}
+	// The snapshot of Top records the pending reads of the incomplete batch.
+	if n := reads(); n != 25 {
+		t.Fatalf("expected 25 reads but got %d", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := readByte(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	if n := reads(); n != 30 {
+		t.Fatalf("expected the pending reads to be recorded on close but got %d reads", n)
+	}
+}
+
+func TestBatchingFlushedOnStop(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithSymbolization())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader is never closed.
+	r := p.Reader(bytes.NewReader(make([]byte, 1024)), rprof.WithBatching(10, 0))
+	for i := 0; i < 5; i++ {
+		if err := readByte(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sumValues(prof, 0); n != 5 {
+		t.Fatalf("expected the 5 pending reads to be recorded on Stop but got %d", n)
+	}
+	// The reads are attributed to the stack of the read that started the
+	// batch rather than to the caller of Stop.
+	for _, s := range prof.Sample {
+		var leaf []string
+		for _, l := range prof.Location[s.LocationIndex[0]-1].Line {
+			leaf = append(leaf, prof.StringTable[prof.Function[l.FunctionIndex-1].Name])
+		}
+		if !slices.Contains(leaf, "github.com/polarsignals/rprof_test.readByte") {
+			t.Fatalf("expected the reads to be attributed to readByte but got %v", leaf)
+		}
+	}
+
+	// No reads are left to leak into the next window.
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if prof, err = p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 0 {
+		t.Fatalf("expected no samples in the next window but got %d", len(prof.Sample))
+	}
+}
+
+func TestComposedWrappers(t *testing.T) {
+	outer := rprof.NewProfiler()
+	inner := rprof.NewProfiler()
+	for _, p := range []*rprof.Rprof{outer, inner} {
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer p.Stop()
+	}
+
+	r := outer.Reader(inner.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 1024)))))
+	if err := readAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both profilers attribute reads to the caller of the outermost wrapper.
+	for _, p := range []*rprof.Rprof{outer, inner} {
+		top := p.Top(1, rprof.MetricReads)
+		if len(top) != 1 || top[0].Function != "io.ReadAll" {
+			t.Fatalf("unexpected top entries: %+v", top)
+		}
+	}
+}
+
+func TestWithProfilers(t *testing.T) {
+	onDemand := rprof.NewProfiler()
+	continuous := rprof.NewProfiler(rprof.WithMaxStackDepth(1))
+	for _, p := range []*rprof.Rprof{onDemand, continuous} {
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := onDemand.Reader(bytes.NewReader(make([]byte, 1024)), rprof.WithProfilers(continuous))
+	if err := readAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []*rprof.Rprof{onDemand, continuous} {
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int64
+		for _, s := range prof.Sample {
+			n += s.Value[1]
+		}
+		if n != 1024 {
+			t.Fatalf("expected 1024 bytes in every profiler but got %d", n)
+		}
+	}
+}
+
+func TestAbandonedStreams(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := p.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 1024))))
+	if _, err := io.ReadAll(drained); err != nil {
+		t.Fatal(err)
+	}
+	drained.Close()
+
+	abandoned := p.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 1024))))
+	if _, err := abandoned.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	abandoned.Close()
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var eof, abandonedCount int64
+	for _, s := range prof.Sample {
+		eof += s.Value[4]
+		abandonedCount += s.Value[5]
+	}
+	if eof != 1 || abandonedCount != 1 {
+		t.Fatalf("expected 1 stream read to EOF and 1 abandoned but got %d and %d", eof, abandonedCount)
+	}
+}
+
+func TestStartContinuous(t *testing.T) {
+	p := rprof.NewProfiler()
+
+	windows := make(chan *profile.Profile, 16)
+	if err := p.StartContinuous(10*time.Millisecond, func(prof *profile.Profile) {
+		windows <- prof
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Start(); err == nil {
+		t.Fatal("expected error starting a profiler in continuous mode")
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The read must show up in exactly one of the completed windows.
+	var total int64
+	timeout := time.After(5 * time.Second)
+	for total < 1024 {
+		select {
+		case prof := <-windows:
+			for _, s := range prof.Sample {
+				total += s.Value[1]
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for windows, got %d bytes", total)
+		}
+	}
+
+	last, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range last.Sample {
+		total += s.Value[1]
+	}
+	if total != 1024 {
+		t.Fatalf("expected 1024 bytes across all windows but got %d", total)
+	}
+}
+
+func TestAlignedWindows(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithAlignedWindows())
+
+	const interval = 20 * time.Millisecond
+	windows := make(chan *profile.Profile, 16)
+	if err := p.StartContinuous(interval, func(prof *profile.Profile) {
+		windows <- prof
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case prof := <-windows:
+			end := prof.TimeNanos + prof.DurationNanos
+			if end%int64(interval) != 0 {
+				t.Fatalf("expected window %d to end at a multiple of %s but it ended at %d", i, interval, end)
+			}
+			if i > 0 && prof.DurationNanos != int64(interval) {
+				t.Fatalf("expected window %d to last %s but it lasted %s", i, interval, time.Duration(prof.DurationNanos))
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for windows")
+		}
+	}
+
+	if _, err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContinuousConcurrentReads(t *testing.T) {
+	p := rprof.NewProfiler()
+
+	var mu sync.Mutex
+	var total int64
+	addBytes := func(prof *profile.Profile) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range prof.Sample {
+			total += s.Value[1]
+		}
+	}
+	if err := p.StartContinuous(time.Millisecond, addBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	const readers, reads, size = 8, 1000, 16
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := p.Reader(bytes.NewReader(make([]byte, reads*size)))
+			buf := make([]byte, size)
+			for j := 0; j < reads; j++ {
+				if _, err := r.Read(buf); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	last, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBytes(last)
+
+	// Windows rotated before Stop may still be passed to the callback.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := total
+		mu.Unlock()
+		if n == readers*reads*size {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d bytes across all windows but got %d", readers*reads*size, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLocalBuffers(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithLocalBuffers())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const readers, size = 8, 1024
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := readAll(p.Reader(bytes.NewReader(make([]byte, size)))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	snap, err := p.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prof := range []*profile.Profile{snap, prof} {
+		var n int64
+		for _, s := range prof.Sample {
+			n += s.Value[1]
+		}
+		if n != readers*size {
+			t.Fatalf("expected %d bytes but got %d", readers*size, n)
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	sumBytes := func(prof *profile.Profile) (n int64) {
+		for _, s := range prof.Sample {
+			n += s.Value[1]
+		}
+		return n
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	prof, snap := p.Delta(rprof.Snapshot{})
+	if n := sumBytes(prof); n != 1024 {
+		t.Fatalf("expected 1024 bytes in the first delta but got %d", n)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 512)))); err != nil {
+		t.Fatal(err)
+	}
+	prof, snap = p.Delta(snap)
+	if n := sumBytes(prof); n != 512 {
+		t.Fatalf("expected 512 bytes in the second delta but got %d", n)
+	}
+	if snap.Bytes != 1536 {
+		t.Fatalf("expected the snapshot to be cumulative but got %d bytes", snap.Bytes)
+	}
+
+	prof, _ = p.Delta(snap)
+	if len(prof.Sample) != 0 {
+		t.Fatalf("expected no samples without reads but got %d", len(prof.Sample))
+	}
+}
+
+func TestDeltaStopped(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	_, snap := p.Delta(rprof.Snapshot{})
+	if _, err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, _ := p.Delta(snap)
+	if len(prof.Sample) != 0 || prof.TimeNanos != 0 || prof.DurationNanos != 0 {
+		t.Fatalf("expected an empty profile without a window but got %d samples at %d for %d", len(prof.Sample), prof.TimeNanos, prof.DurationNanos)
+	}
+}
+
+func TestReset(t *testing.T) {
+	p := rprof.NewProfiler()
+	p.Reset()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	p.Reset()
+	if prof, err := p.Snapshot(); err != nil || len(prof.Sample) != 0 {
+		t.Fatalf("expected the profiler to keep running without samples after Reset but got %v", err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 512)))); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sumValues(prof, 1); n != 512 {
+		t.Fatalf("expected only the 512 bytes read after Reset but got %d", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	p := rprof.NewProfiler()
+	h := rprof.NewHandler(p)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?snapshot=true", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected an error snapshotting a stopped profiler but got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?snapshot=maybe", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid snapshot parameter to be rejected but got %d", rec.Code)
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	first, err := p.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 512)))); err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sumValues(first, 1); n != 1024 {
+		t.Fatalf("expected 1024 bytes in the first snapshot but got %d", n)
+	}
+	if n := sumValues(second, 1); n != 1536 {
+		t.Fatalf("expected 1536 bytes in the second snapshot but got %d", n)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?snapshot=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a snapshot but got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := sumValues(readProfile(t, rec.Body), 1); n != 1536 {
+		t.Fatalf("expected 1536 bytes in the served snapshot but got %d", n)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sumValues(prof, 1); n != 1536 {
+		t.Fatalf("expected the snapshots to leave the 1536 bytes to Stop but got %d", n)
+	}
+}
+
+func TestRecent(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.StartRecent(5*time.Millisecond, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Recent(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, s := range prof.Sample {
+		n += s.Value[1]
+	}
+	if n != 1024 {
+		t.Fatalf("expected 1024 bytes in the recent profile but got %d", n)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if windows := p.Windows(); len(windows) != 3 {
+		t.Fatalf("expected 3 windows to be kept but got %d", len(windows))
+	}
+}
+
+func TestStartRecentTwice(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.StartRecent(5*time.Millisecond, 3); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Windows()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a window to be completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.StartRecent(time.Hour, 1); err == nil {
+		t.Fatal("expected error starting a started profiler")
+	}
+	if len(p.Windows()) == 0 {
+		t.Fatal("expected the windows to be kept by a failed StartRecent")
+	}
+	// The number of windows to keep is unchanged as well.
+	time.Sleep(50 * time.Millisecond)
+	if windows := p.Windows(); len(windows) != 3 {
+		t.Fatalf("expected 3 windows to be kept but got %d", len(windows))
+	}
+}
+
+func TestDoLabels(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	rprof.Do(context.Background(), rprof.Labels("tenant", "acme"), func(ctx context.Context) {
+		if _, err := io.ReadAll(p.ReaderContext(ctx, bytes.NewReader(make([]byte, 1024)))); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range prof.Sample {
+		labels := map[string]string{}
+		for _, l := range s.Label {
+			if l.Str != 0 {
+				labels[prof.StringTable[l.Key]] = prof.StringTable[l.Str]
+			}
+		}
+		if labels["tenant"] != "acme" {
+			t.Fatalf("expected tenant label on every sample but got %v", labels)
+		}
+	}
+}
+
+func TestContextReaders(t *testing.T) {
+	data := make([]byte, 1024)
+	for _, tc := range []struct {
+		name string
+		read func(ctx context.Context, p *rprof.Rprof) error
+	}{
+		{"ReaderContext", func(ctx context.Context, p *rprof.Rprof) error {
+			return readAll(p.ReaderContext(ctx, bytes.NewReader(data)))
+		}},
+		{"ReadCloserContext", func(ctx context.Context, p *rprof.Rprof) error {
+			r := p.ReadCloserContext(ctx, io.NopCloser(bytes.NewReader(data)))
+			if err := readAll(r); err != nil {
+				return err
+			}
+			return r.Close()
+		}},
+		{"ReaderAtContext", func(ctx context.Context, p *rprof.Rprof) error {
+			_, err := p.ReaderAtContext(ctx, bytes.NewReader(data)).ReadAt(make([]byte, 512), 256)
+			return err
+		}},
+		{"RprofReader.ReadContext", func(ctx context.Context, p *rprof.Rprof) error {
+			r := p.Reader(bytes.NewReader(data)).(*rprof.RprofReader)
+			_, err := r.ReadContext(ctx, make([]byte, 512))
+			return err
+		}},
+		{"RprofReadCloser.ReadContext", func(ctx context.Context, p *rprof.Rprof) error {
+			r := p.ReadCloser(io.NopCloser(bytes.NewReader(data))).(*rprof.RprofReadCloser)
+			_, err := r.ReadContext(ctx, make([]byte, 512))
+			return err
+		}},
+		{"RprofReaderAt.ReadAtContext", func(ctx context.Context, p *rprof.Rprof) error {
+			r := p.ReaderAt(bytes.NewReader(data)).(*rprof.RprofReaderAt)
+			_, err := r.ReadAtContext(ctx, make([]byte, 512), 256)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := rprof.NewProfiler()
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			rprof.Do(context.Background(), rprof.Labels("tenant", "acme"), func(ctx context.Context) {
+				if err := tc.read(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			prof, err := p.Stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sumValues(prof, 1) == 0 {
+				t.Fatal("expected the reads to be recorded")
+			}
+			for _, s := range prof.Sample {
+				labels := map[string]string{}
+				for _, l := range s.Label {
+					if l.Str != 0 {
+						labels[prof.StringTable[l.Key]] = prof.StringTable[l.Str]
+					}
+				}
+				if labels["tenant"] != "acme" {
+					t.Fatalf("expected tenant label on every sample but got %v", labels)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapperLabels(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Reader(bytes.NewReader(make([]byte, 1024)),
+		rprof.WithLabels(map[string]string{"table": "users"}),
+		rprof.WithLabelSet(rprof.NumLabel("shard", 7, "")),
+	)
+	if err := readAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range prof.Sample {
+		var table string
+		var shard int64
+		for _, l := range s.Label {
+			switch prof.StringTable[l.Key] {
+			case "table":
+				table = prof.StringTable[l.Str]
+			case "shard":
+				shard = l.Num
+			}
+		}
+		if table != "users" || shard != 7 {
+			t.Fatalf("expected table and shard labels on every sample but got %q and %d", table, shard)
+		}
+	}
+}
+
+func TestStringTableDeduplicated(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{1, 100, 10000} {
+		r := p.Reader(bytes.NewReader(make([]byte, size)), rprof.WithLabels(map[string]string{"table": "users"}))
+		if err := readAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) < 2 {
+		t.Fatalf("expected several samples but got %d", len(prof.Sample))
+	}
+
+	seen := map[string]bool{}
+	for _, s := range prof.StringTable {
+		if seen[s] {
+			t.Fatalf("string %q is in the string table more than once", s)
+		}
+		seen[s] = true
+	}
+}
+
+func TestStreamID(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)), rprof.WithStreamID())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := map[int64]bool{}
+	for _, s := range prof.Sample {
+		for _, l := range s.Label {
+			if prof.StringTable[l.Key] == "stream" {
+				streams[l.Num] = true
+			}
+		}
+	}
+	if len(streams) != 3 {
+		t.Fatalf("expected 3 distinct streams but got %d", len(streams))
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	p := rprof.NewProfiler()
+	rprof.Register("storage", p)
+
+	if rprof.Lookup("storage") != p {
+		t.Fatal("expected the registered profiler")
+	}
+	if rprof.Lookup(rprof.DefaultName) == nil {
+		t.Fatal("expected the default profiler to be registered")
+	}
+	if rprof.Lookup("network") != nil {
+		t.Fatal("expected no profiler")
+	}
+}
+
+func TestStackless(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithStackless())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"wal", "data"} {
+		r := p.Reader(bytes.NewReader(make([]byte, 1024)), rprof.WithName(name), rprof.WithLabels(map[string]string{"table": "users"}))
+		if err := readAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bytesByName := map[string]int64{}
+	for _, s := range prof.Sample {
+		if len(s.LocationIndex) != 0 {
+			t.Fatalf("expected no locations in stackless mode but got %d", len(s.LocationIndex))
+		}
+		for _, l := range s.Label {
+			switch prof.StringTable[l.Key] {
+			case "name":
+				bytesByName[prof.StringTable[l.Str]] += s.Value[1]
+			case "table":
+				t.Fatal("expected only the name label in stackless mode")
+			}
+		}
+	}
+	if bytesByName["wal"] != 1024 || bytesByName["data"] != 1024 {
+		t.Fatalf("expected 1024 bytes per name but got %v", bytesByName)
+	}
+
+	// Escalate to full stacks.
+	p.SetStackless(false)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+	prof, err = p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range prof.Sample {
+		if len(s.LocationIndex) == 0 {
+			t.Fatal("expected stacks after leaving stackless mode")
+		}
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	o := p.Overhead()
+	if o.Records == 0 || o.RecordTime <= 0 || o.StacksWalked == 0 || o.Memory <= 0 {
+		t.Fatalf("expected overhead to be accounted for but got %+v", o)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Comment) != 1 || !strings.HasPrefix(prof.StringTable[prof.Comment[0]], "rprof: overhead of ") {
+		t.Fatal("expected a comment about the overhead")
+	}
+}
+
+func TestFailedReads(t *testing.T) {
+	cases := []struct {
+		policy        rprof.FailedReadPolicy
+		reads, errors int64
+	}{
+		{rprof.RecordFailedReads, 3, 3},
+		{rprof.SkipFailedReads, 0, 0},
+		{rprof.CountFailedReads, 0, 3},
+	}
+	for _, c := range cases {
+		p := rprof.NewProfiler(rprof.WithFailedReads(c.policy))
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := p.Reader(iotest.ErrReader(errors.New("boom")))
+		for i := 0; i < 3; i++ {
+			if _, err := r.Read(make([]byte, 16)); err == nil {
+				t.Fatal("expected an error")
+			}
+		}
+
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reads, errs int64
+		for _, s := range prof.Sample {
+			reads += s.Value[0]
+			errs += s.Value[3]
+		}
+		if reads != c.reads || errs != c.errors {
+			t.Fatalf("policy %d: expected %d reads and %d errors but got %d and %d", c.policy, c.reads, c.errors, reads, errs)
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		p := rprof.NewProfiler()
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		var src io.Reader = bytes.NewReader(make([]byte, 1<<20))
+		if !fast {
+			src = struct{ io.Reader }{src}
+		}
+		var dst bytes.Buffer
+		n, err := io.Copy(&dst, p.ReadCloser(io.NopCloser(src)))
+		if err != nil || n != 1<<20 {
+			t.Fatalf("expected to copy %d bytes but copied %d: %v", 1<<20, n, err)
+		}
+
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bytesRead, fastPath, eof int64
+		for _, s := range prof.Sample {
+			bytesRead += s.Value[1]
+			eof += s.Value[4]
+			for _, l := range s.Label {
+				if prof.StringTable[l.Key] == "fastpath" {
+					fastPath += s.Value[0]
+				}
+			}
+		}
+		if bytesRead != 1<<20 || eof != 1 {
+			t.Fatalf("expected %d bytes read to EOF once but got %d bytes and %d EOFs", 1<<20, bytesRead, eof)
+		}
+		if fast && fastPath != 1 || !fast && fastPath != 0 {
+			t.Fatalf("unexpected %d fast path reads", fastPath)
+		}
+	}
+}
+
+// leakReader creates a reader that is never closed.
+func leakReader(p *rprof.Rprof) {
+	r := p.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 16))))
+	readByte(r)
+}
+
+func TestLeakDetection(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithLeakDetection())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := p.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 16))))
+	if err := readAll(closed); err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	leakReader(p)
+
+	var closes, leaked int64
+	deadline := time.Now().Add(5 * time.Second)
+	for leaked == 0 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+
+		prof, err := p.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		closes, leaked = 0, 0
+		for _, s := range prof.Sample {
+			closes += s.Value[7]
+			leaked += s.Value[8]
+		}
+	}
+	if closes != 1 || leaked != 1 {
+		t.Fatalf("expected 1 close and 1 leak but got %d and %d", closes, leaked)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	p := rprof.NewProfiler()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Collect(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context's error but got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		// Read once the profiler is started, then end the collection.
+		for {
+			if _, err := p.Snapshot(); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+		cancel()
+	}()
+	prof, err := p.Collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bytesRead int64
+	for _, s := range prof.Sample {
+		bytesRead += s.Value[1]
+	}
+	if bytesRead != 1024 {
+		t.Fatalf("expected 1024 bytes but got %d", bytesRead)
+	}
+	if _, err := p.Stop(); err == nil {
+		t.Fatal("expected the profiler to be stopped")
+	}
+
+	if _, err := p.StartFor(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Stop(); err == nil {
+		t.Fatal("expected the profiler to be stopped")
+	}
+}
+
+func TestSymbolization(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithSymbolization())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAll(p.Reader(bytes.NewReader(make([]byte, 1024)))); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, loc := range prof.Location {
+		if len(loc.Line) == 0 {
+			t.Fatalf("location %d was not symbolized", loc.Id)
+		}
+		fn := prof.Function[loc.Line[0].FunctionIndex-1]
+		if prof.StringTable[fn.Name] == "github.com/polarsignals/rprof_test.readAll" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected the readAll frame to be symbolized")
+	}
+}
+
+func TestDumpOnSignal(t *testing.T) {
+	proc, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+
+	path := filepath.Join(t.TempDir(), "rprof.pb.gz")
+	stop := p.DumpOnSignal(path, 0, os.Interrupt)
+	defer stop()
+	if err := proc.Signal(os.Interrupt); err != nil {
+		t.Skipf("sending signals to the process is not supported: %v", err)
+	}
+
+	// The profile is renamed to path once it is complete.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the profile to be written on the signal")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	prof := readProfileFile(t, path)
+	var bytesRead int64
+	for _, s := range prof.Sample {
+		bytesRead += s.Value[1]
+	}
+	if bytesRead != 1024 {
+		t.Fatalf("expected 1024 bytes but got %d", bytesRead)
+	}
+	if _, err := p.Snapshot(); err != nil {
+		t.Fatalf("expected the profiler to keep running: %v", err)
+	}
+}
+
+// readProfileFile reads the compressed profile at path.
+func readProfileFile(t *testing.T, path string) *profile.Profile {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return readProfile(t, f)
+}
+
+// readProfile reads a compressed profile from r.
+func readProfile(t *testing.T, r io.Reader) *profile.Profile {
+	t.Helper()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := &profile.Profile{}
+	if err := proto.Unmarshal(data, prof); err != nil {
+		t.Fatal(err)
+	}
+	return prof
+}
+
+func TestStartWriting(t *testing.T) {
+	p := rprof.NewProfiler()
+	buf := bytes.NewBuffer(nil)
+	if err := p.StartWriting(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StartWriting(buf); err == nil {
+		t.Fatal("expected error starting a started profiler")
+	}
+	readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+	if buf.Len() != 0 {
+		t.Fatal("expected nothing to be written before Stop")
+	}
+
+	if _, err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := &profile.Profile{}
+	if err := proto.Unmarshal(data, prof); err != nil {
+		t.Fatal(err)
+	}
+	var bytesRead int64
+	for _, s := range prof.Sample {
+		bytesRead += s.Value[1]
+	}
+	if bytesRead != 1024 {
+		t.Fatalf("expected 1024 bytes but got %d", bytesRead)
+	}
+
+	// The writer is only used for the window started by StartWriting.
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing to be written by a later Stop but got %d bytes", buf.Len())
+	}
+}
+
+func TestScopeHandler(t *testing.T) {
+	var got rprof.Snapshot
+	h := rprof.ScopeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readAll(rprof.ReaderContext(r.Context(), bytes.NewReader(make([]byte, 1024))))
+		// Readers not created with the context aren't part of the scope.
+		readAll(rprof.Reader(bytes.NewReader(make([]byte, 1024))))
+		w.Write([]byte("ok"))
+	}), rprof.WithScopeTrailers(), rprof.WithScopeCallback(func(r *http.Request, s rprof.Snapshot) {
+		got = s
+	}))
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got.Bytes != 1024 {
+		t.Fatalf("expected 1024 bytes in the scope but got %d", got.Bytes)
+	}
+	if len(got.Profile().Sample) == 0 {
+		t.Fatal("expected samples in the profile of the scope")
+	}
+	if v := resp.Trailer.Get("Rprof-Bytes"); v != "1024" {
+		t.Fatalf("expected the Rprof-Bytes trailer to be 1024 but got %q", v)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	}))
+	defer srv.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: p.Transport(srv.Client().Transport)}
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(resp.Body)
+		resp.Body.Close()
+	}
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bytes read by phase and connection.
+	got := map[[2]string]int64{}
+	for _, s := range prof.Sample {
+		var key [2]string
+		for _, l := range s.Label {
+			switch prof.StringTable[l.Key] {
+			case "http.phase":
+				key[0] = prof.StringTable[l.Str]
+			case "http.conn":
+				key[1] = prof.StringTable[l.Str]
+			}
+		}
+		got[key] += s.Value[1]
+	}
+	for _, conn := range []string{"new", "reused"} {
+		if got[[2]string{"body", conn}] != 1024 {
+			t.Errorf("expected 1024 body bytes on a %s connection but got %v", conn, got)
+		}
+		if got[[2]string{"header", conn}] == 0 {
+			t.Errorf("expected header bytes on a %s connection but got %v", conn, got)
+		}
+	}
+}
+
+func TestBufferedReader(t *testing.T) {
+	for _, tc := range []struct {
+		readSize int
+		hits     bool
+	}{
+		// Small reads are mostly served from the buffer.
+		{readSize: 128, hits: true},
+		// Reads larger than the buffer bypass it.
+		{readSize: 8192, hits: false},
+	} {
+		p := rprof.NewProfiler()
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		r := p.BufferedReader(bytes.NewReader(make([]byte, 1<<16)), 4096)
+		buf := make([]byte, tc.readSize)
+		for {
+			if _, err := r.Read(buf); err == io.EOF {
+				break
+			}
+		}
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fetchedIdx, hitsIdx := sampleTypeIndex(prof, "fetched"), sampleTypeIndex(prof, "hits")
+		var reads, bytesRead, fetched, hits int64
+		for _, s := range prof.Sample {
+			reads += s.Value[0]
+			bytesRead += s.Value[1]
+			fetched += s.Value[fetchedIdx]
+			hits += s.Value[hitsIdx]
+		}
+		if bytesRead != 1<<16 || fetched != 1<<16 {
+			t.Fatalf("read size %d: expected %d bytes read and fetched but got %d and %d", tc.readSize, 1<<16, bytesRead, fetched)
+		}
+		if tc.hits && hits < reads*9/10 || !tc.hits && hits != 0 {
+			t.Fatalf("read size %d: unexpected %d hits of %d reads", tc.readSize, hits, reads)
+		}
+	}
+}
+
+func TestCallerLabels(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithCallerLabels(2))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range prof.Sample {
+		labels := map[string]string{}
+		for _, l := range s.Label {
+			labels[prof.StringTable[l.Key]] = prof.StringTable[l.Str]
+		}
+		// readAll calls io.ReadAll.
+		if !strings.HasPrefix(labels["caller"], "io/io.go:") || !strings.Contains(labels["caller.1"], "/extern_test.go:") {
+			t.Fatalf("unexpected caller labels %v", labels)
+		}
+		if _, ok := labels["caller.2"]; ok {
+			t.Fatalf("expected 2 caller labels but got %v", labels)
+		}
+	}
+}
+
+func TestSamples(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	r := p.Reader(bytes.NewReader(make([]byte, 1000)), rprof.WithLabels(map[string]string{"table": "users"}))
+	if _, err := r.Read(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	p.Samples(func(s rprof.Sample) bool {
+		n++
+		if s.Reads != 1 || s.Bytes != 1000 || s.Size != 1024 || s.Labels["table"] != "users" {
+			t.Fatalf("unexpected sample %+v", s)
+		}
+		if f, _ := runtime.CallersFrames(s.Stack).Next(); f.Function != "github.com/polarsignals/rprof_test.TestSamples" {
+			t.Fatalf("unexpected leaf frame %s", f.Function)
+		}
+		return true
+	})
+	if n != 1 {
+		t.Fatalf("expected 1 sample but got %d", n)
+	}
+}
+
+func TestSampleHook(t *testing.T) {
+	var events []rprof.SampleEvent
+	p := rprof.NewProfiler(rprof.WithSampleHook(func(ev rprof.SampleEvent) {
+		events = append(events, ev)
+	}, 2))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	r := p.Reader(bytes.NewReader(make([]byte, 1000)), rprof.WithLabels(map[string]string{"table": "users"}))
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The third read may fall into the next second.
+	if len(events) < 2 || len(events) > 3 {
+		t.Fatalf("expected 2 or 3 events but got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Reads != 1 || ev.Bytes != 100 || ev.Size != 100 || ev.Labels["table"] != "users" || len(ev.Stack) == 0 {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	var reads int64
+	p.Samples(func(s rprof.Sample) bool {
+		reads += s.Reads
+		return true
+	})
+	if reads != 3 {
+		t.Fatalf("expected 3 aggregated reads but got %d", reads)
+	}
+}
+
+func TestTransformers(t *testing.T) {
+	var comments int
+	p := rprof.NewProfiler(
+		rprof.WithTransformers(rprof.DropLabels("table")),
+		rprof.WithTransformers(rprof.TransformerFunc(func(prof *profile.Profile) {
+			comments = len(prof.Comment)
+			prof.Comment = nil
+		})),
+	)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Reader(bytes.NewReader(make([]byte, 1024)),
+		rprof.WithLabels(map[string]string{"table": "users", "region": "eu"}),
+	)
+	if err := readAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if comments == 0 || len(prof.Comment) != 0 {
+		t.Fatalf("expected the transformers to run in order after the comments were added")
+	}
+	for _, s := range prof.Sample {
+		var region bool
+		for _, l := range s.Label {
+			switch prof.StringTable[l.Key] {
+			case "table":
+				t.Fatal("expected the table label to be dropped")
+			case "region":
+				region = true
+			}
+		}
+		if !region {
+			t.Fatal("expected the region label to be kept")
+		}
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	p := rprof.NewProfiler(rprof.WithValueTypes(
+		rprof.ValueType{Type: "decompressed", Unit: "bytes"},
+		rprof.ValueType{Type: "rows", Unit: "count"},
+	))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Reader(bytes.NewReader(make([]byte, 1000)), rprof.WithReadValues(func(n int, values []int64) {
+		values[0] = int64(n) * 4
+		values[1] = 1
+	}))
+	for i := 0; i < 10; i++ {
+		if _, err := r.Read(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decompressed, rows int64
+	for i, st := range prof.SampleType {
+		for _, s := range prof.Sample {
+			switch prof.StringTable[st.Type] + "/" + prof.StringTable[st.Unit] {
+			case "decompressed/bytes":
+				decompressed += s.Value[i]
+			case "rows/count":
+				rows += s.Value[i]
+			}
+		}
+	}
+	if decompressed != 4000 || rows != 10 {
+		t.Fatalf("expected 4000 decompressed bytes and 10 rows but got %d and %d", decompressed, rows)
+	}
+}
+
+func TestTooManyValueTypes(t *testing.T) {
+	types := make([]rprof.ValueType, rprof.MaxValueTypes)
+	for i := range types {
+		types[i] = rprof.ValueType{Type: fmt.Sprintf("type%d", i), Unit: "count"}
+	}
+	if got := rprof.NewProfiler(rprof.WithValueTypes(types...)).ValueTypes(); len(got) != rprof.MaxValueTypes {
+		t.Fatalf("expected %d value types but got %d", rprof.MaxValueTypes, len(got))
+	}
+
+	extra := rprof.ValueType{Type: "extra", Unit: "count"}
+	for _, fn := range []func(){
+		func() { rprof.NewProfiler(rprof.WithValueTypes(append(types, extra)...)) },
+		func() { rprof.NewProfiler(rprof.WithValueTypes(types...), rprof.WithValueTypes(extra)) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected a panic for too many value types")
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestTinyReads(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// Byte-wise reads without a buffer are flagged, buffered ones aren't.
+	r := p.Reader(bytes.NewReader(make([]byte, 100)))
+	for readByte(r) == nil {
+	}
+	bufio.NewReader(p.Reader(bytes.NewReader(make([]byte, 8192)))).WriteTo(io.Discard)
+
+	tiny := p.TinyReads(rprof.DefaultTinyReadSize, 10)
+	if len(tiny) != 1 {
+		t.Fatalf("expected 1 stack with tiny reads but got %+v", tiny)
+	}
+	// The final read returning io.EOF counts as well.
+	if tiny[0].Reads != 101 || tiny[0].Bytes != 100 || tiny[0].AverageSize != 0 || !strings.Contains(tiny[0].Frames[0], "readByte") {
+		t.Fatalf("unexpected tiny reads: %+v", tiny[0])
+	}
+	if tiny := p.TinyReads(rprof.DefaultTinyReadSize, -1); len(tiny) != 0 {
+		t.Fatalf("expected no tiny reads for a negative k but got %+v", tiny)
+	}
+
+	rec := httptest.NewRecorder()
+	rprof.NewStatusHandler(p).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "rprof_test.readByte") {
+		t.Fatalf("expected the tiny reads on the status page but got %s", rec.Body.String())
+	}
+}
+
+func TestPair(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Pair("buffered", func(lower io.Reader) io.Reader {
+		return bufio.NewReaderSize(lower, 4096)
+	}, bytes.NewReader(make([]byte, 8192)))
+	if _, err := io.ReadFull(r, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prof.Sample) != 1 {
+		t.Fatalf("expected 1 sample but got %d", len(prof.Sample))
+	}
+	s := prof.Sample[0]
+	i := sampleTypeIndex(prof, "fetched")
+	if s.Value[1] != 1000 || s.Value[i] != 4096 {
+		t.Fatalf("expected 1000 bytes read and 4096 fetched but got %d and %d", s.Value[1], s.Value[i])
+	}
+	var pair string
+	var amplification int64
+	for _, l := range s.Label {
+		switch prof.StringTable[l.Key] {
+		case "pair":
+			pair = prof.StringTable[l.Str]
+		case "amplification":
+			amplification = l.Num
+		}
+	}
+	if pair != "buffered" || amplification != 409 {
+		t.Fatalf("expected the pair and amplification labels but got %q and %d", pair, amplification)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	// Pseudo-random data doesn't compress, so the compressed data outgrows
+	// the buffer filled when reading the gzip header.
+	data := make([]byte, 64<<10)
+	x := uint32(1)
+	for i := range data {
+		x = x*1664525 + 1013904223
+		data[i] = byte(x >> 24)
+	}
+	zw.Write(data)
+	zw.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := p.Pipeline("blocks", bytes.NewReader(compressed.Bytes()), []rprof.Stage{{
+		Name: "gzip",
+		New:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := map[string]int64{}
+	var fetched int64
+	for _, s := range prof.Sample {
+		var pipeline, layer string
+		for _, l := range s.Label {
+			switch prof.StringTable[l.Key] {
+			case "pipeline":
+				pipeline = prof.StringTable[l.Str]
+			case "layer":
+				layer = prof.StringTable[l.Str]
+			}
+		}
+		if pipeline != "blocks" {
+			t.Fatalf("expected the pipeline label on every sample but got %q", pipeline)
+		}
+		read[layer] += s.Value[1]
+		if layer == "gzip" {
+			fetched += s.Value[sampleTypeIndex(prof, "fetched")]
+		}
+	}
+	if read["source"] != int64(compressed.Len()) || read["gzip"] != int64(len(data)) {
+		t.Fatalf("unexpected bytes read per layer: %v", read)
+	}
+	if fetched == 0 || fetched > read["source"] {
+		t.Fatalf("expected the gzip layer to fetch from the source but got %d", fetched)
+	}
+}
+
+func TestZipReader(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		method := zip.Store
+		if name == "c.txt" {
+			method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(make([]byte, 1000))
+	}
+	zw.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := p.ZipReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := map[string]int64{}
+	p.Samples(func(s rprof.Sample) bool {
+		before[s.Labels["zip.entry"]] += s.Bytes
+		return true
+	})
+
+	f, err := zr.Open("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(f); err != nil {
+		t.Fatal(err)
+	}
+	f, err = zr.Open("c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(f); err != nil {
+		t.Fatal(err)
+	}
+
+	read := map[string]int64{}
+	p.Samples(func(s rprof.Sample) bool {
+		read[s.Labels["zip.entry"]] += s.Bytes
+		return true
+	})
+	p.Stop()
+
+	if len(before) != 1 || before[""] == 0 {
+		t.Fatalf("expected the directory reads to be unlabeled but got %v", before)
+	}
+	// The local header of the entry is read unlabeled when opening it.
+	if read["a.txt"] != 0 || read["b.txt"] != 1000 || read["c.txt"] == 0 {
+		t.Fatalf("unexpected bytes read per entry: %v", read)
+	}
+
+	// Opening the archive reads no more than the directory.
+	var plain, profiled countingReaderAt
+	plain.r = bytes.NewReader(archive.Bytes())
+	profiled.r = bytes.NewReader(archive.Bytes())
+	if _, err := zip.NewReader(&plain, int64(archive.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ZipReader(&profiled, int64(archive.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if profiled.reads != plain.reads {
+		t.Fatalf("expected %d reads opening the archive but got %d", plain.reads, profiled.reads)
+	}
+}
+
+// countingReaderAt counts the reads of an io.ReaderAt.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (r *countingReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	r.reads++
+	return r.r.ReadAt(buf, off)
+}
+
+func TestTarReader(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: 4096}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(make([]byte, 4096))
+	}
+	tw.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	tr := p.TarReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "b.txt" {
+			if err := readAll(tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	read := map[string]int64{}
+	p.Samples(func(s rprof.Sample) bool {
+		read[s.Labels["tar.entry"]] += s.Bytes
+		return true
+	})
+	// The entry b.txt is read, a.txt is skipped by Next, which reads the
+	// header of b.txt.
+	if read["b.txt"] < 4096 || read["a.txt"] == 0 || read["a.txt"]+read["b.txt"]+read[""] != int64(archive.Len()) {
+		t.Fatalf("unexpected bytes read per entry: %v", read)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if types := p.ValueTypes(); len(types) != 0 {
+		t.Fatalf("expected no value types before creating a scanner but got %+v", types)
+	}
+	s := p.Scanner(strings.NewReader(strings.Repeat("123456789\n", 10000)))
+	var lines int
+	for s.Scan() {
+		lines++
+	}
+	if err := s.Err(); err != nil || lines != 10000 {
+		t.Fatalf("expected 10000 lines but got %d: %v", lines, err)
+	}
+
+	if types := p.ValueTypes(); len(types) != 1 || types[0] != (rprof.ValueType{Type: "tokens", Unit: "count"}) {
+		t.Fatalf("expected the tokens value type but got %+v", types)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sampleTypeIndex(prof, "records") != -1 {
+		t.Fatal("expected no records sample type without decoders")
+	}
+	i := sampleTypeIndex(prof, "tokens")
+	var tokens int64
+	var tokenSize bool
+	for _, s := range prof.Sample {
+		tokens += s.Value[i]
+		for _, l := range s.Label {
+			if prof.StringTable[l.Key] == "token_size" {
+				if l.Num < 9 || l.Num > 11 {
+					t.Fatalf("unexpected token size %d", l.Num)
+				}
+				tokenSize = true
+			}
+		}
+	}
+	if tokens != 10000 || !tokenSize {
+		t.Fatalf("expected 10000 tokens and the token size label but got %d and %v", tokens, tokenSize)
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := p.JSONDecoder(strings.NewReader(strings.Repeat(`{"id":1234}`+"\n", 1000)))
+	for {
+		var v struct{ ID int }
+		if err := d.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := p.CSVReader(strings.NewReader(strings.Repeat("a,b,c\n", 500))).ReadAll()
+	if err != nil || len(records) != 500 {
+		t.Fatalf("expected 500 records but got %d: %v", len(records), err)
+	}
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := sampleTypeIndex(prof, "records")
+	var decoded, read int64
+	var recordSize bool
+	for _, s := range prof.Sample {
+		decoded += s.Value[i]
+		read += s.Value[1]
+		for _, l := range s.Label {
+			recordSize = recordSize || prof.StringTable[l.Key] == "record_size"
+		}
+	}
+	if decoded != 1500 || read != 12*1000+6*500 || !recordSize {
+		t.Fatalf("expected 1500 records decoded off %d bytes and the record size label but got %d off %d and %v", 12*1000+6*500, decoded, read, recordSize)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	}))
+	defer srv.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	orig := &http.Client{Timeout: time.Minute}
+	client := p.Client(orig)
+	if orig.Transport != nil || client.Timeout != time.Minute {
+		t.Fatal("expected a copy of the client")
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(resp.Body)
+	resp.Body.Close()
+
+	var body int64
+	p.Samples(func(s rprof.Sample) bool {
+		if s.Labels["http.phase"] == "body" {
+			body += s.Bytes
+		}
+		return true
+	})
+	if body != 1024 {
+		t.Fatalf("expected 1024 body bytes but got %d", body)
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	}))
+	defer srv.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	resp, err := srv.Client().Get(srv.URL + "/objects/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = p.ResponseBody(resp)
+	readAll(resp.Body)
+	resp.Body.Close()
+
+	var body int64
+	p.Samples(func(s rprof.Sample) bool {
+		if s.Labels["http.method"] != "GET" || s.Labels["http.host"] != srv.Listener.Addr().String() || s.Labels["http.path"] != "/objects/1" {
+			t.Fatalf("unexpected labels %v", s.Labels)
+		}
+		body += s.Bytes
+		return true
+	})
+	if body != 1024 {
+		t.Fatalf("expected 1024 body bytes but got %d", body)
+	}
+}
+
+func TestInstrumentDefaultHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	}))
+	defer srv.Close()
+
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	orig := http.DefaultTransport
+	restore := p.InstrumentDefaultHTTP()
+	p.InstrumentDefaultHTTP()()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(resp.Body)
+	resp.Body.Close()
+	restore()
+	if http.DefaultTransport != orig {
+		t.Fatal("expected the default transport to be restored")
+	}
+
+	var body int64
+	p.Samples(func(s rprof.Sample) bool {
+		if s.Labels["http.phase"] == "body" {
+			body += s.Bytes
+		}
+		return true
+	})
+	if body != 1024 {
+		t.Fatalf("expected 1024 body bytes but got %d", body)
+	}
+}
+
+func TestListener(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readAll(r.Body)
+	}))
+	srv.Listener = p.Listener(srv.Listener, rprof.WithName("server"))
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL, "application/octet-stream", bytes.NewReader(make([]byte, 1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var read int64
+	p.Samples(func(s rprof.Sample) bool {
+		read += s.Bytes
+		return true
+	})
+	// The request header is read as well as the body.
+	if read <= 1024 {
+		t.Fatalf("expected more than the 1024 bytes of the body but got %d", read)
+	}
+}
+
+// messageConn is a WebSocket connection with a queue of messages.
+type messageConn struct {
+	types    []int
+	messages []string
+}
+
+func (c *messageConn) NextReader() (int, io.Reader, error) {
+	if len(c.messages) == 0 {
+		return 0, nil, io.EOF
+	}
+	typ, msg := c.types[0], c.messages[0]
+	c.types, c.messages = c.types[1:], c.messages[1:]
+	return typ, strings.NewReader(msg), nil
+}
+
+func TestNextReader(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	c := &messageConn{types: []int{1, 2, 2}, messages: []string{"hello", "12345678", "1234"}}
+	for {
+		_, r, err := p.NextReader(c)
+		if err == io.EOF {
+			break
+		}
+		if err := readAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := map[string]int64{}
+	var messages int64
+	p.Samples(func(s rprof.Sample) bool {
+		read[s.Labels["websocket.message"]] += s.Bytes
+		messages += s.EOF
+		return true
+	})
+	if read["text"] != 5 || read["binary"] != 12 || messages != 3 {
+		t.Fatalf("unexpected bytes read per message type %v of %d messages", read, messages)
+	}
+}
+
+func TestConns(t *testing.T) {
+	p := rprof.NewProfiler()
+
+	var conns []net.Conn
+	for _, size := range []int{100, 1000} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(make([]byte, size))
+			client.Close()
+		}()
+		c := p.Conn(server)
+		if err := readAll(c); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+
+	stats := p.Conns(10)
+	if len(stats) != 2 || stats[0].Bytes != 1000 || stats[1].Bytes != 100 || stats[0].Remote != "pipe" {
+		t.Fatalf("unexpected connection stats %+v", stats)
+	}
+
+	conns[1].Close()
+	rec := httptest.NewRecorder()
+	rprof.NewConnsHandler(p).ServeHTTP(rec, httptest.NewRequest("GET", "/?n=5", nil))
+	if !strings.Contains(rec.Body.String(), `"bytes":100}`) || strings.Contains(rec.Body.String(), `"bytes":1000}`) {
+		t.Fatalf("expected only the open connection but got %s", rec.Body.String())
+	}
+
+	if stats := p.Conns(-1); len(stats) != 0 {
+		t.Fatalf("expected no connections for a negative n but got %+v", stats)
+	}
+	rec = httptest.NewRecorder()
+	rprof.NewConnsHandler(p).ServeHTTP(rec, httptest.NewRequest("GET", "/?n=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a negative n but got %d", rec.Code)
+	}
+}
+
+func TestConnConcurrentReads(t *testing.T) {
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	c := p.Conn(server)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 16)
+			for {
+				if _, err := c.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	client.Write(make([]byte, 1024))
+	client.Close()
+	wg.Wait()
+	c.Close()
+
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sumValues(prof, 1); n != 1024 {
+		t.Fatalf("expected 1024 bytes but got %d", n)
+	}
+	if n := sumValues(prof, sampleTypeIndex(prof, "eof")); n != 1 {
+		t.Fatalf("expected the end of the stream to be recorded once but got %d", n)
+	}
+}
+
+func TestSamplingParameters(t *testing.T) {
+	for _, tc := range []struct {
+		opt        rprof.Option
+		period     int64
+		periodType string
+	}{
+		{rprof.WithSampleRate(10), 10, "reads"},
+		{rprof.WithByteSampleRate(4096), 4096, "read"},
+	} {
+		p := rprof.NewProfiler(tc.opt)
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if prof.Period != tc.period || prof.StringTable[prof.PeriodType.Type] != tc.periodType {
+			t.Fatalf("expected a period of %d %s but got %d %s", tc.period, tc.periodType, prof.Period, prof.StringTable[prof.PeriodType.Type])
+		}
+		var comment bool
+		for _, c := range prof.Comment {
+			comment = comment || strings.Contains(prof.StringTable[c], "scaled estimates")
+		}
+		if !comment {
+			t.Fatal("expected a comment on the sampling")
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package rprof
+
+import (
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// frameKind classifies the function of a PC for trimming stacks.
+type frameKind uint8
+
+const (
+	frameUser frameKind = iota
+	// frameInternal is a frame of rprof's own code, such as a wrapper's Read
+	// method.
+	frameInternal
+	// frameRuntime is a frame of the runtime package, such as runtime.main or
+	// runtime.goexit.
+	frameRuntime
+)
+
+// stackSlack is the number of PCs stack buffers hold in addition to the
+// maximum stack depth, to walk rprof's own frames and skipped frames without
+// walking the stack twice.
+const stackSlack = 16
+
+var (
+	// pkgPath is the import path of this package, determined at runtime to
+	// remain correct when the package is vendored or forked.
+	pkgPath = reflect.TypeOf(Rprof{}).PkgPath()
+
+	// frameKinds caches the kind of each PC seen, PCs are immutable for the
+	// lifetime of the process.
+	frameKinds sync.Map // uintptr -> frameKind
+)
+
+// kindOf returns the kind of the function at pc. If functions are inlined at
+// pc, the kind is that of the outermost function, which is the one that was
+// actually called.
+func kindOf(pc uintptr) frameKind {
+	if kind, ok := frameKinds.Load(pc); ok {
+		return kind.(frameKind)
+	}
+
+	var outermost runtime.Frame
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		f, more := frames.Next()
+		outermost = f
+		if !more {
+			break
+		}
+	}
+
+	kind := frameUser
+	switch funcPackage(outermost.Function) {
+	case pkgPath:
+		// Internal tests are part of the package but are callers of rprof
+		// rather than rprof itself.
+		if !strings.HasSuffix(outermost.File, "_test.go") {
+			kind = frameInternal
+		}
+	case "runtime":
+		kind = frameRuntime
+	}
+
+	frameKinds.Store(pc, kind)
+	return kind
+}
+
+// funcPackage returns the import path of the package of the fully qualified
+// function name, such as "github.com/polarsignals/rprof.(*Rprof).Start".
+func funcPackage(name string) string {
+	// The package name is the part up to the first dot after the last slash.
+	slash := strings.LastIndexByte(name, '/')
+	if i := strings.IndexByte(name[slash+1:], '.'); i >= 0 {
+		return name[:slash+1+i]
+	}
+	return name
+}
+
+// internalFrames returns the number of rprof frames at the leaf end of the
+// stack. There may be more than one when wrappers are composed, for example a
+// Reader wrapping a ReadCloser.
+func internalFrames(pcs []uintptr) int {
+	for i, pc := range pcs {
+		if kindOf(pc) != frameInternal {
+			return i
+		}
+	}
+	return len(pcs)
+}
+
+// trimRuntimeFrames returns pcs without the runtime frames at its root end.
+func trimRuntimeFrames(pcs []uintptr) []uintptr {
+	for len(pcs) > 0 && kindOf(pcs[len(pcs)-1]) == frameRuntime {
+		pcs = pcs[:len(pcs)-1]
+	}
+	return pcs
+}
+
+// stackWalk walks the stack of a record once, on first use, for all the
+// profilers the record goes to.
+type stackWalk struct {
+	p   *Rprof
+	cfg *wrapConfig
+
+	// walker is the profiler whose pool buf was taken from.
+	walker *Rprof
+	buf    *[]uintptr
+	pcs    []uintptr
+}
+
+// stack returns the stack of the record without rprof's own frames and the
+// frames skipped by the wrapper, at least as deep as the maximum stack depth
+// of every profiler the record goes to.
+func (w *stackWalk) stack() []uintptr {
+	if w.buf != nil || w.pcs != nil {
+		return w.pcs
+	}
+	if c := w.cfg.stackCache; c != nil {
+		if pcs, ok := c.get(); ok {
+			w.pcs = pcs
+			return pcs
+		}
+	}
+
+	w.walker = w.p
+	for _, q := range w.cfg.also {
+		if q.cfg.stackDepth() > w.walker.cfg.stackDepth() {
+			w.walker = q
+		}
+	}
+	w.buf = w.walker.stackBuf()
+
+	// Skip runtime.Callers, stack, add and the record method. The remaining
+	// frames of rprof, such as the wrapper methods, are trimmed below since
+	// their number varies and wrappers may be composed.
+	w.walker.overhead.stacksWalked.Add(1)
+	numRead := runtime.Callers(4, *w.buf)
+	pcs := (*w.buf)[:numRead]
+	skip := internalFrames(pcs) + w.cfg.skipFrames
+	if skip <= stackSlack {
+		pcs = pcs[min(skip, len(pcs)):]
+	} else {
+		// The slack doesn't suffice to hold the skipped frames, so walk the
+		// stack again rather than risk cutting frames within the depth.
+		numRead = runtime.Callers(4+skip, *w.buf)
+		pcs = (*w.buf)[:numRead]
+	}
+
+	w.pcs = pcs
+	if c := w.cfg.stackCache; c != nil {
+		c.put(pcs)
+	}
+	return pcs
+}
+
+// release returns the buffer of the walk to its pool.
+func (w *stackWalk) release() {
+	if w.buf != nil {
+		w.walker.stackBufs.Put(w.buf)
+	}
+}
+
+// stackCache caches the stack of a wrapper's records, which is identical
+// for reads from a loop, and only walks it again every so many records.
+type stackCache struct {
+	every int64
+	n     atomic.Int64
+	pcs   atomic.Pointer[[]uintptr]
+}
+
+// get returns the cached stack unless it has to be walked again.
+func (c *stackCache) get() ([]uintptr, bool) {
+	if c.n.Add(1)%c.every == 0 {
+		return nil, false
+	}
+	pcs := c.pcs.Load()
+	if pcs == nil {
+		return nil, false
+	}
+	return *pcs, true
+}
+
+// put caches a copy of pcs.
+func (c *stackCache) put(pcs []uintptr) {
+	pcs = slices.Clone(pcs)
+	if pcs == nil {
+		// Tell an empty stack apart from a missing one.
+		pcs = []uintptr{}
+	}
+	c.pcs.Store(&pcs)
+}
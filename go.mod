@@ -4,4 +4,9 @@ go 1.22.1
 
 require go.opentelemetry.io/proto/otlp v1.3.1
 
-require google.golang.org/protobuf v1.34.1
+require (
+	github.com/google/pprof v0.0.0-20241210010833-40e02aabc2ad
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	google.golang.org/protobuf v1.34.1
+)
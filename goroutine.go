@@ -0,0 +1,32 @@
+package rprof
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+)
+
+// goroutinePrefix is the prefix of the first line of runtime.Stack's output.
+var goroutinePrefix = []byte("goroutine ")
+
+// goroutineID returns the ID of the calling goroutine as printed in stack
+// traces, or 0 if it cannot be determined.
+func goroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+
+	// The first line looks like "goroutine 18 [running]:".
+	line, ok := bytes.CutPrefix(buf[:n], goroutinePrefix)
+	if !ok {
+		return 0
+	}
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+
+	id, err := strconv.ParseUint(string(line), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
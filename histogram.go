@@ -0,0 +1,77 @@
+package rprof
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultReadSizeBuckets are the bucket upper bounds used by
+// NewReadSizeHistogram when none are given: powers of four from 64B to 16MiB.
+var DefaultReadSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+// ReadSizeHistogram is a histogram of the sizes of reads performed through
+// profiled readers. Unlike profiles it is not bound to a collection window,
+// once set on a profiler every read is observed.
+type ReadSizeHistogram struct {
+	bounds []float64
+	// counts has one more entry than bounds, for the +Inf bucket.
+	counts []atomic.Uint64
+	sum    atomic.Int64
+}
+
+// NewReadSizeHistogram returns a new histogram with the given bucket upper
+// bounds in bytes. If no bounds are given DefaultReadSizeBuckets are used.
+func NewReadSizeHistogram(bounds ...float64) *ReadSizeHistogram {
+	if len(bounds) == 0 {
+		bounds = DefaultReadSizeBuckets
+	}
+	bounds = slices.Clone(bounds)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	return &ReadSizeHistogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe records a read of the given size.
+func (h *ReadSizeHistogram) Observe(size int) {
+	i, _ := slices.BinarySearch(h.bounds, float64(size))
+	h.counts[i].Add(1)
+	h.sum.Add(int64(size))
+}
+
+// ServeHTTP writes the histogram in the OpenMetrics text format as
+// rprof_read_size_bytes, so it can be scraped by Prometheus.
+// Implements http.Handler.
+func (h *ReadSizeHistogram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.NewBuffer(nil)
+
+	fmt.Fprintln(buf, "# TYPE rprof_read_size_bytes histogram")
+	fmt.Fprintln(buf, "# UNIT rprof_read_size_bytes bytes")
+	fmt.Fprintln(buf, "# HELP rprof_read_size_bytes Size of reads performed through profiled readers.")
+
+	// Load the sum first, so the count is never lower than what the sum implies.
+	sum := h.sum.Load()
+
+	// Buckets are cumulative in the exposition format.
+	var count uint64
+	for i, bound := range h.bounds {
+		count += h.counts[i].Load()
+		fmt.Fprintf(buf, "rprof_read_size_bytes_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'f', -1, 64), count)
+	}
+	count += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(buf, "rprof_read_size_bytes_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(buf, "rprof_read_size_bytes_sum %d\n", sum)
+	fmt.Fprintf(buf, "rprof_read_size_bytes_count %d\n", count)
+	fmt.Fprintln(buf, "# EOF")
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,96 @@
+package rprof
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SampleEvent is a single recorded read, close or leak passed to the hook set
+// with WithSampleHook.
+type SampleEvent struct {
+	// Time is when the event was recorded.
+	Time time.Time
+	// Stack are the PCs of the stack, leaf first. It is nil in stackless
+	// mode. It is a copy and may be retained.
+	Stack []uintptr
+	// Size is the number of bytes of the read, or the average size of the
+	// reads of a batch, 0 if the event isn't of a read.
+	Size int
+	// Labels are the labels of the reader, with numeric labels formatted as
+	// decimal strings.
+	Labels map[string]string
+
+	// The values added to the sample of the event, scaled like the profile
+	// when reads are sampled.
+	Reads     int64
+	Bytes     int64
+	Latency   time.Duration
+	Errors    int64
+	EOF       int64
+	Abandoned int64
+	Requested int64
+	Closes    int64
+	Leaked    int64
+	Extra     [MaxValueTypes]int64
+}
+
+// WithSampleHook calls fn with every recorded event, at most perSecond times
+// per second if perSecond is positive, in addition to aggregating it. It is
+// called synchronously by the reading goroutine, so it should hand events off
+// quickly, for example to audit logs or anomaly detectors. Reads skipped by
+// sampling or the record filter aren't passed to fn.
+func WithSampleHook(fn func(SampleEvent), perSecond int) Option {
+	return func(p *Rprof) {
+		p.cfg.hook = &sampleHook{fn: fn, limit: int64(perSecond)}
+	}
+}
+
+// sampleHook rate limits the calls of a hook to a fixed number per second.
+type sampleHook struct {
+	fn    func(SampleEvent)
+	limit int64
+
+	second atomic.Int64
+	count  atomic.Int64
+}
+
+// allow reports whether the hook may be called at the given time.
+func (h *sampleHook) allow(now time.Time) bool {
+	if h.limit <= 0 {
+		return true
+	}
+	sec := now.Unix()
+	if cur := h.second.Load(); cur != sec && h.second.CompareAndSwap(cur, sec) {
+		h.count.Store(0)
+	}
+	return h.count.Add(1) <= h.limit
+}
+
+// event returns the event of a sample with the given stack, size, labels and
+// values.
+func (h *sampleHook) event(now time.Time, pcs []uintptr, size int, labels string, v sampleValue) SampleEvent {
+	ev := SampleEvent{
+		Time:      now,
+		Size:      max(size, 0),
+		Reads:     v.reads,
+		Bytes:     v.bytes,
+		Latency:   time.Duration(v.latency),
+		Errors:    v.errors,
+		EOF:       v.eof,
+		Abandoned: v.abandoned,
+		Requested: v.requested,
+		Closes:    v.closes,
+		Leaked:    v.leaked,
+		Extra:     v.extra,
+	}
+	if len(pcs) > 0 {
+		ev.Stack = append([]uintptr(nil), pcs...)
+	}
+	if labels != "" {
+		ev.Labels = map[string]string{}
+		decodeLabels(labels, func(l label) {
+			ev.Labels[l.key] = l.stringValue()
+		})
+	}
+	return ev
+}
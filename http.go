@@ -2,12 +2,12 @@ package rprof
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"net/http"
 	"strconv"
 	"time"
 
-	"google.golang.org/protobuf/proto"
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
 )
 
 // ProfHandler is an HTTP handler that starts the profiler for a given duration.
@@ -26,8 +26,44 @@ func NewHandler(p *Rprof) *ProfHandler {
 }
 
 // ServeHTTP starts the profiler for the given duration and writes the profile to the response.
+// If the snapshot parameter is true, it instead writes a snapshot of the
+// already running profiler without stopping it. If the recent parameter is
+// given, it instead writes the windows kept by StartRecent that ended within
+// the given duration, for example recent=5m.
 // Implements http.Handler.
 func (h *ProfHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("snapshot") != "" {
+		snapshot, err := strconv.ParseBool(r.FormValue("snapshot"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if snapshot {
+			prof, err := h.p.Snapshot()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeProfileResponse(w, prof)
+			return
+		}
+	}
+
+	if r.FormValue("recent") != "" {
+		d, err := time.ParseDuration(r.FormValue("recent"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prof, err := h.p.Recent(d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeProfileResponse(w, prof)
+		return
+	}
+
 	// Default to 10 seconds.
 	seconds := 10
 	if r.FormValue("seconds") != "" {
@@ -38,41 +74,29 @@ func (h *ProfHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if seconds <= 0 {
+			http.Error(w, "seconds must be positive", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Start the profiler.
-	if err := h.p.Start(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Wait for the duration for samples to accumulate.
-	time.Sleep(time.Duration(seconds) * time.Second)
-
-	// Stop the profiler, which returns the profile.
-	prof, err := h.p.Stop()
+	// Collect samples for the duration, or until the client goes away.
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(seconds)*time.Second)
+	defer cancel()
+	prof, err := h.p.Collect(ctx)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Marshal the proto message, compress it, and write it to the response.
-	content, err := proto.Marshal(prof)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	writeProfileResponse(w, prof)
+}
 
+// writeProfileResponse marshals the profile, compresses it, and writes it to
+// the response.
+func writeProfileResponse(w http.ResponseWriter, prof *proto.Profile) {
 	buf := bytes.NewBuffer(nil)
-
-	gz := gzip.NewWriter(buf)
-
-	if _, err := gz.Write(content); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if err := gz.Close(); err != nil {
+	if err := writeProfile(buf, prof); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,182 @@
+package rprof
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LabelSet is a set of labels that are attached to the samples of readers
+// wrapped with a context carrying them, mirroring runtime/pprof.LabelSet.
+type LabelSet struct {
+	list []label
+}
+
+// label is a single key-value pair. Numeric labels have a number and an
+// optional unit instead of a string value.
+type label struct {
+	key   string
+	value string
+
+	numeric bool
+	num     int64
+	unit    string
+}
+
+// stringValue returns the value of the label formatted as a string.
+func (l label) stringValue() string {
+	if l.numeric {
+		return strconv.FormatInt(l.num, 10)
+	}
+	return l.value
+}
+
+// Labels takes an even number of strings representing key-value pairs and
+// makes a LabelSet containing them. A label overwrites a prior label with the
+// same key.
+func Labels(args ...string) LabelSet {
+	if len(args)%2 != 0 {
+		panic("uneven number of arguments to rprof.Labels")
+	}
+
+	list := make([]label, 0, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		list = append(list, label{key: args[i], value: args[i+1]})
+	}
+	return LabelSet{list: normalizeLabels(list)}
+}
+
+// NumLabel returns a LabelSet containing a single numeric label with the
+// given key, number and unit, such as "bytes" or "seconds". The unit may be
+// empty. Combine it with other labels using LabelSet.Merge.
+func NumLabel(key string, num int64, unit string) LabelSet {
+	return LabelSet{list: []label{{key: key, numeric: true, num: num, unit: unit}}}
+}
+
+// Merge returns the labels of s overwritten by those of o.
+func (s LabelSet) Merge(o LabelSet) LabelSet {
+	return s.merge(o)
+}
+
+// normalizeLabels sorts the labels by key and removes all but the last label
+// of each key.
+func normalizeLabels(list []label) []label {
+	slices.SortStableFunc(list, func(a, b label) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	res := list[:0]
+	for i, l := range list {
+		if i+1 < len(list) && list[i+1].key == l.key {
+			continue
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// merge returns the labels of s overwritten by those of o.
+func (s LabelSet) merge(o LabelSet) LabelSet {
+	if len(s.list) == 0 {
+		return o
+	}
+	if len(o.list) == 0 {
+		return s
+	}
+
+	list := make([]label, 0, len(s.list)+len(o.list))
+	list = append(list, s.list...)
+	list = append(list, o.list...)
+	return LabelSet{list: normalizeLabels(list)}
+}
+
+// Kinds of encoded labels.
+const (
+	stringLabel  = 's'
+	numericLabel = 'n'
+)
+
+// encode returns the labels as a string usable in a map key. Each label is
+// encoded as its kind followed by its NUL-terminated fields.
+func (s LabelSet) encode() string {
+	var sb strings.Builder
+	for _, l := range s.list {
+		if l.numeric {
+			sb.WriteByte(numericLabel)
+			sb.WriteString(l.key)
+			sb.WriteByte(0)
+			sb.WriteString(strconv.FormatInt(l.num, 10))
+			sb.WriteByte(0)
+			sb.WriteString(l.unit)
+			sb.WriteByte(0)
+			continue
+		}
+
+		sb.WriteByte(stringLabel)
+		sb.WriteString(l.key)
+		sb.WriteByte(0)
+		sb.WriteString(l.value)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// decodeLabels calls f for each label of a string produced by encode.
+func decodeLabels(s string, f func(l label)) {
+	for s != "" {
+		var l label
+		kind := s[0]
+		l.key, s, _ = strings.Cut(s[1:], "\x00")
+		l.value, s, _ = strings.Cut(s, "\x00")
+		if kind == numericLabel {
+			l.numeric = true
+			l.num, _ = strconv.ParseInt(l.value, 10, 64)
+			l.value = ""
+			l.unit, s, _ = strings.Cut(s, "\x00")
+		}
+		f(l)
+	}
+}
+
+type labelContextKey struct{}
+
+// labelsFromContext returns the labels of ctx.
+func labelsFromContext(ctx context.Context) LabelSet {
+	labels, _ := ctx.Value(labelContextKey{}).(LabelSet)
+	return labels
+}
+
+// ContextWithLabels returns a new context with the given labels added to the
+// labels of ctx. A label overwrites a prior label with the same key.
+func ContextWithLabels(ctx context.Context, labels LabelSet) context.Context {
+	return context.WithValue(ctx, labelContextKey{}, labelsFromContext(ctx).merge(labels))
+}
+
+// Do calls f with a copy of ctx with the given labels added. Readers wrapped
+// with context-aware constructors such as ReaderContext using that context,
+// or one derived from it, attach the labels to their samples.
+func Do(ctx context.Context, labels LabelSet, f func(context.Context)) {
+	f(ContextWithLabels(ctx, labels))
+}
+
+// Label returns the value of the label with the given key on ctx, and a
+// boolean indicating whether that label exists.
+func Label(ctx context.Context, key string) (string, bool) {
+	for _, l := range labelsFromContext(ctx).list {
+		if l.key == key {
+			return l.stringValue(), true
+		}
+	}
+	return "", false
+}
+
+// ForLabels invokes f with each label set on ctx. If f returns false,
+// iteration stops.
+func ForLabels(ctx context.Context, f func(key, value string) bool) {
+	for _, l := range labelsFromContext(ctx).list {
+		if !f(l.key, l.stringValue()) {
+			return
+		}
+	}
+}
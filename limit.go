@@ -0,0 +1,145 @@
+package rprof
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDegradation is the highest degradation level of an overhead limiter, at
+// which one in 4^(maxDegradation-1) reads is recorded.
+const maxDegradation = 8
+
+// maxDegradationEvents is the number of degradation events an overhead
+// limiter keeps.
+const maxDegradationEvents = 64
+
+// WithOverheadLimit limits the time spent recording reads to the given
+// fraction of the CPU time available to the process, for example 0.01 for
+// 1%. Every second in which the limit was exceeded the profiler degrades one
+// level further: first it stops walking stacks, as in stackless mode, then it
+// samples one in 4, 16, 64 and so on reads, scaling their values. Once the
+// overhead falls below a quarter of the limit it recovers one level per
+// second. Changes of the level are recorded as comments in the profiles of
+// the windows they occur in. A limit of 0 or less disables the limiter.
+func WithOverheadLimit(fraction float64) Option {
+	return func(p *Rprof) {
+		if fraction <= 0 {
+			p.cfg.limiter = nil
+			return
+		}
+		p.cfg.limiter = &overheadLimiter{limit: fraction}
+	}
+}
+
+// overheadLimiter degrades recording when the overhead of a profiler
+// exceeds a limit. See WithOverheadLimit.
+type overheadLimiter struct {
+	limit float64
+
+	// second is the current second since the epoch and nanos the record
+	// time of the profiler at its start.
+	second atomic.Int64
+	nanos  atomic.Int64
+	// level is the degradation level, 0 while recording normally.
+	level atomic.Int32
+
+	mu     sync.Mutex
+	events []degradationEvent
+}
+
+// degradationEvent is a change of the degradation level.
+type degradationEvent struct {
+	time     time.Time
+	overhead float64
+	level    int32
+}
+
+// tick checks the overhead of the last second, given the counters of the
+// profiler, once the second at now started, and adjusts the level.
+func (l *overheadLimiter) tick(now time.Time, c *overheadCounters) {
+	sec := now.Unix()
+	cur := l.second.Load()
+	if cur == sec || !l.second.CompareAndSwap(cur, sec) {
+		return
+	}
+
+	nanos := c.recordNanos.Load()
+	used := nanos - l.nanos.Swap(nanos)
+	if cur != sec-1 {
+		// The first record or the first after an idle second.
+		return
+	}
+
+	overhead := float64(used) / float64(time.Second) / float64(runtime.GOMAXPROCS(0))
+	level := l.level.Load()
+	switch {
+	case overhead > l.limit && level < maxDegradation:
+		level++
+	case overhead < l.limit/4 && level > 0:
+		level--
+	default:
+		return
+	}
+	l.level.Store(level)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == maxDegradationEvents {
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+	l.events = append(l.events, degradationEvent{time: now, overhead: overhead, level: level})
+}
+
+// stackless reports whether reads are recorded without their stacks. It is
+// false for a nil limiter.
+func (l *overheadLimiter) stackless() bool {
+	return l != nil && l.level.Load() >= 1
+}
+
+// rate returns the sample rate reads are recorded with, 1 for a nil limiter.
+func (l *overheadLimiter) rate() int {
+	if l == nil {
+		return 1
+	}
+	return levelRate(l.level.Load())
+}
+
+// levelRate returns the sample rate of a degradation level.
+func levelRate(level int32) int {
+	if level < 2 {
+		return 1
+	}
+	return 1 << (2 * (level - 1))
+}
+
+// addDegradationEvents adds a comment per change of the degradation level
+// within the window of the profile.
+func (b *profileBuilder) addDegradationEvents(l *overheadLimiter, timestampNanos, durationNanos int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.events {
+		if t := e.time.UnixNano(); t < timestampNanos || t > timestampNanos+durationNanos {
+			continue
+		}
+		var mode string
+		switch e.level {
+		case 0:
+			mode = "recovered to recording all stacks"
+		case 1:
+			mode = "stopped walking stacks"
+		default:
+			mode = fmt.Sprintf("stopped walking stacks and sampled one in %d reads", levelRate(e.level))
+		}
+		b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+			"rprof: %s at %s with an overhead of %.2f%% against a limit of %.2f%%",
+			mode, e.time.Format(time.RFC3339), e.overhead*100, l.limit*100,
+		)))
+	}
+}
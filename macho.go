@@ -0,0 +1,82 @@
+package rprof
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	errBadMachO = errors.New("malformed Mach-O binary")
+	errNoUUID   = errors.New("no LC_UUID found in Mach-O binary")
+)
+
+// machoBuildIDs caches the build IDs of the files mapped into the process by
+// path, as every build of a profile reads the mappings again. Files without
+// a build ID are cached as "".
+var machoBuildIDs sync.Map
+
+// cachedMachOBuildID returns the build ID of the named Mach-O binary, or ""
+// if it has none. Libraries in the dyld shared cache, such as the system
+// libraries, have no file of their own and so no build ID.
+func cachedMachOBuildID(file string) string {
+	if file == "" {
+		return ""
+	}
+	if id, ok := machoBuildIDs.Load(file); ok {
+		return id.(string)
+	}
+	id, _ := machoBuildID(file)
+	machoBuildIDs.Store(file, id)
+	return id
+}
+
+// machoBuildID returns the UUID of the named Mach-O binary, which pprof uses
+// as its build ID, without introducing a dependency on debug/macho. Universal
+// binaries are not supported.
+func machoBuildID(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 32)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return "", err
+	}
+
+	// All supported darwin platforms are little endian.
+	byteOrder := binary.LittleEndian
+	var off int64
+	switch byteOrder.Uint32(buf) {
+	default:
+		return "", errBadMachO
+	case 0xfeedface: // 32-bit header
+		off = 28
+	case 0xfeedfacf: // 64-bit header
+		off = 32
+	}
+
+	ncmds := int(byteOrder.Uint32(buf[16:]))
+	for i := 0; i < ncmds; i++ {
+		if _, err := f.ReadAt(buf[:24], off); err != nil {
+			return "", err
+		}
+		cmd := byteOrder.Uint32(buf[0:])
+		size := int64(byteOrder.Uint32(buf[4:]))
+		if size < 8 {
+			return "", errBadMachO
+		}
+		if cmd == 0x1b { // LC_UUID
+			if size < 24 {
+				return "", errBadMachO
+			}
+			return fmt.Sprintf("%x", buf[8:24]), nil
+		}
+		off += size
+	}
+	return "", errNoUUID
+}
@@ -0,0 +1,575 @@
+package rprof
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures a profiler created with NewProfiler.
+type Option func(*Rprof)
+
+// config is the configuration of a profiler. It is set by options when the
+// profiler is created and is immutable afterwards.
+type config struct {
+	maxStackDepth int
+	sizeBuckets   sizeBuckets
+	sampleRate    int
+	byteRate      int
+	goroutines    bool
+	maxSamples    int
+	trimRuntime   bool
+	filter        func(size int, stack []uintptr) bool
+	timeBucket    time.Duration
+	leafOnly      bool
+	shards        int
+	localBuffers  bool
+	failedReads   FailedReadPolicy
+	leakDetection bool
+	canonical     bool
+	symbolize     bool
+	// callerLabels is the number of leaf frames attached as labels. See
+	// WithCallerLabels.
+	callerLabels int
+	// noTraceLabels omits the trace_id and span_id labels. See
+	// WithoutTraceLabels.
+	noTraceLabels bool
+	// hook is called with recorded events. See WithSampleHook.
+	hook *sampleHook
+	// transformers post-process built profiles. See WithTransformers.
+	transformers []Transformer
+	// valueTypes are the additional sample types, which grow as adapters
+	// are used. See WithValueTypes.
+	valueTypes *valueTypeSet
+	// sizeFrames shows size buckets as frames rather than labels. See
+	// WithSizeFrames.
+	sizeFrames bool
+	// adaptive adjusts the sample rate to the frequency of reads, nil
+	// unless adaptive sampling is enabled. See WithAdaptiveSampling.
+	adaptive *adaptiveSampler
+	// limiter degrades recording when the overhead exceeds a limit, nil
+	// unless a limit is set. See WithOverheadLimit.
+	limiter *overheadLimiter
+	// alignWindows aligns the windows of continuous mode to multiples of
+	// their interval. See WithAlignedWindows.
+	alignWindows bool
+}
+
+// stackDepth returns the configured maximum stack depth, 128 by default.
+func (c *config) stackDepth() int {
+	if c.leafOnly {
+		return 1
+	}
+	if c.maxStackDepth <= 0 {
+		return defaultMaxStackDepth
+	}
+	return c.maxStackDepth
+}
+
+// buckets returns the configured size buckets.
+func (c *config) buckets() sizeBuckets {
+	if c.sizeBuckets == nil {
+		return powerOfTwoBuckets{}
+	}
+	return c.sizeBuckets
+}
+
+// WithMaxStackDepth sets the maximum number of frames recorded per sample.
+// Deeper stacks are truncated and end in a synthetic "[truncated]" frame, and
+// the profile carries a comment with the number of affected reads. Each
+// distinct stack holds depth*8 bytes at most, so a lower depth saves memory
+// while a higher depth avoids truncating deeply recursive callers. Defaults
+// to 128.
+func WithMaxStackDepth(depth int) Option {
+	return func(p *Rprof) {
+		p.cfg.maxStackDepth = depth
+	}
+}
+
+// WithMaxSamples caps the number of distinct samples held by the profiler,
+// bounding its memory on workloads with high-cardinality stacks or labels.
+// Once the cap is reached, reads that would add a new sample are aggregated
+// into a single sample with a synthetic "[dropped]" frame instead, and the
+// profile carries a comment with the number of dropped reads. A max of 0 or
+// less disables the cap.
+func WithMaxSamples(max int) Option {
+	return func(p *Rprof) {
+		p.cfg.maxSamples = max
+	}
+}
+
+// WithoutRuntimeFrames omits the frames of the runtime package at the root of
+// stacks, such as runtime.main and runtime.goexit, which are the same for all
+// samples and only add noise to flame graphs. Frames of rprof itself are
+// always omitted, regardless of how many wrappers a read passes through.
+func WithoutRuntimeFrames() Option {
+	return func(p *Rprof) {
+		p.cfg.trimRuntime = true
+	}
+}
+
+// WithRecordFilter only records reads for which fn returns true, so known
+// noisy paths such as health checks or metrics scrapes can be excluded at
+// record time rather than paying for their samples and filtering them later.
+// fn is given the size of the read, or -1 for records that aren't reads such
+// as abandoned streams, and the stack that would be recorded, leaf first.
+// The stack is only valid during the call, and nil in stackless mode. fn is
+// called while holding the profiler's lock, so it must be fast and must not
+// use the profiler.
+func WithRecordFilter(fn func(size int, stack []uintptr) bool) Option {
+	return func(p *Rprof) {
+		p.cfg.filter = fn
+	}
+}
+
+// WithTimeBuckets aggregates samples separately per time bucket of the given
+// width within a window, and attaches a numeric "time" label with the start
+// of the bucket in Unix nanoseconds to every sample. Spikes within a long
+// window then remain visible rather than being averaged away, for example by
+// focusing on a single bucket or comparing buckets. Buckets are aligned to
+// multiples of d since the zero time. The number of samples grows with the
+// number of buckets per window. A width of 0 or less disables time buckets.
+func WithTimeBuckets(d time.Duration) Option {
+	return func(p *Rprof) {
+		p.cfg.timeBucket = d
+	}
+}
+
+// WithLeafOnly aggregates samples by the immediate caller of Read only rather
+// than by the full stack, for services that only need to know which functions
+// read the most. It cuts the memory held per sample and the cost of walking
+// stacks by orders of magnitude. It overrides WithMaxStackDepth, and stacks
+// are not marked as truncated.
+func WithLeafOnly() Option {
+	return func(p *Rprof) {
+		p.cfg.leafOnly = true
+	}
+}
+
+// WithShards sets the number of shards the samples are spread across by the
+// hash of their stack. Each shard has its own lock, so readers reading from
+// different stacks in parallel don't contend. Defaults to GOMAXPROCS at the
+// time the profiler is created, and is capped at 256.
+func WithShards(n int) Option {
+	return func(p *Rprof) {
+		p.cfg.shards = n
+	}
+}
+
+// WithLocalBuffers records samples in buffers local to the recording
+// goroutine's processor, pooled in a sync.Pool, rather than in the shared
+// shards, which removes the shard locks from the read path. Records still
+// take the profiler's read lock, so that the buffers can be merged, and
+// update its shared counters. The buffers are merged when the profiler is
+// stopped, rotated or a snapshot is taken, which in turn has to wait for
+// in-flight reads. It suits high-throughput proxies where even sharded locks
+// contend. The limit of WithMaxSamples is applied approximately, and the top
+// stacks of a BudgetError passed to the callback of WithReadBudget only cover
+// samples merged so far.
+func WithLocalBuffers() Option {
+	return func(p *Rprof) {
+		p.cfg.localBuffers = true
+	}
+}
+
+// WithoutSizeBuckets aggregates samples by stack only rather than by stack and
+// the power of two size bucket of the read, and omits the "bytes" label. This
+// reduces the number of distinct samples by up to 64x, for long-running
+// collections where memory matters more than the size distribution.
+func WithoutSizeBuckets() Option {
+	return func(p *Rprof) {
+		p.cfg.sizeBuckets = noSizeBuckets{}
+	}
+}
+
+// WithSizeBuckets aggregates samples in buckets with the given inclusive upper
+// bounds in bytes instead of powers of two, for example to align buckets with
+// the block size of a storage system. The "bytes" label of a sample is the
+// upper bound of its bucket. Reads larger than the largest bound are
+// aggregated in an overflow bucket labeled with math.MaxInt64. It panics if
+// more than 255 bounds are given.
+func WithSizeBuckets(bounds ...int) Option {
+	bounds = slices.Clone(bounds)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	if len(bounds) > math.MaxUint8 {
+		panic("rprof: too many size buckets")
+	}
+
+	return func(p *Rprof) {
+		p.cfg.sizeBuckets = boundedBuckets{bounds: bounds}
+	}
+}
+
+// WithSampleRate records only one in rate reads, chosen at random, and scales
+// the values of the recorded reads by rate, so the profile estimates the
+// totals of all reads. This bounds the cost of walking stacks for readers that
+// perform millions of reads per second. Read size histograms and throughput
+// thresholds still observe every read. A rate of 1 or less records every read.
+func WithSampleRate(rate int) Option {
+	return func(p *Rprof) {
+		p.cfg.sampleRate = rate
+	}
+}
+
+// WithByteSampleRate records reads such that on average one read is recorded
+// per rate bytes read, similar to runtime.MemProfileRate. A read of n bytes
+// is recorded with probability 1-exp(-n/rate) and its values are scaled by the
+// inverse of that probability, which gives statistically sound estimates of
+// the bytes read per stack at a bounded cost regardless of how frequently
+// Read is called. Empty reads are never recorded. It takes precedence over
+// WithSampleRate. A rate of 0 or less disables byte sampling.
+func WithByteSampleRate(rate int) Option {
+	return func(p *Rprof) {
+		p.cfg.byteRate = rate
+	}
+}
+
+// FailedReadPolicy is how reads that return no bytes and an error other than
+// io.EOF are recorded. See WithFailedReads.
+type FailedReadPolicy int
+
+const (
+	// RecordFailedReads records failed reads like any other read, in the
+	// size bucket of 0 bytes, and counts them in the "errors" sample type.
+	// This is the default.
+	RecordFailedReads FailedReadPolicy = iota
+	// SkipFailedReads doesn't record failed reads at all.
+	SkipFailedReads
+	// CountFailedReads only counts failed reads in the "errors" sample type,
+	// without a size bucket, so they don't add to the reads of count-based
+	// views.
+	CountFailedReads
+)
+
+// WithFailedReads sets how reads that return no bytes and an error other than
+// io.EOF are recorded, RecordFailedReads by default. On paths that retry
+// heavily failed reads can otherwise dominate the views by number of reads.
+// Reads that return bytes along with an error are always recorded.
+func WithFailedReads(policy FailedReadPolicy) Option {
+	return func(p *Rprof) {
+		p.cfg.failedReads = policy
+	}
+}
+
+// WithoutTraceLabels omits the trace_id and span_id labels that are otherwise
+// attached to the samples of context-aware readers whose context has a
+// recording OpenTelemetry span. Every span produces distinct samples, so on
+// services tracing many requests this bounds the number of samples.
+func WithoutTraceLabels() Option {
+	return func(p *Rprof) {
+		p.cfg.noTraceLabels = true
+	}
+}
+
+// WithLeakDetection records readers returned by ReadCloser that are garbage
+// collected without being closed in the "leaked" sample type, at the stack
+// they were created at. Leaked response bodies are a classic source of both
+// read amplification and connection exhaustion. It walks the stack of every
+// ReadCloser created and sets a finalizer on it, whether or not the profiler
+// is started, and leaks are only detected once the garbage collector runs.
+func WithLeakDetection() Option {
+	return func(p *Rprof) {
+		p.cfg.leakDetection = true
+	}
+}
+
+// WithSymbolization embeds the functions, files and lines of all locations in
+// profiles, symbolized in-process from the running binary, so profiles stand
+// alone regardless of how the binary was built, for example with -ldflags=-s
+// -w, or whether the binary is available to the consumer. This makes
+// profiles larger and slower to build. Profiles are always symbolized on
+// wasm, which has no mappings.
+func WithSymbolization() Option {
+	return func(p *Rprof) {
+		p.cfg.symbolize = true
+	}
+}
+
+// WithCanonicalOrder builds profiles with their samples, locations and
+// strings in a canonical order rather than in the random order of map
+// iteration, so identical samples produce byte-identical profiles. This
+// enables golden tests, deduplication in storage and meaningful binary
+// diffs. Sorting the samples makes building profiles slower, and the comment
+// about the profiler's overhead, which differs between identical profiles,
+// is left out.
+func WithCanonicalOrder() Option {
+	return func(p *Rprof) {
+		p.cfg.canonical = true
+	}
+}
+
+// WithGoroutineLabels attaches a numeric "goroutine" label with the ID of the
+// reading goroutine to every sample. This tells apart the workers of a pool
+// that all read from identical stacks. Determining the ID requires formatting
+// the goroutine's stack header on every read, and the number of samples grows
+// with the number of goroutines, so it is best used for short collections.
+func WithGoroutineLabels() Option {
+	return func(p *Rprof) {
+		p.cfg.goroutines = true
+	}
+}
+
+// WithReadSizeHistogram sets the histogram that observes every read. See
+// Rprof.SetReadSizeHistogram.
+func WithReadSizeHistogram(h *ReadSizeHistogram) Option {
+	return func(p *Rprof) {
+		p.histogram.Store(h)
+	}
+}
+
+// WithThroughput sets the throughput that observes every read. See
+// Rprof.SetThroughput.
+func WithThroughput(t *Throughput) Option {
+	return func(p *Rprof) {
+		p.throughput.Store(t)
+	}
+}
+
+// WithReadBudget limits the number of bytes that may be read within a single
+// Start/Stop window. See Rprof.SetReadBudget.
+func WithReadBudget(limit int64, onExceed func(*BudgetError)) Option {
+	return func(p *Rprof) {
+		p.budget.limit = limit
+		p.budget.onExceed = onExceed
+	}
+}
+
+// WithStackless starts the profiler in stackless mode. See
+// Rprof.SetStackless.
+func WithStackless() Option {
+	return func(p *Rprof) {
+		p.stackless.Store(true)
+	}
+}
+
+// WithSpanEventThresholds sets the thresholds above which reads add events to
+// the span of context-aware readers. See Rprof.SetSpanEventThresholds.
+func WithSpanEventThresholds(t SpanEventThresholds) Option {
+	return func(p *Rprof) {
+		p.spans.thresholds.Store(&t)
+	}
+}
+
+// WrapOption configures a single profiled reader.
+type WrapOption func(*wrapConfig)
+
+// wrapConfig is the configuration of a profiled reader.
+type wrapConfig struct {
+	skipFrames int
+	name       string
+	labels     LabelSet
+	// labelKey is the encoded labels, part of the key of every sample of
+	// the reader.
+	labelKey string
+	// traceKey is the encoded labels with the trace_id and span_id labels
+	// of span, which replaces labelKey unless trace labels are disabled. It
+	// is empty if there is no span. See WithoutTraceLabels.
+	traceKey string
+	// nameKey is the encoded name label, which replaces labelKey in
+	// stackless mode. See SetStackless.
+	nameKey string
+	// span is the span reads are associated with, nil if the reader was not
+	// created with a context or the context had no recording span.
+	span trace.Span
+	// also are the profilers reads are recorded in besides the profiler of
+	// the reader. See WithProfilers.
+	also []*Rprof
+	// stackCache caches the stack of the reader's records, nil if stack
+	// caching is disabled. See WithStackCache.
+	stackCache *stackCache
+	// batch accumulates the reader's reads, nil if batching is disabled. See
+	// WithBatching.
+	batch *readBatch
+	// readValues sets the values of the additional sample types of each
+	// read, nil if the reader contributes none. See WithReadValues.
+	readValues func(n int, values []int64)
+}
+
+// newWrapConfig returns the configuration resulting from the labels and span
+// of ctx and the given options.
+func newWrapConfig(ctx context.Context, opts []WrapOption) wrapConfig {
+	cfg := wrapConfig{
+		labels: labelsFromContext(ctx),
+		span:   spanFromContext(ctx),
+	}
+	if s := ScopeFromContext(ctx); s != nil {
+		cfg.also = append(cfg.also, s.p)
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.encodeLabels()
+	if cfg.name != "" {
+		cfg.nameKey = Labels(nameLabel, cfg.name).encode()
+	}
+	return cfg
+}
+
+// withContext returns the configuration for a single read performed with ctx.
+// The labels of ctx are added to those of the reader, the span of ctx, if
+// any, replaces that of the reader and the read is recorded in the scope of
+// ctx, if any, as well.
+func (cfg wrapConfig) withContext(ctx context.Context) wrapConfig {
+	if s := ScopeFromContext(ctx); s != nil && !slices.Contains(cfg.also, s.p) {
+		cfg.also = append(slices.Clip(cfg.also), s.p)
+	}
+	labels := labelsFromContext(ctx)
+	span := spanFromContext(ctx)
+	if len(labels.list) > 0 {
+		cfg.labels = cfg.labels.merge(labels)
+	}
+	if span != nil {
+		cfg.span = span
+	}
+	if len(labels.list) > 0 || span != nil {
+		cfg.encodeLabels()
+	}
+	return cfg
+}
+
+// withLabels returns the configuration with the given labels added to those
+// of the reader.
+func (cfg wrapConfig) withLabels(labels LabelSet) wrapConfig {
+	cfg.labels = cfg.labels.merge(labels)
+	cfg.encodeLabels()
+	return cfg
+}
+
+// encodeLabels encodes the labels of the configuration, with and without
+// the trace labels of its span.
+func (cfg *wrapConfig) encodeLabels() {
+	cfg.labelKey = cfg.labels.encode()
+	cfg.traceKey = ""
+	if cfg.span != nil {
+		sc := cfg.span.SpanContext()
+		cfg.traceKey = cfg.labels.merge(Labels(
+			traceIDLabel, sc.TraceID().String(),
+			spanIDLabel, sc.SpanID().String(),
+		)).encode()
+	}
+}
+
+// WithSkipFrames skips the given number of frames above the caller of Read
+// when recording stacks, after rprof's own frames. Libraries that wrap
+// profiled readers in their own helpers can use it to attribute reads to the
+// callers of their helpers rather than to the helpers themselves.
+func WithSkipFrames(n int) WrapOption {
+	return func(cfg *wrapConfig) {
+		cfg.skipFrames = n
+	}
+}
+
+// WithLabels attaches the given labels to every sample of the reader, for
+// example to tell apart reads by shard, table or storage tier. They overwrite
+// labels with the same keys of the reader's context.
+func WithLabels(labels map[string]string) WrapOption {
+	list := make([]label, 0, len(labels))
+	for k, v := range labels {
+		list = append(list, label{key: k, value: v})
+	}
+	set := LabelSet{list: normalizeLabels(list)}
+
+	return func(cfg *wrapConfig) {
+		cfg.labels = cfg.labels.merge(set)
+	}
+}
+
+// WithLabelSet attaches the given labels, which may include numeric labels
+// created with NumLabel, to every sample of the reader. They overwrite labels
+// with the same keys of the reader's context.
+func WithLabelSet(labels LabelSet) WrapOption {
+	return func(cfg *wrapConfig) {
+		cfg.labels = cfg.labels.merge(labels)
+	}
+}
+
+// streamIDs generates the IDs attached by WithStreamID.
+var streamIDs atomic.Int64
+
+// streamLabel is the label key that WithStreamID attaches the ID of a reader
+// as.
+const streamLabel = "stream"
+
+// WithStreamID attaches a numeric "stream" label with an ID unique to the
+// reader to every sample of the reader. Rather than fusing all readers of a
+// stack, this allows counting the distinct streams read by a stack and
+// computing per-stream totals downstream. The number of samples grows with
+// the number of streams, so it is best used for long-lived streams.
+func WithStreamID() WrapOption {
+	return func(cfg *wrapConfig) {
+		cfg.labels = cfg.labels.merge(NumLabel(streamLabel, streamIDs.Add(1), ""))
+	}
+}
+
+// WithProfilers records the reads of the reader in the given profilers as
+// well as in the profiler of the reader, for example to feed both an
+// on-demand profiler with a short window and an always-on continuous one.
+// Unlike wrapping a reader once per profiler, the stack of a read is walked
+// only once. Each profiler applies its own options, such as sampling and
+// stack depth, to the reads. The profiler of the reader is ignored if given.
+func WithProfilers(profilers ...*Rprof) WrapOption {
+	return func(cfg *wrapConfig) {
+		for _, p := range profilers {
+			if !slices.Contains(cfg.also, p) {
+				cfg.also = append(cfg.also, p)
+			}
+		}
+	}
+}
+
+// WithStackCache caches the stack of the reader after recording a read and
+// only walks it again every n records, which saves most of the cost of
+// walking stacks for readers that are read from a loop millions of times.
+// The trade-off is that reads from a different stack than the cached one
+// are attributed to the cached stack until it is walked again. A value of 1
+// or less disables caching.
+func WithStackCache(n int) WrapOption {
+	return func(cfg *wrapConfig) {
+		if n <= 1 {
+			cfg.stackCache = nil
+			return
+		}
+		cfg.stackCache = &stackCache{every: int64(n)}
+	}
+}
+
+// WithBatching accumulates the reads of the reader and records them at once
+// every n reads, or with the first read after interval elapsed since the
+// first accumulated read, whichever comes first. Per read, only a few
+// additions remain instead of walking the stack and updating the profiler's
+// samples. Accumulated reads are attributed to the stack of the read that
+// started the batch, and to the size bucket of their average size. Reads in a
+// different size bucket or with different labels complete the batch early,
+// while failed reads and the end of streams are always recorded on their
+// own. Batches are exact and not subject to sampling. Incomplete batches are
+// recorded when the reader is closed, and when the profiler is stopped,
+// rotated or snapshotted, so idle readers don't hold back reads. A value of n
+// of 1 or less disables batching, an interval of 0 or less only completes
+// batches by count.
+func WithBatching(n int, interval time.Duration) WrapOption {
+	return func(cfg *wrapConfig) {
+		if n <= 1 {
+			cfg.batch = nil
+			return
+		}
+		cfg.batch = &readBatch{reads: n, interval: interval}
+	}
+}
+
+// nameLabel is the label key that WithName attaches the name of a reader as.
+const nameLabel = "name"
+
+// WithName attaches a "name" label with the given value to every sample of
+// the reader. It tells apart logical streams that are read from the same
+// stack, for example the write-ahead log and the data files of a database.
+func WithName(name string) WrapOption {
+	return func(cfg *wrapConfig) {
+		cfg.name = name
+		cfg.labels = cfg.labels.merge(Labels(nameLabel, name))
+	}
+}
@@ -0,0 +1,74 @@
+package rprof
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverheadStats is the cost of a profiler to the process it profiles, so
+// operators can verify the profiler isn't becoming the problem.
+type OverheadStats struct {
+	// Records is the number of reads recorded since the profiler was
+	// created.
+	Records int64
+	// RecordTime is the time spent recording them, including walking their
+	// stacks.
+	RecordTime time.Duration
+	// StacksWalked is the number of stacks walked to record reads since the
+	// profiler was created. It is less than Records in stackless mode, with
+	// stack caching or with sampling.
+	StacksWalked int64
+	// Memory estimates the memory in bytes held by the samples of the
+	// current collection window.
+	Memory int64
+}
+
+// overheadCounters accumulates the overhead of a profiler.
+type overheadCounters struct {
+	records      atomic.Int64
+	recordNanos  atomic.Int64
+	stacksWalked atomic.Int64
+}
+
+// observe accounts for a record that started at start.
+func (c *overheadCounters) observe(start time.Time) {
+	c.records.Add(1)
+	c.recordNanos.Add(int64(time.Since(start)))
+}
+
+// stats returns the overhead accumulated so far, without the memory.
+func (c *overheadCounters) stats() OverheadStats {
+	return OverheadStats{
+		Records:      c.records.Load(),
+		RecordTime:   time.Duration(c.recordNanos.Load()),
+		StacksWalked: c.stacksWalked.Load(),
+	}
+}
+
+// Overhead returns the overhead of the default profiler. See Rprof.Overhead.
+func Overhead() OverheadStats {
+	return profiler.Overhead()
+}
+
+// Overhead returns the overhead of the profiler: the reads it recorded, the
+// time it spent doing so, the stacks it walked and the memory held by its
+// samples. Reads performed while the profiler is stopped aren't accounted
+// for as they are hardly recorded at all.
+func (p *Rprof) Overhead() OverheadStats {
+	o := p.overhead.stats()
+	o.Memory = p.memory()
+	return o
+}
+
+// addOverheadComment adds a comment with the overhead of the profiler to the
+// profile, with the memory held by the samples of the profile.
+func (b *profileBuilder) addOverheadComment(o OverheadStats) {
+	if b.cfg.canonical {
+		return
+	}
+	b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+		"rprof: overhead of %s recording %d reads and walking %d stacks since the profiler was created, %d bytes of samples",
+		o.RecordTime, o.Records, o.StacksWalked, o.Memory,
+	)))
+}
@@ -0,0 +1,117 @@
+package rprof
+
+import (
+	"cmp"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// PackageEntry is the aggregate of all reads attributed to the same Go
+// package.
+type PackageEntry struct {
+	// Package is the import path of the package.
+	Package string
+	// Reads is the number of reads.
+	Reads int64
+	// Bytes is the number of bytes read.
+	Bytes int64
+}
+
+// Packages returns the top k packages of the default profiler. See
+// Rprof.Packages.
+func Packages(k int, by Metric) []PackageEntry {
+	return profiler.Packages(k, by)
+}
+
+// Packages returns the top k packages of the samples collected so far,
+// ranked by the given metric. If the profiler is not running it returns nil.
+// See Snapshot.Packages.
+func (p *Rprof) Packages(k int, by Metric) []PackageEntry {
+	s, _ := p.takeSnapshot()
+	return s.Packages(k, by)
+}
+
+// Packages returns the top k packages in the snapshot, ranked by the given
+// metric. Each read is attributed to the package of the leaf-most frame of
+// its stack that is outside of the standard library, or to the package of
+// its leaf frame if all of its frames are in the standard library. Helpers
+// such as io.ReadAll are thus skipped in favor of the dependency, or the
+// package of the program, calling them. A negative k is treated as 0.
+func (s Snapshot) Packages(k int, by Metric) []PackageEntry {
+	byStack := map[uint32]string{}
+	entries := map[string]*PackageEntry{}
+	for key, v := range s.samples {
+		if key.stack == 0 || key.unsized {
+			continue
+		}
+
+		pkg, ok := byStack[key.stack]
+		if !ok {
+			pkg = stackPackage(s.stacks.pcs(key.stack))
+			byStack[key.stack] = pkg
+		}
+
+		e, ok := entries[pkg]
+		if !ok {
+			e = &PackageEntry{Package: pkg}
+			entries[pkg] = e
+		}
+		e.Reads += v.reads
+		e.Bytes += v.bytes
+	}
+
+	res := make([]PackageEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, *e)
+	}
+	slices.SortFunc(res, func(a, b PackageEntry) int {
+		if c := cmp.Compare(b.value(by), a.value(by)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Package, b.Package)
+	})
+
+	if k = max(k, 0); len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+// value returns the value of the entry for the given metric.
+func (e PackageEntry) value(m Metric) int64 {
+	switch m {
+	case MetricReads:
+		return e.Reads
+	default:
+		return e.Bytes
+	}
+}
+
+// stackPackage returns the package a stack is attributed to. See
+// Snapshot.Packages.
+func stackPackage(stack []uintptr) string {
+	var leaf string
+	frames := runtime.CallersFrames(stack)
+	for {
+		f, more := frames.Next()
+		pkg := funcPackage(f.Function)
+		if leaf == "" {
+			leaf = pkg
+		}
+		if pkg != "" && !isStdPackage(pkg) {
+			return pkg
+		}
+		if !more {
+			return leaf
+		}
+	}
+}
+
+// isStdPackage reports whether the package with the given import path is in
+// the standard library, whose import paths have no dot in their first
+// element.
+func isStdPackage(pkg string) bool {
+	first, _, _ := strings.Cut(pkg, "/")
+	return !strings.Contains(first, ".")
+}
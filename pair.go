@@ -0,0 +1,91 @@
+package rprof
+
+import (
+	"context"
+	"io"
+)
+
+// pairLabel is the label with the name of a pair. See Rprof.Pair.
+const pairLabel = "pair"
+
+// Pair returns a new pair of readers profiled by the default profiler. See
+// Rprof.Pair.
+func Pair(name string, upper func(lower io.Reader) io.Reader, lower io.Reader, opts ...WrapOption) *RprofPair {
+	return profiler.Pair(name, upper, lower, opts...)
+}
+
+// RprofPair is an io.Reader that reads from an upper, logical layer, such as
+// a decompressor or decoder, on top of a lower, physical layer, such as a
+// file, and profiles how many bytes each read pulled from the lower layer.
+type RprofPair struct {
+	p     *Rprof
+	upper io.Reader
+	lower *countingReader
+	cfg   wrapConfig
+	// fetched is the index of the values of the fetched sample type, -1 if
+	// they aren't recorded.
+	fetched int
+
+	// eof is true once a read returned io.EOF.
+	eof bool
+}
+
+// Pair returns a new reader that reads from the reader returned by upper,
+// which is called with lower wrapped to count the bytes read from it, for
+// example
+//
+//	p.Pair("rows", func(r io.Reader) io.Reader { return snappy.NewReader(r) }, file)
+//
+// Reads record the bytes read from the upper layer as usual, and in the
+// "fetched" sample type the bytes the upper layer read from the lower layer to
+// serve them. Per stack, fetched divided by read bytes is the read
+// amplification of the code path, which is also attached to the samples as
+// the "amplification" label in percent. The fetched sample type is added to
+// the profiles of the profiler once a pair is created. The samples are
+// labeled with the name of the pair as "pair".
+func (p *Rprof) Pair(name string, upper func(lower io.Reader) io.Reader, lower io.Reader, opts ...WrapOption) *RprofPair {
+	src := &countingReader{r: lower}
+	opts = append([]WrapOption{WithLabelSet(Labels(pairLabel, name))}, opts...)
+	return p.newPair(upper(src), src, opts)
+}
+
+// newPair returns a new pair reading from upper on top of lower.
+func (p *Rprof) newPair(upper io.Reader, lower *countingReader, opts []WrapOption) *RprofPair {
+	r := &RprofPair{
+		p:     p,
+		upper: upper,
+		lower: lower,
+		cfg:   newWrapConfig(context.Background(), opts),
+	}
+	r.fetched = p.registerValueType(fetchedType, &r.cfg)
+	return r
+}
+
+// Read reads from the upper layer and records the sample along with the
+// bytes read from the lower layer in the profiler.
+// Implements io.Reader.
+func (r *RprofPair) Read(buf []byte) (int, error) {
+	before := r.lower.n
+	ev := r.p.read(r.upper, buf, &r.cfg, &r.eof)
+	setValue(&ev, r.fetched, r.lower.n-before)
+	r.p.recordSample(ev, &r.cfg)
+	return ev.n, ev.err
+}
+
+// fetchedType is the sample type of the bytes a buffer or upper layer
+// fetched from its source, with the read amplification as label.
+var fetchedType = valueType{
+	ValueType: ValueType{Type: "fetched", Unit: "bytes"},
+	label:     "amplification",
+	unit:      "percent",
+	derive:    amplification,
+}
+
+// amplification returns the bytes fetched per byte read of a sample in
+// percent. It reports false if the sample fetched nothing or read nothing.
+func amplification(fetched, bytes int64) (int64, bool) {
+	if fetched <= 0 || bytes <= 0 {
+		return 0, false
+	}
+	return fetched * 100 / bytes, true
+}
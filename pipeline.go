@@ -0,0 +1,56 @@
+package rprof
+
+import (
+	"fmt"
+	"io"
+)
+
+// Label keys of the readers of a pipeline. See Rprof.Pipeline.
+const (
+	pipelineLabel = "pipeline"
+	layerLabel    = "layer"
+)
+
+// sourceLayer is the layer label of the source of a pipeline.
+const sourceLayer = "source"
+
+// Stage is a layer of a reader pipeline, such as a decompressor or decoder.
+type Stage struct {
+	// Name is the name of the layer, attached to its samples as "layer".
+	Name string
+	// New returns the reader of the layer reading from the layer below.
+	New func(r io.Reader) (io.Reader, error)
+}
+
+// Pipeline returns a new reader pipeline profiled by the default profiler.
+// See Rprof.Pipeline.
+func Pipeline(name string, src io.Reader, stages []Stage, opts ...WrapOption) (io.Reader, error) {
+	return profiler.Pipeline(name, src, stages, opts...)
+}
+
+// Pipeline builds a pipeline of readers, such as source → decompress →
+// decode, by stacking the given stages on top of src in order, and profiles
+// the reads of every layer. It returns the reader of the last stage.
+//
+// The samples of all layers are labeled with the name of the pipeline as
+// "pipeline" and with the name of their layer as "layer", "source" for src.
+// Like Pair, the reads of each stage record in the "fetched" sample type the
+// bytes the stage read from the layer below to serve them, so the
+// contribution of each stage is visible in a single profile. The options
+// apply to every layer.
+func (p *Rprof) Pipeline(name string, src io.Reader, stages []Stage, opts ...WrapOption) (io.Reader, error) {
+	layerOpts := func(layer string) []WrapOption {
+		return append([]WrapOption{WithLabelSet(Labels(pipelineLabel, name, layerLabel, layer))}, opts...)
+	}
+
+	r := p.Reader(src, layerOpts(sourceLayer)...)
+	for _, s := range stages {
+		lower := &countingReader{r: r}
+		upper, err := s.New(lower)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: layer %s: %w", name, s.Name, err)
+		}
+		r = p.newPair(upper, lower, layerOpts(s.Name))
+	}
+	return r, nil
+}
@@ -45,6 +45,7 @@ func parseProcSelfMaps(data []byte, addMapping func(lo, hi, offset uint64, file,
 		return f
 	}
 
+	var mappings []procMapping
 	for len(data) > 0 {
 		line, data, _ = bytes.Cut(data, newline)
 		addr := next()
@@ -71,9 +72,6 @@ func parseProcSelfMaps(data []byte, addMapping func(lo, hi, offset uint64, file,
 		}
 		next()          // dev
 		inode := next() // inode
-		if line == nil {
-			continue
-		}
 		file := string(line)
 
 		// Trim deleted file marker.
@@ -83,12 +81,27 @@ func parseProcSelfMaps(data []byte, addMapping func(lo, hi, offset uint64, file,
 			file = file[:len(file)-deletedLen]
 		}
 
-		if len(inode) == 1 && inode[0] == '0' && file == "" {
+		mappings = append(mappings, procMapping{
+			lo:     lo,
+			hi:     hi,
+			offset: offset,
+			file:   file,
+			anon:   len(inode) == 1 && inode[0] == '0' && file == "",
+		})
+	}
+
+	for i, m := range mappings {
+		if m.anon {
 			// Huge-page text mappings list the initial fragment of
-			// mapped but unpopulated memory as being inode 0.
-			// Don't report that part.
-			// But [vdso] and [vsyscall] are inode 0, so let non-empty file names through.
-			continue
+			// mapped but unpopulated memory as being inode 0 without a
+			// file, right next to the file's mapping. Don't report
+			// that part. Other anonymous executable mappings, such as
+			// JIT-compiled code, are reported as such.
+			if i > 0 && !mappings[i-1].anon && mappings[i-1].hi == m.lo ||
+				i+1 < len(mappings) && !mappings[i+1].anon && mappings[i+1].lo == m.hi {
+				continue
+			}
+			m.file = anonMapping
 		}
 
 		// TODO: pprof's remapMappingIDs makes one adjustment:
@@ -99,7 +112,27 @@ func parseProcSelfMaps(data []byte, addMapping func(lo, hi, offset uint64, file,
 		// If we do need it, it would go here, before we
 		// enter the mappings into b.mem in the first place.
 
-		buildID, _ := elfBuildID(file)
-		addMapping(lo, hi, offset, file, buildID)
+		addMapping(m.lo, m.hi, m.offset, m.file, mappingBuildID(m.file))
+	}
+}
+
+// anonMapping is the file name of executable mappings not backed by a file.
+const anonMapping = "[anon]"
+
+// procMapping is an executable mapping listed in /proc/self/maps.
+type procMapping struct {
+	lo, hi, offset uint64
+	file           string
+	// anon is true for mappings not backed by a file.
+	anon bool
+}
+
+// mappingBuildID returns the build ID of the file of a mapping. Pseudo-files
+// such as [vdso], [vsyscall] and [anon] have none, and aren't looked up so a
+// file of the same name in the working directory isn't mistaken for them.
+func mappingBuildID(file string) string {
+	if file == "" || strings.HasPrefix(file, "[") {
+		return ""
 	}
+	return cachedELFBuildID(file)
 }
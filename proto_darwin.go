@@ -10,10 +10,13 @@ import (
 
 // readMapping adds a mapping entry for the text region of the running process.
 // It uses the mach_vm_region region system call to add mapping entries for the
-// text region of the running process. Note that currently no attempt is
-// made to obtain the buildID information.
+// executable regions of the running process, with the UUIDs of their files as
+// build IDs.
 func (b *profileBuilder) readMapping() {
-	if !machVMInfo(b.addMapping) {
+	ok := machVMInfo(func(lo, hi, offset uint64, file, _ string) {
+		b.addMapping(lo, hi, offset, file, cachedMachOBuildID(file))
+	})
+	if !ok {
 		b.addMappingEntry(0, 0, 0, "", "", true)
 	}
 }
@@ -23,7 +26,7 @@ func readMainModuleMapping() (start, end uint64, exe, buildID string, err error)
 	ok := machVMInfo(func(lo, hi, off uint64, file, build string) {
 		if first {
 			start, end = lo, hi
-			exe, buildID = file, build
+			exe, buildID = file, cachedMachOBuildID(file)
 		}
 		// May see multiple text segments if rosetta is used for running
 		// the go toolchain itself.
@@ -0,0 +1,19 @@
+//go:build js || wasip1
+
+package rprof
+
+import (
+	"errors"
+)
+
+// readMapping adds the fake mapping, since wasm has no memory mappings, and
+// has the profile symbolized in-process, since consumers have no binary to
+// symbolize its addresses from.
+func (b *profileBuilder) readMapping() {
+	b.addMappingEntry(0, 0, 0, "", "", true)
+	b.symbolize = true
+}
+
+func readMainModuleMapping() (start, end uint64, exe, buildID string, err error) {
+	return 0, 0, "", "", errors.New("not implemented")
+}
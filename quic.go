@@ -0,0 +1,52 @@
+package rprof
+
+import (
+	"context"
+	"io"
+)
+
+// streamTypeLabel is the label with the type of a QUIC stream. See
+// Rprof.QUICStream.
+const streamTypeLabel = "quic.stream"
+
+// QUICStream returns a new reader of a QUIC stream profiled by the default
+// profiler. See Rprof.QUICStream.
+func QUICStream(s io.Reader, id int64, opts ...WrapOption) io.Reader {
+	return profiler.QUICStream(s, id, opts...)
+}
+
+// QUICStream returns a new reader that profiles the reads of s, the receiving
+// side of the QUIC stream with the given ID, such as a quic.Stream or
+// quic.ReceiveStream of github.com/quic-go/quic-go:
+//
+//	r := p.QUICStream(stream, int64(stream.StreamID()))
+//
+// The samples are labeled with the type of the stream, which its ID encodes,
+// as "quic.stream": "client-bidi", "server-bidi", "client-uni" or
+// "server-uni". This gives HTTP/3 and custom QUIC protocol servers read
+// attribution comparable to Conn. Use WithStreamID to tell apart individual
+// streams. Methods of the stream other than Read, such as CancelRead, must be
+// called on s. Sending streams write only and need no profiling.
+func (p *Rprof) QUICStream(s io.Reader, id int64, opts ...WrapOption) io.Reader {
+	opts = append([]WrapOption{WithLabelSet(Labels(streamTypeLabel, quicStreamType(id)))}, opts...)
+	return &RprofReader{
+		p:   p,
+		r:   s,
+		cfg: newWrapConfig(context.Background(), opts),
+	}
+}
+
+// quicStreamType returns the type of the QUIC stream with the given ID, whose
+// least significant bit is the initiator and second least significant bit
+// the directionality of the stream as defined by RFC 9000.
+func quicStreamType(id int64) string {
+	initiator := "client"
+	if id&1 != 0 {
+		initiator = "server"
+	}
+	direction := "bidi"
+	if id&2 != 0 {
+		direction = "uni"
+	}
+	return initiator + "-" + direction
+}
@@ -0,0 +1,234 @@
+package rprof
+
+import (
+	"context"
+	"io"
+	"runtime"
+)
+
+// RprofReader is an io.Reader that will profile the reads if the profiler is on.
+type RprofReader struct {
+	p   *Rprof
+	r   io.Reader
+	cfg wrapConfig
+
+	// eof is true once a read returned io.EOF.
+	eof bool
+}
+
+// Reader returns a new io.Reader that will be profiled if the profiler is on.
+func (p *Rprof) Reader(r io.Reader, opts ...WrapOption) io.Reader {
+	return &RprofReader{
+		p:   p,
+		r:   r,
+		cfg: newWrapConfig(context.Background(), opts),
+	}
+}
+
+// ReaderContext returns a new io.Reader that will be profiled if the profiler
+// is on. The labels of ctx, see Do, are attached to its samples and reads are
+// associated with the span in ctx, see SetSpanEventThresholds.
+func (p *Rprof) ReaderContext(ctx context.Context, r io.Reader, opts ...WrapOption) io.Reader {
+	return &RprofReader{
+		p:   p,
+		r:   r,
+		cfg: newWrapConfig(ctx, opts),
+	}
+}
+
+// Read reads from the underlying reader and records the sample in the profiler.
+// Implements io.Reader.
+func (r *RprofReader) Read(buf []byte) (int, error) {
+	ev := r.p.read(r.r, buf, &r.cfg, &r.eof)
+	r.p.recordSample(ev, &r.cfg)
+	return ev.n, ev.err
+}
+
+// WriteTo writes the data of the underlying reader to w. If the underlying
+// reader implements io.WriterTo its fast path is used and the transfer is
+// recorded as a single read with a "fastpath" label, otherwise the data is
+// copied through Read. This keeps io.Copy from losing the fast path.
+// Implements io.WriterTo.
+func (r *RprofReader) WriteTo(w io.Writer) (int64, error) {
+	return r.p.writeTo(w, r.r, readerOnly{r}, &r.cfg, &r.eof)
+}
+
+// ReadContext is like Read, but additionally attributes the read to the labels
+// and span of ctx. This is useful for long-lived readers that are used on
+// behalf of different requests.
+func (r *RprofReader) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	cfg := r.cfg.withContext(ctx)
+	ev := r.p.read(r.r, buf, &cfg, &r.eof)
+	r.p.recordSample(ev, &cfg)
+	return ev.n, ev.err
+}
+
+// RprofReadCloser is an io.ReadCloser that will profile the reads if the profiler is on.
+type RprofReadCloser struct {
+	p   *Rprof
+	r   io.ReadCloser
+	cfg wrapConfig
+
+	// eof is true once a read returned io.EOF.
+	eof bool
+	// closed is true once Close was called.
+	closed bool
+	// created is the stack the reader was created at if leak detection is
+	// enabled. See WithLeakDetection.
+	created []uintptr
+}
+
+// ReadCloser returns a new io.ReadCloser that will be profiled if the profiler is on.
+func (p *Rprof) ReadCloser(r io.ReadCloser, opts ...WrapOption) io.ReadCloser {
+	return p.newReadCloser(r, newWrapConfig(context.Background(), opts))
+}
+
+// ReadCloserContext returns a new io.ReadCloser that will be profiled if the
+// profiler is on. The labels of ctx are attached to its samples and reads are
+// associated with the span in ctx.
+func (p *Rprof) ReadCloserContext(ctx context.Context, r io.ReadCloser, opts ...WrapOption) io.ReadCloser {
+	return p.newReadCloser(r, newWrapConfig(ctx, opts))
+}
+
+// newReadCloser returns a new RprofReadCloser. If leak detection is enabled
+// it records the stack of its caller's caller and sets a finalizer that
+// records the reader as leaked if it is garbage collected without being
+// closed.
+func (p *Rprof) newReadCloser(r io.ReadCloser, cfg wrapConfig) *RprofReadCloser {
+	rc := &RprofReadCloser{
+		p:   p,
+		r:   r,
+		cfg: cfg,
+	}
+	if p.cfg.leakDetection {
+		buf := make([]uintptr, p.cfg.stackDepth()+stackSlack)
+		// Skip runtime.Callers and newReadCloser, the constructors are
+		// trimmed with rprof's other frames.
+		pcs := buf[:runtime.Callers(2, buf)]
+		rc.created = pcs[min(internalFrames(pcs)+cfg.skipFrames, len(pcs)):]
+		runtime.SetFinalizer(rc, (*RprofReadCloser).finalize)
+	}
+	return rc
+}
+
+// finalize records the reader as leaked if it wasn't closed.
+func (r *RprofReadCloser) finalize() {
+	if !r.closed {
+		r.p.recordLeaked(&r.cfg, r.created)
+	}
+}
+
+// Read reads from the underlying reader and records the sample in the profiler.
+// Implements io.Reader.
+func (r *RprofReadCloser) Read(buf []byte) (int, error) {
+	ev := r.p.read(r.r, buf, &r.cfg, &r.eof)
+	r.p.recordSample(ev, &r.cfg)
+	return ev.n, ev.err
+}
+
+// WriteTo writes the data of the underlying reader to w, using its fast path
+// if it has one. See RprofReader.WriteTo.
+// Implements io.WriterTo.
+func (r *RprofReadCloser) WriteTo(w io.Writer) (int64, error) {
+	return r.p.writeTo(w, r.r, readerOnly{r}, &r.cfg, &r.eof)
+}
+
+// ReadContext is like Read, but additionally attributes the read to the labels
+// and span of ctx.
+func (r *RprofReadCloser) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	cfg := r.cfg.withContext(ctx)
+	ev := r.p.read(r.r, buf, &cfg, &r.eof)
+	r.p.recordSample(ev, &cfg)
+	return ev.n, ev.err
+}
+
+// Close closes the underlying reader. The first call is recorded in the
+// "closes" sample type and, if the reader was not read to io.EOF, the stream
+// is recorded as abandoned.
+// Implements io.Closer.
+func (r *RprofReadCloser) Close() error {
+	if !r.closed {
+		r.p.flushBatch(&r.cfg)
+		r.p.recordClose(&r.cfg, !r.eof)
+		if r.created != nil {
+			runtime.SetFinalizer(r, nil)
+		}
+	}
+	r.closed = true
+	return r.r.Close()
+}
+
+// RprofReaderAt is an io.ReaderAt that will profile the reads if the profiler is on.
+type RprofReaderAt struct {
+	p   *Rprof
+	r   io.ReaderAt
+	cfg wrapConfig
+}
+
+// ReaderAt returns a new io.ReaderAt that will be profiled if the profiler is on.
+func (p *Rprof) ReaderAt(r io.ReaderAt, opts ...WrapOption) io.ReaderAt {
+	return &RprofReaderAt{
+		p:   p,
+		r:   r,
+		cfg: newWrapConfig(context.Background(), opts),
+	}
+}
+
+// ReaderAtContext returns a new io.ReaderAt that will be profiled if the
+// profiler is on. The labels of ctx are attached to its samples and reads are
+// associated with the span in ctx.
+func (p *Rprof) ReaderAtContext(ctx context.Context, r io.ReaderAt, opts ...WrapOption) io.ReaderAt {
+	return &RprofReaderAt{
+		p:   p,
+		r:   r,
+		cfg: newWrapConfig(ctx, opts),
+	}
+}
+
+// ReadAt reads from the underlying reader and records the sample in the profiler.
+func (r *RprofReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	ev := r.p.readAt(r.r, buf, off, &r.cfg)
+	r.p.recordSample(ev, &r.cfg)
+	return ev.n, ev.err
+}
+
+// ReadAtContext is like ReadAt, but additionally attributes the read to the
+// labels and span of ctx.
+func (r *RprofReaderAt) ReadAtContext(ctx context.Context, buf []byte, off int64) (int, error) {
+	cfg := r.cfg.withContext(ctx)
+	ev := r.p.readAt(r.r, buf, off, &cfg)
+	r.p.recordSample(ev, &cfg)
+	return ev.n, ev.err
+}
+
+// fastPathLabels marks the samples of transfers that used the fast path of
+// the underlying reader.
+var fastPathLabels = Labels("fastpath", "WriteTo")
+
+// readerOnly hides all methods of a reader but Read, so io.Copy doesn't call
+// WriteTo on it again.
+type readerOnly struct {
+	io.Reader
+}
+
+// writeTo implements io.WriterTo for the wrapper of src with the given
+// configuration. If src implements io.WriterTo the transfer is recorded as a
+// single read, so its bytes are counted exactly once, otherwise the data is
+// copied from wrapped, which records every read. eof is the wrapper's flag of
+// whether the stream was read to io.EOF.
+func (p *Rprof) writeTo(dst io.Writer, src, wrapped io.Reader, cfg *wrapConfig, eof *bool) (int64, error) {
+	wt, ok := src.(io.WriterTo)
+	if !ok {
+		return io.Copy(dst, wrapped)
+	}
+
+	start := p.readStart(cfg)
+	n, err := wt.WriteTo(dst)
+	ev := newReadEvent(start, int(n), int(n), err, nil)
+	// WriteTo reads until io.EOF, which it doesn't return.
+	ev.eof = err == nil && !*eof
+	*eof = *eof || ev.eof
+	fast := cfg.withLabels(fastPathLabels)
+	p.recordSample(ev, &fast)
+	return n, err
+}
@@ -0,0 +1,147 @@
+package rprof
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// StartRecent starts the default profiler keeping recent windows in memory.
+// See Rprof.StartRecent.
+func StartRecent(interval time.Duration, n int) error {
+	return profiler.StartRecent(interval, n)
+}
+
+// Recent returns a profile of the default profiler's recent windows. See
+// Rprof.Recent.
+func Recent(d time.Duration) (*proto.Profile, error) {
+	return profiler.Recent(d)
+}
+
+// StartRecent starts the profiler in continuous mode, rotating windows every
+// interval and keeping the last n completed windows in memory. Use Recent or
+// Windows to retrospectively retrieve the reads of the last minutes, for
+// example after an incident, without having to start collection after the
+// fact.
+//
+// The windows kept by an earlier call are discarded. Calling Stop ends
+// continuous mode but keeps the completed windows. If the profiler is
+// already started then it returns an error.
+func (p *Rprof) StartRecent(interval time.Duration, n int) error {
+	if n <= 0 {
+		return errors.New("number of windows must be positive")
+	}
+
+	return p.startContinuous(interval, func(chan struct{}) {
+		p.recent.reset(n)
+	}, p.recent.push)
+}
+
+// Windows returns the completed windows kept by StartRecent, oldest first.
+func (p *Rprof) Windows() []Snapshot {
+	return p.recent.since(time.Time{})
+}
+
+// Recent returns a profile merging the windows kept by StartRecent that
+// ended within the last d, as well as the samples collected so far in the
+// current window. If d is zero, all kept windows are merged. If there are
+// no windows and the profiler is not started then it returns an error.
+func (p *Rprof) Recent(d time.Duration) (*proto.Profile, error) {
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	windows := p.recent.since(since)
+	if cur, ok := p.takeSnapshot(); ok {
+		windows = append(windows, cur)
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("no recent windows")
+	}
+
+	return mergeSnapshots(windows).Profile(), nil
+}
+
+// mergeSnapshots merges the samples of consecutive snapshots of the same
+// profiler into a single snapshot spanning all of them. The stacks of each
+// window have their own IDs, so they are interned again in a single table.
+func mergeSnapshots(snapshots []Snapshot) Snapshot {
+	last := snapshots[len(snapshots)-1]
+	m := Snapshot{
+		Start:   snapshots[0].Start,
+		Time:    last.Time,
+		cfg:     snapshots[0].cfg,
+		samples: map[sampleKey]*sampleValue{},
+	}
+	var stacks stackTable
+	var pcs []uintptr
+	for _, s := range snapshots {
+		m.Reads += s.Reads
+		m.Bytes += s.Bytes
+		for k, v := range s.samples {
+			if k.stack != 0 {
+				pcs = s.stacks.appendPCs(pcs[:0], k.stack)
+				h := hashStack(pcs)
+				local, ok := stacks.lookup(h, pcs)
+				if !ok {
+					local = stacks.insert(h, pcs)
+				}
+				k.stack = stackID(0, local)
+			}
+			if mv, ok := m.samples[k]; ok {
+				mv.add(*v)
+				continue
+			}
+			v := *v
+			m.samples[k] = &v
+		}
+	}
+	m.stacks = stackIndex{stacks.list}
+	return m
+}
+
+// windowRing keeps the last n completed windows.
+type windowRing struct {
+	mu      sync.Mutex
+	n       int
+	windows []Snapshot // oldest first
+}
+
+// reset discards all windows and sets the number of windows to keep.
+func (r *windowRing) reset(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.n = n
+	r.windows = make([]Snapshot, 0, n)
+}
+
+// push adds a completed window, evicting the oldest one if the ring is full.
+func (r *windowRing) push(s Snapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.windows) == r.n {
+		copy(r.windows, r.windows[1:])
+		r.windows = r.windows[:r.n-1]
+	}
+	r.windows = append(r.windows, s)
+}
+
+// since returns the windows that ended after t. The samples of completed
+// windows are never modified, so they are shared rather than copied.
+func (r *windowRing) since(t time.Time) []Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var windows []Snapshot
+	for _, s := range r.windows {
+		if s.Time.After(t) {
+			windows = append(windows, s)
+		}
+	}
+	return windows
+}
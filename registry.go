@@ -0,0 +1,83 @@
+package rprof
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// DefaultName is the name the default profiler is registered under.
+const DefaultName = "default"
+
+var registry = struct {
+	mu        sync.RWMutex
+	profilers map[string]*Rprof
+}{
+	profilers: map[string]*Rprof{
+		DefaultName: profiler,
+	},
+}
+
+// Register makes a profiler available by name, so that it can be retrieved
+// with Lookup and served by a NamedProfHandler. This allows a process to run
+// separate profilers concurrently, for example for storage and network reads.
+// It panics if a profiler is already registered under the name.
+func Register(name string, p *Rprof) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, ok := registry.profilers[name]; ok {
+		panic(fmt.Sprintf("rprof: profiler %q already registered", name))
+	}
+	registry.profilers[name] = p
+}
+
+// Lookup returns the profiler registered under name, or nil if there is none.
+// The default profiler is registered as DefaultName.
+func Lookup(name string) *Rprof {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	return registry.profilers[name]
+}
+
+// Names returns the sorted names of all registered profilers.
+func Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	names := make([]string, 0, len(registry.profilers))
+	for name := range registry.profilers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NamedProfHandler is an HTTP handler that profiles any registered profiler
+// for a given duration.
+type NamedProfHandler struct{}
+
+// NamedHandler returns a new NamedProfHandler.
+func NamedHandler() *NamedProfHandler {
+	return &NamedProfHandler{}
+}
+
+// ServeHTTP profiles the profiler registered under the name given with the
+// name parameter, the default profiler if none is given, like a ProfHandler.
+// Implements http.Handler.
+func (h *NamedProfHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		name = DefaultName
+	}
+
+	p := Lookup(name)
+	if p == nil {
+		http.Error(w, fmt.Sprintf("unknown profiler %q", name), http.StatusNotFound)
+		return
+	}
+
+	NewHandler(p).ServeHTTP(w, r)
+}
@@ -1,10 +1,14 @@
 package rprof
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
@@ -15,6 +19,12 @@ var (
 	profiler = NewProfiler()
 )
 
+// Default returns the default profiler used by the package-level functions,
+// for access to methods that have no package-level equivalent.
+func Default() *Rprof {
+	return profiler
+}
+
 // Start starts the default profiler.
 func Start() error {
 	return profiler.Start()
@@ -25,35 +35,214 @@ func Stop() (*proto.Profile, error) {
 	return profiler.Stop()
 }
 
+// Reset clears the samples collected so far by the default profiler.
+func Reset() {
+	profiler.Reset()
+}
+
 // Reader returns a new io.Reader that will be profiled if the profiler is on.
-func Reader(r io.Reader) io.Reader {
-	return profiler.Reader(r)
+func Reader(r io.Reader, opts ...WrapOption) io.Reader {
+	return profiler.Reader(r, opts...)
+}
+
+// ReaderContext returns a new io.Reader that will be profiled if the profiler
+// is on, and that is associated with the labels and span in ctx.
+func ReaderContext(ctx context.Context, r io.Reader, opts ...WrapOption) io.Reader {
+	return profiler.ReaderContext(ctx, r, opts...)
 }
 
 // ReadCloser returns a new io.ReadCloser that will be profiled if the profiler is on.
-func ReadCloser(r io.ReadCloser) io.ReadCloser {
-	return profiler.ReadCloser(r)
+func ReadCloser(r io.ReadCloser, opts ...WrapOption) io.ReadCloser {
+	return profiler.ReadCloser(r, opts...)
+}
+
+// ReadCloserContext returns a new io.ReadCloser that will be profiled if the
+// profiler is on, and that is associated with the labels and span in ctx.
+func ReadCloserContext(ctx context.Context, r io.ReadCloser, opts ...WrapOption) io.ReadCloser {
+	return profiler.ReadCloserContext(ctx, r, opts...)
 }
 
 // ReaderAt returns a new io.ReaderAt that will be profiled if the profiler is on.
-func ReaderAt(r io.ReaderAt) io.ReaderAt {
-	return profiler.ReaderAt(r)
+func ReaderAt(r io.ReaderAt, opts ...WrapOption) io.ReaderAt {
+	return profiler.ReaderAt(r, opts...)
 }
 
+// ReaderAtContext returns a new io.ReaderAt that will be profiled if the
+// profiler is on, and that is associated with the labels and span in ctx.
+func ReaderAtContext(ctx context.Context, r io.ReaderAt, opts ...WrapOption) io.ReaderAt {
+	return profiler.ReaderAtContext(ctx, r, opts...)
+}
+
+// SetReadSizeHistogram sets the histogram that observes every read performed
+// through readers of the default profiler. See Rprof.SetReadSizeHistogram.
+func SetReadSizeHistogram(h *ReadSizeHistogram) {
+	profiler.SetReadSizeHistogram(h)
+}
+
+// defaultMaxStackDepth is the maximum number of frames recorded per sample
+// unless configured otherwise with WithMaxStackDepth.
+const defaultMaxStackDepth = 128
+
 // sampleKey is the key used to group a unique sample. If the same stack and
-// size bucket are seen multiple times then the values are aggregated.
+// size bucket are seen multiple times then the values are aggregated. The
+// stack is referred to by its interned ID, and the small fields are packed
+// together, so keys stay small and cheap to hash and compare.
 type sampleKey struct {
-	locations       [128]uintptr
-	sizeBucketPower uint8
-	numLocations    uint8
+	// labels are the encoded labels of the reader. See LabelSet.encode.
+	labels string
+	// goroutine is the ID of the reading goroutine if goroutine labels are
+	// enabled, 0 otherwise.
+	goroutine uint64
+	// timeBucket is the start of the time bucket of the sample in Unix
+	// nanoseconds if time buckets are enabled, 0 otherwise.
+	timeBucket int64
+	// stack is the ID of the stack in the profiler's stack table, 0 for the
+	// empty stack.
+	stack      uint32
+	sizeBucket uint8
+	// unsized is true for samples that are not produced by reads, such as
+	// closing a stream, and therefore have no size bucket.
+	unsized bool
+	// truncated is true if the stack was deeper than the maximum stack depth
+	// and its outermost frames were cut.
+	truncated bool
+	// dropped is true for the sample aggregating the reads that exceeded the
+	// maximum number of samples. See WithMaxSamples.
+	dropped bool
+}
+
+// droppedKey is the key of the sample aggregating the reads that exceeded the
+// maximum number of samples. It is unsized so it isn't attributed to a stack.
+var droppedKey = sampleKey{unsized: true, dropped: true}
+
+// sampleValue holds the values aggregated for a sample.
+type sampleValue struct {
+	reads     int64
+	bytes     int64
+	latency   int64
+	errors    int64
+	eof       int64
+	abandoned int64
+	requested int64
+	closes    int64
+	leaked    int64
+	// extra are the values of the additional sample types. See
+	// WithValueTypes.
+	extra [MaxValueTypes]int64
 }
 
-// Rprof is a profiler that records the number of reads and the number of bytes
-// read since the last call to Start.
+// add adds the values of o to v.
+func (v *sampleValue) add(o sampleValue) {
+	v.reads += o.reads
+	v.bytes += o.bytes
+	v.latency += o.latency
+	v.errors += o.errors
+	v.eof += o.eof
+	v.abandoned += o.abandoned
+	v.requested += o.requested
+	v.closes += o.closes
+	v.leaked += o.leaked
+	for i := range v.extra {
+		v.extra[i] += o.extra[i]
+	}
+}
+
+// sub subtracts o from v.
+func (v *sampleValue) sub(o sampleValue) {
+	v.reads -= o.reads
+	v.bytes -= o.bytes
+	v.latency -= o.latency
+	v.errors -= o.errors
+	v.eof -= o.eof
+	v.abandoned -= o.abandoned
+	v.requested -= o.requested
+	v.closes -= o.closes
+	v.leaked -= o.leaked
+	for i := range v.extra {
+		v.extra[i] -= o.extra[i]
+	}
+}
+
+// fill sets the values of a sample in the order of the sample types of the
+// profile, the built-in ones followed by the additional ones.
+func (v *sampleValue) fill(values []int64) {
+	values[0] = v.reads
+	values[1] = v.bytes
+	values[2] = v.latency
+	values[3] = v.errors
+	values[4] = v.eof
+	values[5] = v.abandoned
+	values[6] = v.requested
+	values[7] = v.closes
+	values[8] = v.leaked
+	copy(values[numValues:], v.extra[:])
+}
+
+// Rprof is a profiler that records the number of reads, the number of bytes
+// read, the time spent reading and the number of failed reads since the last
+// call to Start.
 type Rprof struct {
-	mu        sync.Mutex
-	samples   map[sampleKey][2]int64
-	startTime int64
+	// mu guards the state of the profiler. Records hold it shared, so Start,
+	// Stop and anything else that swaps or copies the samples hold it
+	// exclusively to wait for in-flight records and exclude new ones. A read
+	// is thus recorded in exactly one window, or none if it completes while
+	// the profiler is stopped.
+	mu sync.RWMutex
+	// shards hold the samples, sharded by the hash of their stack.
+	shards []shard
+	// localBufs pools the local buffers samples are recorded in before
+	// being flushed to the shards, nil unless local buffers are enabled.
+	// See WithLocalBuffers.
+	localBufs *sync.Pool
+	// buffers are all local buffers created since the last flush.
+	buffers   []*localBuffer
+	buffersMu sync.Mutex
+	// batches are the batches of the profiler's wrappers that hold pending
+	// reads, flushed before the samples are taken. See WithBatching.
+	batches   map[*readBatch]struct{}
+	batchesMu sync.Mutex
+	// numSamples is the number of samples in all shards.
+	numSamples atomic.Int64
+	startTime  int64
+	// started mirrors startTime != 0, so records can skip all work without
+	// locking while the profiler is stopped.
+	started atomic.Bool
+	// stackless is true while reads are recorded without their stacks. See
+	// SetStackless.
+	stackless atomic.Bool
+	budget    readBudget
+	// stopContinuous is closed by Stop to end continuous mode, nil if the
+	// profiler is not in continuous mode.
+	stopContinuous chan struct{}
+	recent         windowRing
+	// writer is the writer the profile is written to by Stop, nil unless
+	// started by StartWriting.
+	writer io.Writer
+
+	cfg config
+	// stackBufs pools buffers of cfg.stackDepth()+1+stackSlack PCs to walk
+	// stacks into.
+	stackBufs sync.Pool
+
+	histogram  atomic.Pointer[ReadSizeHistogram]
+	throughput atomic.Pointer[Throughput]
+	spans      spanTracker
+	// totalBytes is the number of bytes read through the profiler's readers
+	// while thresholds is non-zero, whether or not it was started. Reads
+	// are only counted while OnThreshold measures the throughput, so they
+	// don't contend on the counter otherwise.
+	totalBytes atomic.Int64
+	thresholds atomic.Int32
+	overhead   overheadCounters
+	// conns are the open connections profiled by Conn or Listener.
+	conns connTracker
+}
+
+// SetReadSizeHistogram sets the histogram that observes every read performed
+// through the profiler's readers, whether or not the profiler is started. A
+// nil histogram stops observing reads.
+func (p *Rprof) SetReadSizeHistogram(h *ReadSizeHistogram) {
+	p.histogram.Store(h)
 }
 
 // Start starts the profiler. If the profiler is already started then it returns an error.
@@ -61,24 +250,70 @@ func (p *Rprof) Start() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	return p.startLocked()
+}
+
+// startLocked starts the profiler. p.mu must be held.
+func (p *Rprof) startLocked() error {
 	if p.startTime != 0 {
 		return errors.New("profiler already started")
 	}
 
 	p.startTime = time.Now().UnixNano()
-	p.samples = map[sampleKey][2]int64{}
+	p.started.Store(true)
+	p.resetSamples()
 
 	return nil
 }
 
+// Reset clears the samples collected so far without stopping the profiler, so
+// the next profile only covers the time since the reset. This allows
+// long-lived profilers to be cleared after each export without racing other
+// callers of Start and Stop. It is a no-op if the profiler is not started.
+func (p *Rprof) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.startTime == 0 {
+		return
+	}
+
+	p.startTime = time.Now().UnixNano()
+	p.resetSamples()
+}
+
 // profileBuilder is a helper to build a profile.
 type profileBuilder struct {
-	p *proto.Profile
+	cfg *config
+	p   *proto.Profile
+	// synthetic maps the names of synthetic frames to their location IDs.
+	synthetic map[string]uint64
+	// strings maps the strings in the string table to their indices.
+	strings map[string]int64
+	// symbolize is true if the locations are symbolized in-process. See
+	// symbolizeLocations.
+	symbolize bool
+	// links maps the trace and span IDs of the links in the link table to
+	// their indices.
+	links map[string]uint64
+	// callerKeys are the string table indices of the caller label keys,
+	// callerFrames those of the frames at each PC and callerPCs is scratch
+	// space for the PCs of a stack. See WithCallerLabels.
+	callerKeys   []int64
+	callerFrames map[uintptr][]int64
+	callerPCs    []uintptr
+	// valueTypes are the additional sample types of the profile, and
+	// derived the labels derived from their values. See addValueTypes.
+	valueTypes []valueType
+	derived    []derivedLabel
 }
 
-// newProfileBuilder returns a new profileBuilder with the given timestamp and duration.
-func newProfileBuilder(timestampNanos, durationNanos int64) *profileBuilder {
+// newProfileBuilder returns a new profileBuilder with the given configuration,
+// timestamp and duration.
+func newProfileBuilder(cfg *config, timestampNanos, durationNanos int64) *profileBuilder {
 	b := &profileBuilder{
+		cfg:       cfg,
+		symbolize: cfg.symbolize,
 		p: &proto.Profile{
 			// StringTable is initialized with values we know are going to be there.
 			StringTable: []string{
@@ -87,6 +322,14 @@ func newProfileBuilder(timestampNanos, durationNanos int64) *profileBuilder {
 				"count",
 				"read",
 				"bytes",
+				"latency",
+				"nanoseconds",
+				"errors",
+				"eof",
+				"abandoned",
+				"requested",
+				"closes",
+				"leaked",
 			},
 			DurationNanos: durationNanos,
 			TimeNanos:     timestampNanos,
@@ -101,19 +344,84 @@ func newProfileBuilder(timestampNanos, durationNanos int64) *profileBuilder {
 			}, {
 				Type: 3, // "read" in the string table
 				Unit: 4, // "bytes" in the string table
+			}, {
+				Type: 5, // "latency" in the string table
+				Unit: 6, // "nanoseconds" in the string table
+			}, {
+				Type: 7, // "errors" in the string table
+				Unit: 2, // "count" in the string table
+			}, {
+				Type: 8, // "eof" in the string table
+				Unit: 2, // "count" in the string table
+			}, {
+				Type: 9, // "abandoned" in the string table
+				Unit: 2, // "count" in the string table
+			}, {
+				Type: 10, // "requested" in the string table
+				Unit: 4,  // "bytes" in the string table
+			}, {
+				Type: 11, // "closes" in the string table
+				Unit: 2,  // "count" in the string table
+			}, {
+				Type: 12, // "leaked" in the string table
+				Unit: 2,  // "count" in the string table
 			}},
+			// Consumers such as pprof default to the last sample type
+			// otherwise, but bytes read is the most useful view.
+			DefaultSampleType: 3, // "read" in the string table
 		},
 	}
 
+	b.strings = make(map[string]int64, len(b.p.StringTable))
+	for i, s := range b.p.StringTable {
+		b.strings[s] = int64(i)
+	}
+	b.addValueTypes()
+	b.addSampling()
+	b.addDegradationEvents(cfg.limiter, timestampNanos, durationNanos)
+
 	// populate the mappings right away
 	b.readMapping()
 	return b
 }
 
-// addString adds a string to the string table and returns the index.
+// addString adds a string to the string table and returns the index. A string
+// that is already in the table isn't added again.
 func (b *profileBuilder) addString(s string) int64 {
+	if idx, ok := b.strings[s]; ok {
+		return idx
+	}
+	idx := int64(len(b.p.StringTable))
 	b.p.StringTable = append(b.p.StringTable, s)
-	return int64(len(b.p.StringTable)) - 1
+	b.strings[s] = idx
+	return idx
+}
+
+// addSyntheticLocation returns the ID of a location with a single frame of
+// the given function name that doesn't correspond to any code, such as
+// "[dropped]". The location is added on first use.
+func (b *profileBuilder) addSyntheticLocation(name string) uint64 {
+	if id, ok := b.synthetic[name]; ok {
+		return id
+	}
+
+	fnID := uint64(len(b.p.Function)) + 1
+	b.p.Function = append(b.p.Function, &proto.Function{
+		Id:   fnID,
+		Name: b.addString(name),
+	})
+
+	id := uint64(len(b.p.Location)) + 1
+	b.p.Location = append(b.p.Location, &proto.Location{
+		Id:   id,
+		Line: []*proto.Line{{FunctionIndex: fnID}},
+	})
+
+	if b.synthetic == nil {
+		b.synthetic = map[string]uint64{}
+	}
+	b.synthetic[name] = id
+	return id
 }
 
 // addMapping is called from the respective platform-specific implementations
@@ -148,204 +456,705 @@ func (b *profileBuilder) addMappingEntry(lo, hi, offset uint64, file, buildID st
 	})
 }
 
-// build populates the samples and locations in the profile.
-func (b *profileBuilder) build(samples map[sampleKey][2]int64) *proto.Profile {
+// build populates the samples and locations in the profile. Large sets of
+// samples are built by several goroutines, see buildParallel, unless the
+// profile is built in canonical order.
+func (b *profileBuilder) build(samples map[sampleKey]*sampleValue, stacks stackIndex) *proto.Profile {
+	if workers := min(runtime.GOMAXPROCS(0), maxBuildWorkers); workers > 1 && len(samples) >= parallelBuildSamples && !b.cfg.canonical {
+		b.buildParallel(samples, stacks, workers)
+	} else {
+		b.buildSerial(samples, stacks)
+	}
+	b.mapUnmapped()
+	if b.symbolize {
+		b.symbolizeLocations()
+	}
+
+	// We do this to signify to the consumer that addresses no longer need to be adjusted.
+	// https://github.com/google/pprof/blob/813a5fbdbec8a66f7a5aedb876e1b2c3ee0f99ac/internal/elfexec/elfexec.go#L218-L223
+	for _, m := range b.p.Mapping {
+		m.MemoryStart = 0
+		m.MemoryLimit = 1 << 63
+		m.FileOffset = 0
+	}
+
+	return b.p
+}
+
+// mapUnmapped assigns the locations whose addresses are outside of all
+// mappings to a fake mapping covering the entire address space, which is also
+// added if there are no mappings at all, for example in an empty profile on a
+// platform whose mappings can't be read. pprof accepts unmapped locations but
+// other consumers don't. Synthetic locations remain unmapped as they have no
+// address.
+func (b *profileBuilder) mapUnmapped() {
+	var fakeID uint64
+	fake := func() uint64 {
+		if fakeID == 0 {
+			b.addMappingEntry(0, 0, 0, "", "", true)
+			fakeID = uint64(len(b.p.Mapping))
+		}
+		return fakeID
+	}
+
+	for _, loc := range b.p.Location {
+		if loc.MappingIndex == 0 && len(loc.Line) == 0 {
+			loc.MappingIndex = fake()
+		}
+	}
+	if len(b.p.Mapping) == 0 {
+		fake()
+	}
+}
+
+// mappingID returns the ID of the mapping containing addr, 0 if there is
+// none.
+func (b *profileBuilder) mappingID(addr uint64) uint64 {
+	for i, m := range b.p.Mapping {
+		if m.MemoryStart <= addr && addr < m.MemoryLimit {
+			return uint64(i) + 1 // IDs are 1-indexed
+		}
+	}
+	return 0
+}
+
+// buildSerial builds the samples and locations of the profile on the calling
+// goroutine. The messages of the profile are allocated in bulk, sized from
+// the number of samples, and the scratch state is pooled for the next build.
+func (b *profileBuilder) buildSerial(samples map[sampleKey]*sampleValue, stacks stackIndex) {
+	scratch := getBuilderScratch()
+	defer putBuilderScratch(scratch)
+
+	// Size a single backing array for the location indices of all samples,
+	// including synthetic frames for truncated or dropped ones and for size
+	// buckets.
+	numLocs := 0
+	for sampleKey := range samples {
+		numLocs += stacks.depth(sampleKey.stack) + 2
+	}
+	allLocs := make([]uint64, 0, numLocs)
+	n := b.numValues()
+	allValues := make([]int64, n*len(samples))
+	sampleSlab := newSlab[proto.Sample](len(samples))
+	locationSlab := newSlab[proto.Location](scratch.numLocations)
+	labelSlab := newSlab[proto.Label](len(samples))
+
 	b.p.Sample = make([]*proto.Sample, 0, len(samples))
+	b.p.Location = slices.Grow(b.p.Location, scratch.numLocations)
 
-	locIdx := map[uintptr]uint64{}
-	locs := make([]uint64, 0, 128)
+	var truncated int64
+	buckets := b.cfg.buckets()
+	var callers []labelTemplate
 
-	for sampleKey, sampleValue := range samples {
-		locs = locs[:0]
+	b.forEachSample(samples, stacks, func(sampleKey sampleKey, sampleValue *sampleValue) {
+		start := len(allLocs)
+		sizeLoc, sizeFrame := b.sizeLocation(sampleKey)
+		if sizeFrame {
+			allLocs = append(allLocs, sizeLoc)
+		}
 
-		for _, loc := range sampleKey.locations[:sampleKey.numLocations] {
-			idx, ok := locIdx[loc]
+		scratch.pcs = stacks.appendPCs(scratch.pcs[:0], sampleKey.stack)
+		for _, loc := range scratch.pcs {
+			idx, ok := scratch.locIdx[loc]
 			if !ok {
-				idx = uint64(len(locIdx)) + 1
-				locIdx[loc] = idx
-
-				var mappingId uint64
-				addr := uint64(loc)
-				for i := uint64(0); i < uint64(len(b.p.Mapping)); i++ {
-					if b.p.Mapping[i].MemoryStart <= addr && addr < b.p.Mapping[i].MemoryLimit {
-						mappingId = i + 1 // IDs are 1-indexed
-						break
-					}
-				}
+				idx = uint64(len(b.p.Location)) + 1
+				scratch.locIdx[loc] = idx
 
-				b.p.Location = append(b.p.Location, &proto.Location{
-					Id:           idx,
-					MappingIndex: mappingId,
-					Address:      addr,
-				})
+				location := locationSlab.new()
+				location.Id = idx
+				location.MappingIndex = b.mappingID(uint64(loc))
+				location.Address = uint64(loc)
+				b.p.Location = append(b.p.Location, location)
 			}
 
-			locs = append(locs, idx)
+			allLocs = append(allLocs, idx)
+		}
+		if sampleKey.truncated {
+			allLocs = append(allLocs, b.addSyntheticLocation("[truncated]"))
+			truncated += sampleValue.reads
+		}
+		if sampleKey.dropped {
+			allLocs = append(allLocs, b.addSyntheticLocation("[dropped]"))
+			b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+				"rprof: dropped %d reads exceeding the maximum of %d samples",
+				sampleValue.reads, b.cfg.maxSamples,
+			)))
 		}
 
-		b.p.Sample = append(b.p.Sample, &proto.Sample{
-			// Copy the locations since we're reusing the slice.
-			LocationIndex: copyLocs(locs),
-			Value:         sampleValue[:],
-			Label: []*proto.Label{{
-				Key: 4, // "bytes"
-				Num: 1 << sampleKey.sizeBucketPower,
-			}},
-		})
-	}
+		values := allValues[:n:n]
+		allValues = allValues[n:]
+		sampleValue.fill(values)
 
-	// We do this to signify to the consumer that addresses no longer need to be adjusted.
-	// https://github.com/google/pprof/blob/813a5fbdbec8a66f7a5aedb876e1b2c3ee0f99ac/internal/elfexec/elfexec.go#L218-L223
-	for _, m := range b.p.Mapping {
-		m.MemoryStart = 0
-		m.MemoryLimit = 1 << 63
-		m.FileOffset = 0
+		sample := sampleSlab.new()
+		// The full slice expression keeps appends to one sample's locations
+		// from overwriting the next one's.
+		sample.LocationIndex = allLocs[start:len(allLocs):len(allLocs)]
+		sample.Value = values
+		if num, ok := buckets.label(sampleKey.sizeBucket); ok && !sampleKey.unsized && !sizeFrame {
+			l := addLabel(sample, &labelSlab)
+			l.Key = 4 // "bytes"
+			l.Num = num
+		}
+		if sampleKey.goroutine != 0 {
+			l := addLabel(sample, &labelSlab)
+			l.Key = b.addString("goroutine")
+			l.Num = int64(sampleKey.goroutine)
+		}
+		if sampleKey.timeBucket != 0 {
+			l := addLabel(sample, &labelSlab)
+			l.Key = b.addString("time")
+			l.Num = sampleKey.timeBucket
+			l.NumUnit = 6 // "nanoseconds"
+		}
+		b.addDerivedLabels(sample, sampleValue, &labelSlab)
+		var traceID, spanID string
+		decodeLabels(sampleKey.labels, func(l label) {
+			pl := addLabel(sample, &labelSlab)
+			pl.Key = b.addString(l.key)
+			if l.numeric {
+				pl.Num = l.num
+				if l.unit != "" {
+					pl.NumUnit = b.addString(l.unit)
+				}
+			} else {
+				pl.Str = b.addString(l.value)
+				traceID, spanID = traceLabel(l, traceID, spanID)
+			}
+		})
+		sample.Link = b.addLink(traceID, spanID)
+		callers = b.callers(stacks, sampleKey.stack, callers[:0])
+		for _, c := range callers {
+			l := addLabel(sample, &labelSlab)
+			l.Key = c.key
+			l.Str = c.str
+		}
+		b.p.Sample = append(b.p.Sample, sample)
+	})
+	if truncated > 0 {
+		b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+			"rprof: truncated the stacks of %d reads exceeding the maximum depth of %d frames",
+			truncated, b.cfg.stackDepth(),
+		)))
 	}
-
-	return b.p
+	scratch.numLocations = len(b.p.Location)
 }
 
-// copyLocs copies the locations to a new slice.
-func copyLocs(locs []uint64) []uint64 {
-	res := make([]uint64, len(locs))
-	copy(res, locs)
-	return res
+// addLabel adds a label allocated from labels to the sample and returns it.
+func addLabel(sample *proto.Sample, labels *slab[proto.Label]) *proto.Label {
+	l := labels.new()
+	sample.Label = append(sample.Label, l)
+	return l
 }
 
 // Stop stops the profiler and returns the profile. If the profiler is not
-// started then it returns an error.
+// started then it returns an error. If it was started by StartWriting then
+// the profile is also written to its writer. If a read budget is set and was
+// exceeded then both the profile and a *BudgetError are returned.
 func (p *Rprof) Stop() (*proto.Profile, error) {
+	s, budgetErr, err := p.stop(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	prof := s.Profile()
+	if s.writer != nil {
+		if err := writeProfile(s.writer, prof); err != nil {
+			return prof, err
+		}
+	}
+	if budgetErr != nil {
+		budgetErr.Top = summarizeStacks(s.samples, s.stacks, budgetErrorStacks)
+		return prof, budgetErr
+	}
+	return prof, nil
+}
+
+// stop stops the profiler and returns a snapshot of the ended window, along
+// with the error of the read budget, without its top stacks, if it was
+// exceeded. If cont is not nil, the profiler is only stopped if it is still in
+// the continuous mode whose channel is cont.
+func (p *Rprof) stop(cont chan struct{}) (Snapshot, *BudgetError, error) {
+	p.flushBatches()
 	p.mu.Lock()
 
 	if p.startTime == 0 {
 		p.mu.Unlock()
-		return nil, errors.New("profiler not started")
+		return Snapshot{}, nil, errors.New("profiler not started")
+	}
+	if cont != nil && p.stopContinuous != cont {
+		p.mu.Unlock()
+		return Snapshot{}, nil, errors.New("continuous mode ended")
 	}
 
-	ts := p.startTime
-	samples := p.samples
+	s := Snapshot{
+		Start:    time.Unix(0, p.startTime),
+		cfg:      &p.cfg,
+		overhead: p.overhead.stats(),
+	}
+	budgetErr := p.budget.err()
+	s.samples, s.stacks = p.swapSamples()
 
+	s.writer = p.writer
+	p.writer = nil
 	p.startTime = 0
+	p.started.Store(false)
+	if p.stopContinuous != nil {
+		close(p.stopContinuous)
+		p.stopContinuous = nil
+	}
 	p.mu.Unlock()
 
-	duration := time.Now().UnixNano() - ts
+	s.Time = time.Now()
+	for _, v := range s.samples {
+		s.Reads += v.reads
+		s.Bytes += v.bytes
+	}
+	return s, budgetErr, nil
+}
 
-	b := newProfileBuilder(ts, duration)
-	return b.build(samples), nil
+// readEvent describes a single read performed through a wrapper.
+type readEvent struct {
+	// n is the number of bytes read.
+	n int
+	// requested is the size of the buffer passed to the read.
+	requested int
+	// latency is the time spent in the underlying read.
+	latency time.Duration
+	// err is the error returned by the underlying read.
+	err error
+	// eof is true if the read is the first one of the stream to return
+	// io.EOF.
+	eof bool
+	// extra are the values of the additional sample types. See
+	// WithReadValues.
+	extra [MaxValueTypes]int64
+	// batched is the number of reads aggregated by a batch, in which case
+	// n, requested, latency and the additional values are their sums, 0 for
+	// a single read.
+	batched int
 }
 
-func (p *Rprof) recordSample(size int) {
-	sizeBucketPower := nextPowerOfTwo(size)
+// failed reports whether the read returned an error other than io.EOF.
+func (ev readEvent) failed() bool {
+	return ev.err != nil && ev.err != io.EOF
+}
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// recording reports whether reads through the wrapper with the given
+// configuration are recorded, that is whether the profiler or any of the
+// additional profilers of the wrapper is started.
+func (p *Rprof) recording(cfg *wrapConfig) bool {
+	if p.started.Load() {
+		return true
+	}
+	for _, q := range cfg.also {
+		if q.started.Load() {
+			return true
+		}
+	}
+	return false
+}
 
-	if p.startTime == 0 {
-		// profiler not started
+// readStart returns the time a read through the wrapper with the given
+// configuration starts, or the zero time if the read isn't recorded, so that
+// wrappers don't take timestamps while their profilers are stopped.
+func (p *Rprof) readStart(cfg *wrapConfig) time.Time {
+	if !p.recording(cfg) {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// newReadEvent returns the event of a read of n of requested bytes that
+// started at start, as returned by readStart, and returned err. eof points to
+// the wrapper's flag of whether its stream returned io.EOF already, which is
+// updated, or is nil if the wrapper doesn't track it.
+func newReadEvent(start time.Time, n, requested int, err error, eof *bool) readEvent {
+	ev := readEvent{n: n, requested: requested, err: err}
+	if !start.IsZero() {
+		ev.latency = time.Since(start)
+	}
+	if eof != nil {
+		ev.eof = err == io.EOF && !*eof
+		*eof = *eof || ev.eof
+	}
+	return ev
+}
+
+// read reads from r into buf and returns the event of the read through the
+// wrapper with the given configuration. See newReadEvent for eof.
+func (p *Rprof) read(r io.Reader, buf []byte, cfg *wrapConfig, eof *bool) readEvent {
+	start := p.readStart(cfg)
+	n, err := r.Read(buf)
+	return newReadEvent(start, n, len(buf), err, eof)
+}
+
+// readAt reads from r into buf at off and returns the event of the read
+// through the wrapper with the given configuration.
+func (p *Rprof) readAt(r io.ReaderAt, buf []byte, off int64, cfg *wrapConfig) readEvent {
+	start := p.readStart(cfg)
+	n, err := r.ReadAt(buf, off)
+	return newReadEvent(start, n, len(buf), err, nil)
+}
+
+// recordSample records a read performed through the wrapper with the given
+// configuration in the profiler and the additional profilers of the wrapper.
+// It must be called from the wrapper's read method, the stack starts at the
+// first caller outside of rprof.
+func (p *Rprof) recordSample(ev readEvent, cfg *wrapConfig) {
+	if !p.recording(cfg) {
+		// Only the totals observe reads while the profilers are stopped, the
+		// values of the read are neither computed nor batched.
+		p.observeAll(ev, cfg)
 		return
 	}
 
-	locations := [128]uintptr{}
-	numRead := runtime.Callers(3, locations[:])
+	if p.started.Load() {
+		now := time.Now()
+		defer p.overhead.observe(now)
+		if l := p.cfg.limiter; l != nil {
+			l.tick(now, &p.overhead)
+		}
+	}
 
-	k := sampleKey{
-		locations:       locations,
-		numLocations:    uint8(numRead),
-		sizeBucketPower: sizeBucketPower,
+	if cfg.readValues != nil {
+		cfg.readValues(ev.n, ev.extra[:p.cfg.valueTypes.user])
 	}
-	sample := p.samples[k]
 
-	// first sample is the number of reads
-	sample[0]++
+	p.observeAll(ev, cfg)
 
-	// second sample is the number of bytes read
-	sample[1] += int64(size)
+	if cfg.batch == nil {
+		p.recordAll(ev, cfg)
+		return
+	}
 
-	p.samples[k] = sample
+	var due [2]pendingRead
+	for _, r := range cfg.batch.add(p, ev, p.cfg.buckets().bucket(ev.n), cfg, due[:0]) {
+		p.recordPending(r)
+	}
 }
 
-// nextPowerOfTwo returns the next power of two that is greater or equal to the input. It returns the power, not the value to be able to return a uint8.
-func nextPowerOfTwo(input int) uint8 {
-	for i := 0; i < 63; i++ {
-		if 1<<i >= input {
-			return uint8(i)
+// observeAll observes a read performed through the wrapper with the given
+// configuration in the profiler and the additional profilers of the wrapper.
+func (p *Rprof) observeAll(ev readEvent, cfg *wrapConfig) {
+	p.observe(ev, cfg)
+	for _, q := range cfg.also {
+		if q != p {
+			q.observe(ev, cfg)
 		}
 	}
-	return 63
 }
 
-// NewProfiler returns a new profiler.
-func NewProfiler() *Rprof {
-	return &Rprof{}
+// flushBatch records the reads pending in the batch of the wrapper with the
+// given configuration, if any.
+func (p *Rprof) flushBatch(cfg *wrapConfig) {
+	if cfg.batch == nil {
+		return
+	}
+
+	var due [1]pendingRead
+	for _, r := range cfg.batch.flush(due[:0]) {
+		p.recordPending(r)
+	}
 }
 
-// RprofReader is an io.Reader that will profile the reads if the profiler is on.
-type RprofReader struct {
-	p *Rprof
-	r io.Reader
+// flushBatches records the reads pending in the batches of all wrappers of
+// the profiler, so they are part of the samples about to be taken rather
+// than of a later window. p.mu must not be held.
+func (p *Rprof) flushBatches() {
+	p.batchesMu.Lock()
+	batches := make([]*readBatch, 0, len(p.batches))
+	for b := range p.batches {
+		batches = append(batches, b)
+	}
+	p.batchesMu.Unlock()
+
+	var due [1]pendingRead
+	for _, b := range batches {
+		for _, r := range b.flush(due[:0]) {
+			p.recordPending(r)
+		}
+	}
 }
 
-// Reader returns a new io.Reader that will be profiled if the profiler is on.
-func (p *Rprof) Reader(r io.Reader) io.Reader {
-	return &RprofReader{
-		p: p,
-		r: r,
+// recordPending records a read of a batch, with the stack of the read that
+// started the batch if it aggregates several reads.
+func (p *Rprof) recordPending(r pendingRead) {
+	w := stackWalk{p: p, cfg: &r.cfg, pcs: r.stack}
+	p.recordWalk(r.ev, &r.cfg, &w)
+	w.release()
+}
+
+// observe feeds a read to the totals, histogram, throughput and span tracking
+// of the profiler, which observe every read whether or not it is recorded.
+func (p *Rprof) observe(ev readEvent, cfg *wrapConfig) {
+	if p.thresholds.Load() > 0 {
+		p.totalBytes.Add(int64(ev.n))
+	}
+	if h := p.histogram.Load(); h != nil {
+		h.Observe(ev.n)
+	}
+	if t := p.throughput.Load(); t != nil {
+		t.Observe(ev.n)
+	}
+	if cfg.span != nil {
+		p.spans.observe(cfg.span, ev.n)
 	}
 }
 
-// Read reads from the underlying reader and records the sample in the profiler.
-// Implements io.Reader.
-func (r *RprofReader) Read(buf []byte) (int, error) {
-	n, err := r.r.Read(buf)
-	r.p.recordSample(n)
-	return n, err
+// recordAll records a read in the profiler and the additional profilers of
+// the wrapper.
+func (p *Rprof) recordAll(ev readEvent, cfg *wrapConfig) {
+	w := stackWalk{p: p, cfg: cfg}
+	p.recordWalk(ev, cfg, &w)
+	w.release()
 }
 
-// RprofReadCloser is an io.ReadCloser that will profile the reads if the profiler is on.
-type RprofReadCloser struct {
-	p *Rprof
-	r io.ReadCloser
+// recordWalk records a read with the stack of w in the profiler and the
+// additional profilers of the wrapper.
+func (p *Rprof) recordWalk(ev readEvent, cfg *wrapConfig, w *stackWalk) {
+	p.record(ev, cfg, w)
+	for _, q := range cfg.also {
+		if q != p {
+			q.record(ev, cfg, w)
+		}
+	}
 }
 
-// ReadCloser returns a new io.ReadCloser that will be profiled if the profiler is on.
-func (p *Rprof) ReadCloser(r io.ReadCloser) io.ReadCloser {
-	return &RprofReadCloser{
-		p: p,
-		r: r,
+// record records a read in the profiler.
+func (p *Rprof) record(ev readEvent, cfg *wrapConfig, w *stackWalk) {
+	if !p.started.Load() {
+		return
+	}
+
+	if ev.n == 0 && ev.failed() {
+		switch p.cfg.failedReads {
+		case SkipFailedReads:
+			return
+		case CountFailedReads:
+			p.add(sampleKey{unsized: true}, 0, sampleValue{errors: 1}, cfg, w)
+			return
+		}
+	}
+
+	var reads, bytes int64
+	ok := true
+	size := ev.n
+	switch {
+	case ev.batched > 0:
+		// Batches are exact aggregates and recorded as is, in the bucket
+		// of their average size.
+		reads, bytes = int64(ev.batched), int64(ev.n)
+		size = ev.n / ev.batched
+	case ev.failed() || ev.eof:
+		// Failed reads and the end of streams are rare and interesting, so
+		// they are always recorded, unscaled.
+		reads, bytes = 1, int64(ev.n)
+	default:
+		reads, bytes, ok = p.cfg.sample(ev.n)
+	}
+	if !ok {
+		return
 	}
+
+	// Latency, requested bytes and the additional values are scaled like the
+	// number of reads when sampling, batches hold their sums already.
+	scale := reads
+	if ev.batched > 0 {
+		scale = 1
+	}
+	delta := sampleValue{
+		reads:     reads,
+		bytes:     bytes,
+		latency:   int64(ev.latency) * scale,
+		requested: int64(ev.requested) * scale,
+	}
+	for i, v := range ev.extra {
+		delta.extra[i] = v * scale
+	}
+	if ev.failed() {
+		delta.errors = 1
+	}
+	if ev.eof {
+		delta.eof = 1
+	}
+
+	k := sampleKey{sizeBucket: p.cfg.buckets().bucket(size)}
+	p.add(k, size, delta, cfg, w)
 }
 
-// Read reads from the underlying reader and records the sample in the profiler.
-// Implements io.Reader.
-func (r *RprofReadCloser) Read(buf []byte) (int, error) {
-	n, err := r.r.Read(buf)
-	r.p.recordSample(n)
-	return n, err
+// recordClose records that a stream was closed, and whether it was closed
+// before it was read to io.EOF, in the profiler and the additional profilers
+// of the wrapper. It must be called from the wrapper's Close method, the stack
+// starts at the first caller outside of rprof.
+func (p *Rprof) recordClose(cfg *wrapConfig, abandoned bool) {
+	delta := sampleValue{closes: 1}
+	if abandoned {
+		delta.abandoned = 1
+	}
+	w := stackWalk{p: p, cfg: cfg}
+	p.recordUnsized(delta, cfg, &w)
+	w.release()
 }
 
-// Close closes the underlying reader.
-// Implements io.Closer.
-func (r *RprofReadCloser) Close() error {
-	return r.r.Close()
+// recordLeaked records that a stream was garbage collected without being
+// closed in the profiler and the additional profilers of the wrapper, at the
+// given stack where the wrapper was created.
+func (p *Rprof) recordLeaked(cfg *wrapConfig, created []uintptr) {
+	// created is never nil, so the walk doesn't walk the finalizer's stack.
+	w := stackWalk{p: p, cfg: cfg, pcs: created}
+	p.recordUnsized(sampleValue{leaked: 1}, cfg, &w)
 }
 
-// RprofReaderAt is an io.ReaderAt that will profile the reads if the profiler is on.
-type RprofReaderAt struct {
-	p *Rprof
-	r io.ReaderAt
+// recordUnsized records delta, which isn't produced by a read, with the
+// stack of w in the profiler and the additional profilers of the wrapper.
+func (p *Rprof) recordUnsized(delta sampleValue, cfg *wrapConfig, w *stackWalk) {
+	p.add(sampleKey{unsized: true}, -1, delta, cfg, w)
+	for _, q := range cfg.also {
+		if q != p {
+			q.add(sampleKey{unsized: true}, -1, delta, cfg, w)
+		}
+	}
 }
 
-// ReaderAt returns a new io.ReaderAt that will be profiled if the profiler is on.
-func (p *Rprof) ReaderAt(r io.ReaderAt) io.ReaderAt {
-	return &RprofReaderAt{
-		p: p,
-		r: r,
+// add adds delta to the sample of the stack of w with the size bucket of k.
+// size is the size of the read passed to the record filter, or -1 if the
+// record isn't a read.
+func (p *Rprof) add(k sampleKey, size int, delta sampleValue, cfg *wrapConfig, w *stackWalk) {
+	if !p.started.Load() {
+		return
+	}
+
+	if p.cfg.goroutines {
+		k.goroutine = goroutineID()
+	}
+	if p.cfg.timeBucket > 0 {
+		k.timeBucket = time.Now().Truncate(p.cfg.timeBucket).UnixNano()
+	}
+
+	p.mu.RLock()
+
+	if p.startTime == 0 {
+		// profiler not started
+		p.mu.RUnlock()
+		return
+	}
+
+	var pcs []uintptr
+	if p.stackless.Load() || p.cfg.limiter.stackless() {
+		// Samples are only told apart by the name of the reader, if any.
+		k.labels = cfg.nameKey
+	} else {
+		pcs = w.stack()
+		if depth := p.cfg.stackDepth(); len(pcs) > depth {
+			pcs = pcs[:depth]
+			k.truncated = !p.cfg.leafOnly
+		} else if p.cfg.trimRuntime {
+			pcs = trimRuntimeFrames(pcs)
+		}
+		k.labels = cfg.labelKey
+		if cfg.traceKey != "" && !p.cfg.noTraceLabels {
+			k.labels = cfg.traceKey
+		}
+	}
+
+	if p.cfg.filter != nil && !p.cfg.filter(size, pcs) {
+		p.mu.RUnlock()
+		return
+	}
+
+	h := hashStack(pcs)
+	if bufs := p.localBufs; bufs != nil {
+		b := bufs.Get().(*localBuffer)
+		p.addSample(b.samples, &b.stacks, 0, k, h, pcs, delta)
+		bufs.Put(b)
+	} else {
+		sh, shardIdx := p.shardFor(h)
+		sh.mu.Lock()
+		p.addSample(sh.samples, &sh.stacks, shardIdx, k, h, pcs, delta)
+		sh.mu.Unlock()
 	}
+
+	var event *SampleEvent
+	if hook := p.cfg.hook; hook != nil {
+		if now := time.Now(); hook.allow(now) {
+			ev := hook.event(now, pcs, size, k.labels, delta)
+			event = &ev
+		}
+	}
+
+	var budgetErr *BudgetError
+	onExceed := p.budget.onExceed
+	if p.budget.add(delta.bytes) && onExceed != nil {
+		budgetErr = p.budget.err()
+		samples, stacks := p.copySamples(true)
+		budgetErr.Top = summarizeStacks(samples, stacks, budgetErrorStacks)
+	}
+	p.mu.RUnlock()
+
+	if event != nil {
+		p.cfg.hook.fn(*event)
+	}
+	if budgetErr != nil {
+		onExceed(budgetErr)
+	}
+}
+
+// addSample adds delta to the sample of k with the stack pcs with hash h in
+// samples, interning the stack in stacks, the table of the shard with the
+// given index.
+func (p *Rprof) addSample(samples map[sampleKey]*sampleValue, stacks *stackTable, shardIdx uint32, k sampleKey, h uint64, pcs []uintptr, delta sampleValue) {
+	local, interned := stacks.lookup(h, pcs)
+	k.stack = stackID(shardIdx, local)
+
+	var sample *sampleValue
+	ok := false
+	if interned {
+		sample, ok = samples[k]
+	}
+	if !ok && p.cfg.maxSamples > 0 && p.numSamples.Load() >= int64(p.cfg.maxSamples) {
+		k = droppedKey
+		sample, ok = samples[k]
+	}
+	if !ok {
+		if !interned && !k.dropped {
+			k.stack = stackID(shardIdx, stacks.insert(h, pcs))
+		}
+		sample = &sampleValue{}
+		samples[k] = sample
+		p.numSamples.Add(1)
+	}
+	sample.add(delta)
 }
 
-// ReadAt reads from the underlying reader and records the sample in the profiler.
-func (r *RprofReaderAt) ReadAt(buf []byte, off int64) (int, error) {
-	n, err := r.r.ReadAt(buf, off)
-	r.p.recordSample(n)
-	return n, err
+// stackBuf returns a buffer to walk a stack into from the pool.
+func (p *Rprof) stackBuf() *[]uintptr {
+	if buf, ok := p.stackBufs.Get().(*[]uintptr); ok {
+		return buf
+	}
+
+	// One extra PC tells stacks deeper than the maximum depth apart from
+	// stacks of exactly the maximum depth.
+	buf := make([]uintptr, p.cfg.stackDepth()+1+stackSlack)
+	return &buf
+}
+
+// nextPowerOfTwo returns the next power of two that is greater or equal to the input. It returns the power, not the value to be able to return a uint8.
+func nextPowerOfTwo(input int) uint8 {
+	for i := 0; i < 63; i++ {
+		if 1<<i >= input {
+			return uint8(i)
+		}
+	}
+	return 63
+}
+
+// NewProfiler returns a new profiler configured with the given options.
+func NewProfiler(opts ...Option) *Rprof {
+	p := &Rprof{cfg: config{valueTypes: &valueTypeSet{}}}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.shards = make([]shard, p.cfg.numShards())
+	p.resetBuffers()
+	return p
 }
@@ -1,8 +1,25 @@
 package rprof
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
+
+	pprof "github.com/google/pprof/profile"
+	profile "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	protobuf "google.golang.org/protobuf/proto"
 )
 
 func TestClosestPowerOfTwo(t *testing.T) {
@@ -38,3 +55,865 @@ func TestClosestPowerOfTwo(t *testing.T) {
 		})
 	}
 }
+
+func TestReadSizeHistogram(t *testing.T) {
+	t.Parallel()
+
+	h := NewReadSizeHistogram(4096, 1024)
+	for _, size := range []int{0, 1024, 1025, 4096, 1 << 20} {
+		h.Observe(size)
+	}
+
+	expected := []uint64{2, 2, 1}
+	for i := range h.counts {
+		if c := h.counts[i].Load(); c != expected[i] {
+			t.Fatalf("bucket %d: expected %d but got %d", i, expected[i], c)
+		}
+	}
+	if sum := h.sum.Load(); sum != 0+1024+1025+4096+1<<20 {
+		t.Fatalf("unexpected sum %d", sum)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	t.Parallel()
+
+	tp := NewThroughput(3 * time.Second)
+	tp.observe(100, 10)
+	tp.observe(101, 20)
+	tp.observe(101, 30)
+	// Reuses the slot of second 100.
+	tp.observe(104, 40)
+
+	points := tp.points(104)
+	expected := []ThroughputPoint{
+		{Time: time.Unix(101, 0), Bytes: 50, Reads: 2},
+		{Time: time.Unix(102, 0)},
+		{Time: time.Unix(103, 0)},
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("expected %d points but got %d", len(expected), len(points))
+	}
+	for i := range expected {
+		if !points[i].Time.Equal(expected[i].Time) || points[i].Bytes != expected[i].Bytes || points[i].Reads != expected[i].Reads {
+			t.Fatalf("point %d: expected %+v but got %+v", i, expected[i], points[i])
+		}
+	}
+	if p := tp.points(105); p[len(p)-1].Bytes != 40 {
+		t.Fatalf("expected 40 bytes in the last second but got %+v", p)
+	}
+}
+
+func TestBoundedBuckets(t *testing.T) {
+	t.Parallel()
+
+	b := boundedBuckets{bounds: []int{512, 16384}}
+	cases := []struct {
+		size  int
+		label int64
+	}{
+		{size: 0, label: 512},
+		{size: 512, label: 512},
+		{size: 513, label: 16384},
+		{size: 16384, label: 16384},
+		{size: 16385, label: math.MaxInt64},
+	}
+
+	for _, c := range cases {
+		if label, _ := b.label(b.bucket(c.size)); label != c.label {
+			t.Fatalf("size %d: expected label %d but got %d", c.size, c.label, label)
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	t.Parallel()
+
+	if reads, bytes, ok := (&config{sampleRate: 1}).sample(100); !ok || reads != 1 || bytes != 100 {
+		t.Fatalf("expected every read to be recorded unscaled but got %v with %d reads of %d bytes", ok, reads, bytes)
+	}
+
+	cfg := &config{sampleRate: 8}
+	recorded := 0
+	for i := 0; i < 1000; i++ {
+		reads, bytes, ok := cfg.sample(100)
+		if !ok {
+			continue
+		}
+		recorded++
+		if reads != 8 || bytes != 800 {
+			t.Fatalf("expected the read to stand for 8 reads of 800 bytes but got %d reads of %d bytes", reads, bytes)
+		}
+	}
+	if recorded == 0 || recorded == 1000 {
+		t.Fatalf("expected some but not all reads to be recorded but got %d", recorded)
+	}
+}
+
+func TestByteSampleRate(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{byteRate: 64 * 1024}
+
+	const (
+		reads = 100000
+		size  = 4096
+	)
+	var total int64
+	for i := 0; i < reads; i++ {
+		if _, bytes, ok := cfg.sample(size); ok {
+			total += bytes
+		}
+	}
+
+	// The estimate should be within 5% of the actual number of bytes read.
+	if actual := int64(reads * size); math.Abs(float64(total-actual)) > 0.05*float64(actual) {
+		t.Fatalf("expected an estimate close to %d but got %d", actual, total)
+	}
+}
+
+func TestGoroutineID(t *testing.T) {
+	t.Parallel()
+
+	ids := make(chan uint64, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ids <- goroutineID()
+		}()
+	}
+
+	a, b := <-ids, <-ids
+	if a == 0 || b == 0 || a == b {
+		t.Fatalf("expected distinct non-zero goroutine IDs but got %d and %d", a, b)
+	}
+}
+
+func TestShardedStacks(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithShards(4))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	stacks := [][]uintptr{{1, 2, 3}, {4, 5}, {6}, {7, 8, 9, 10}, {11, 12}}
+	for _, pcs := range stacks {
+		h := hashStack(pcs)
+		sh, i := p.shardFor(h)
+		k := sampleKey{stack: stackID(i, sh.stacks.insert(h, pcs))}
+		sh.samples[k] = &sampleValue{reads: 1}
+		p.numSamples.Add(1)
+	}
+
+	samples, index := p.swapSamples()
+	if len(samples) != len(stacks) {
+		t.Fatalf("expected %d samples but got %d", len(stacks), len(samples))
+	}
+
+	seen := map[string]bool{}
+	for k := range samples {
+		seen[fmt.Sprint(index.pcs(k.stack))] = true
+	}
+	for _, pcs := range stacks {
+		if !seen[fmt.Sprint(pcs)] {
+			t.Fatalf("stack %v was not resolved", pcs)
+		}
+	}
+}
+
+func TestBuilderReuse(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler()
+	build := func(stacks ...[]uintptr) map[uint64]bool {
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for i, pcs := range stacks {
+			h := hashStack(pcs)
+			sh, n := p.shardFor(h)
+			k := sampleKey{stack: stackID(n, sh.stacks.insert(h, pcs)), sizeBucket: uint8(i), truncated: true}
+			sh.samples[k] = &sampleValue{reads: 1}
+			p.numSamples.Add(1)
+		}
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addrs := map[uint64]bool{}
+		for _, s := range prof.Sample {
+			if len(s.Value) != numValues || s.Value[0] != 1 {
+				t.Fatalf("unexpected values %v", s.Value)
+			}
+			for _, idx := range s.LocationIndex {
+				if idx == 0 || idx > uint64(len(prof.Location)) {
+					t.Fatalf("location index %d out of range", idx)
+				}
+				addrs[prof.Location[idx-1].Address] = true
+			}
+		}
+		return addrs
+	}
+
+	first := build([]uintptr{1, 2, 3}, []uintptr{3, 4})
+	second := build([]uintptr{5, 6})
+	for _, addr := range []uint64{1, 2, 3, 4} {
+		if !first[addr] || second[addr] {
+			t.Fatalf("address %d leaked between profiles", addr)
+		}
+	}
+	if !second[5] || !second[6] {
+		t.Fatalf("expected addresses 5 and 6 but got %v", second)
+	}
+}
+
+func TestSampleKeySize(t *testing.T) {
+	t.Parallel()
+
+	if size := unsafe.Sizeof(sampleKey{}); size > 40 {
+		t.Fatalf("expected sample keys of at most 40 bytes but got %d", size)
+	}
+	if hashStack([]uintptr{1, 2}) == hashStack([]uintptr{2, 1}) {
+		t.Fatal("expected different hashes for different stacks")
+	}
+	if hashStack([]uintptr{1, 2}) != hashStack([]uintptr{1, 2}) {
+		t.Fatal("expected equal hashes for equal stacks")
+	}
+}
+
+func TestBuildParallel(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithShards(4))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		pcs := []uintptr{uintptr(i%50 + 1), uintptr(i%7 + 100), 1000}
+		h := hashStack(pcs)
+		sh, n := p.shardFor(h)
+		k := sampleKey{
+			stack:      stackID(n, sh.stacks.insert(h, pcs)),
+			sizeBucket: uint8(i % 3),
+			labels:     Labels("shard", fmt.Sprint(i%5)).encode(),
+			goroutine:  uint64(i % 11),
+			truncated:  i%13 == 0,
+		}
+		if v, ok := sh.samples[k]; ok {
+			v.reads++
+			continue
+		}
+		sh.samples[k] = &sampleValue{reads: 1, bytes: int64(i)}
+		p.numSamples.Add(1)
+	}
+	samples, stacks := p.swapSamples()
+
+	describe := func(prof *profile.Profile) []string {
+		var res []string
+		for _, s := range prof.Sample {
+			var b strings.Builder
+			for _, idx := range s.LocationIndex {
+				loc := prof.Location[idx-1]
+				if loc.Id != idx {
+					t.Fatalf("location %d has ID %d", idx, loc.Id)
+				}
+				if len(loc.Line) > 0 {
+					fmt.Fprintf(&b, "%s;", prof.StringTable[prof.Function[loc.Line[0].FunctionIndex-1].Name])
+				} else {
+					fmt.Fprintf(&b, "%d;", loc.Address)
+				}
+			}
+			fmt.Fprint(&b, s.Value)
+			for _, l := range s.Label {
+				fmt.Fprintf(&b, " %s=%s%d", prof.StringTable[l.Key], prof.StringTable[l.Str], l.Num)
+			}
+			res = append(res, b.String())
+		}
+		slices.Sort(res)
+		return res
+	}
+
+	for _, sizeFrames := range []bool{false, true} {
+		cfg := p.cfg
+		cfg.sizeFrames = sizeFrames
+		serial := newProfileBuilder(&cfg, 0, 0)
+		serial.buildSerial(samples, stacks)
+		parallel := newProfileBuilder(&cfg, 0, 0)
+		parallel.buildParallel(samples, stacks, 4)
+
+		want, got := describe(serial.p), describe(parallel.p)
+		if !slices.Equal(want, got) {
+			t.Fatalf("size frames %v: parallel build differs from serial build:\n%v\n%v", sizeFrames, got, want)
+		}
+		if len(serial.p.Location) != len(parallel.p.Location) {
+			t.Fatalf("size frames %v: expected %d locations but got %d", sizeFrames, len(serial.p.Location), len(parallel.p.Location))
+		}
+	}
+}
+
+func TestSizeFrameName(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		buckets sizeBuckets
+		bucket  uint8
+		want    string
+	}{
+		{powerOfTwoBuckets{}, 0, "bytes:[0-1]"},
+		{powerOfTwoBuckets{}, 13, "bytes:[4097-8192]"},
+		{boundedBuckets{bounds: []int{512, 4096}}, 1, "bytes:[513-4096]"},
+		{boundedBuckets{bounds: []int{512, 4096}}, 2, "bytes:[4097-]"},
+		{noSizeBuckets{}, 0, ""},
+	} {
+		if got, _ := sizeFrameName(tc.buckets, tc.bucket); got != tc.want {
+			t.Errorf("bucket %d: expected %q but got %q", tc.bucket, tc.want, got)
+		}
+	}
+}
+
+// checkValid checks that prof is a valid pprof profile.
+func checkValid(t *testing.T, prof *profile.Profile) {
+	t.Helper()
+
+	data, err := protobuf.Marshal(prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := pprof.ParseData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range parsed.Location {
+		if loc.Address != 0 && loc.Mapping == nil {
+			t.Fatalf("location %d at %#x has no mapping", loc.ID, loc.Address)
+		}
+	}
+}
+
+func TestWellFormedProfiles(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithMaxStackDepth(2))
+	build := func(stacks ...[]uintptr) *profile.Profile {
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for _, pcs := range stacks {
+			h := hashStack(pcs)
+			sh, n := p.shardFor(h)
+			k := sampleKey{stack: stackID(n, sh.stacks.insert(h, pcs)), truncated: len(pcs) > 2}
+			sh.samples[k] = &sampleValue{reads: 1}
+			p.numSamples.Add(1)
+		}
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prof
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		prof := build()
+		if len(prof.Mapping) == 0 {
+			t.Fatal("expected a mapping")
+		}
+		checkValid(t, prof)
+	})
+	t.Run("unmapped addresses", func(t *testing.T) {
+		// Addresses this low are never mapped.
+		checkValid(t, build([]uintptr{1, 2}, []uintptr{2, 3, 4}))
+	})
+	t.Run("no mappings", func(t *testing.T) {
+		b := newProfileBuilder(&p.cfg, 1, 1)
+		b.p.Mapping = nil
+		b.build(map[sampleKey]*sampleValue{}, nil)
+		if len(b.p.Mapping) != 1 || b.p.Mapping[0].Id != 1 {
+			t.Fatal("expected the fake mapping")
+		}
+		checkValid(t, b.p)
+	})
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	t.Parallel()
+
+	build := func(shards int, stacks [][]uintptr) []byte {
+		p := NewProfiler(WithCanonicalOrder(), WithShards(shards))
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for i, pcs := range stacks {
+			h := hashStack(pcs)
+			sh, n := p.shardFor(h)
+			k := sampleKey{
+				stack:      stackID(n, sh.stacks.insert(h, pcs)),
+				sizeBucket: uint8(pcs[0] % 3),
+				labels:     Labels("table", fmt.Sprint(pcs[0]%2)).encode(),
+			}
+			sh.samples[k] = &sampleValue{reads: int64(i + 1)}
+			p.numSamples.Add(1)
+		}
+		samples, index := p.swapSamples()
+
+		b := newProfileBuilder(&p.cfg, 1, 1)
+		data, err := protobuf.Marshal(b.build(samples, index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	stacks := [][]uintptr{{1, 2, 3}, {4, 5}, {6}, {7, 8, 9, 10}, {11, 12}, {3, 2, 1}}
+	want := build(1, stacks)
+	for i := 0; i < 5; i++ {
+		if got := build(4, stacks); !bytes.Equal(got, want) {
+			t.Fatal("expected identical samples to produce identical profiles")
+		}
+	}
+}
+
+func TestMachOBuildID(t *testing.T) {
+	t.Parallel()
+
+	le := binary.LittleEndian
+	header := make([]byte, 32)
+	le.PutUint32(header[0:], 0xfeedfacf)
+	le.PutUint32(header[16:], 2) // ncmds
+	other := make([]byte, 16)
+	le.PutUint32(other[0:], 0x2) // LC_SYMTAB
+	le.PutUint32(other[4:], uint32(len(other)))
+	uuid := make([]byte, 24)
+	le.PutUint32(uuid[0:], 0x1b) // LC_UUID
+	le.PutUint32(uuid[4:], uint32(len(uuid)))
+	for i := range uuid[8:] {
+		uuid[8+i] = byte(i)
+	}
+
+	file := filepath.Join(t.TempDir(), "binary")
+	if err := os.WriteFile(file, slices.Concat(header, other, uuid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := machoBuildID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "000102030405060708090a0b0c0d0e0f" {
+		t.Fatalf("unexpected build ID %q", id)
+	}
+
+	if _, err := machoBuildID(os.Args[0]); err == nil && runtime.GOOS != "darwin" {
+		t.Fatal("expected an error for a binary that isn't Mach-O")
+	}
+}
+
+func TestSymbolize(t *testing.T) {
+	t.Parallel()
+
+	pcs := make([]uintptr, 8)
+	pcs = pcs[:runtime.Callers(1, pcs)]
+	h := hashStack(pcs)
+	var stacks stackTable
+	k := sampleKey{stack: stackID(0, stacks.insert(h, pcs)), truncated: true}
+
+	p := NewProfiler()
+	b := newProfileBuilder(&p.cfg, 1, 1)
+	b.symbolize = true
+	prof := b.build(map[sampleKey]*sampleValue{k: {reads: 1}}, stackIndex{stacks.list})
+	checkValid(t, prof)
+
+	var found bool
+	for _, loc := range prof.Location {
+		if len(loc.Line) == 0 {
+			t.Fatalf("location %d was not symbolized", loc.Id)
+		}
+		for _, line := range loc.Line {
+			fn := prof.Function[line.FunctionIndex-1]
+			if prof.StringTable[fn.Name] == "github.com/polarsignals/rprof.TestSymbolize" {
+				found = line.Line > 0 && strings.HasSuffix(prof.StringTable[fn.Filename], "rprof_test.go")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected a frame of the test")
+	}
+}
+
+func TestParseProcSelfMaps(t *testing.T) {
+	t.Parallel()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fmt.Sprintf(`00400000-0040b000 r-xp 00000000 fc:01 787766                             %s
+0060a000-0060b000 r--p 0000a000 fc:01 787766                             %s
+0040b000-0040c000 r-xp 00000000 00:00 0
+7f7d76000000-7f7d76100000 r-xp 00000000 00:00 0
+7f7d7797c000-7f7d77b36000 r-xp 00000000 fc:01 1180226                    /lib/missing.so (deleted)
+7ffc34343000-7ffc34345000 r-xp 00000000 00:00 0                          [vdso]
+ffffffffff600000-ffffffffff601000 r-xp 00000000 00:00 0                  [vsyscall]
+`, exe, exe)
+
+	type mapping struct {
+		lo            uint64
+		file, buildID string
+	}
+	var got []mapping
+	parseProcSelfMaps([]byte(data), func(lo, hi, offset uint64, file, buildID string) {
+		got = append(got, mapping{lo, file, buildID})
+	})
+
+	want := []mapping{
+		{0x400000, exe, ""},
+		// The anonymous mapping right after the binary is skipped.
+		{0x7f7d76000000, "[anon]", ""},
+		{0x7f7d7797c000, "/lib/missing.so", ""},
+		{0x7ffc34343000, "[vdso]", ""},
+		{0xffffffffff600000, "[vsyscall]", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d mappings but got %v", len(want), got)
+	}
+	if got[0].buildID == "" {
+		t.Fatal("expected the build ID of the test binary")
+	}
+	got[0].buildID = ""
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected mappings %v but got %v", want, got)
+	}
+}
+
+func TestQUICStreamType(t *testing.T) {
+	t.Parallel()
+
+	for id, want := range map[int64]string{
+		0:  "client-bidi",
+		1:  "server-bidi",
+		2:  "client-uni",
+		3:  "server-uni",
+		12: "client-bidi",
+		7:  "server-uni",
+	} {
+		if got := quicStreamType(id); got != want {
+			t.Errorf("stream %d: expected %s but got %s", id, want, got)
+		}
+	}
+}
+
+func TestAdaptiveSampling(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithAdaptiveSampling(100))
+	a := p.cfg.adaptive
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10000; i++ {
+		if rate := a.rate(start); rate != 1 {
+			t.Fatalf("expected every read to be recorded in the first second but got a rate of %d", rate)
+		}
+	}
+	if rate := a.rate(start.Add(time.Second)); rate != 100 {
+		t.Fatalf("expected a rate of 100 after 10000 reads but got %d", rate)
+	}
+	if rate := a.rate(start.Add(2 * time.Second)); rate != 1 {
+		t.Fatalf("expected a rate of 1 after a single read but got %d", rate)
+	}
+	if rate := a.rate(start.Add(10 * time.Second)); rate != 1 {
+		t.Fatalf("expected a rate of 1 after idling but got %d", rate)
+	}
+}
+
+func TestOverheadLimit(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithOverheadLimit(0.01))
+	l := p.cfg.limiter
+	procs := int64(runtime.GOMAXPROCS(0))
+	start := time.Unix(1000, 0)
+
+	l.tick(start, &p.overhead)
+	for i := 1; i <= 3; i++ {
+		// Spend 2% of the CPU time recording.
+		p.overhead.recordNanos.Add(int64(20*time.Millisecond) * procs)
+		l.tick(start.Add(time.Duration(i)*time.Second), &p.overhead)
+	}
+	if !l.stackless() || l.rate() != 16 {
+		t.Fatalf("expected stackless recording of one in 16 reads but got stackless %v and rate %d", l.stackless(), l.rate())
+	}
+
+	l.tick(start.Add(4*time.Second), &p.overhead)
+	if l.rate() != 4 {
+		t.Fatalf("expected a rate of 4 after an idle second but got %d", l.rate())
+	}
+
+	b := newProfileBuilder(&p.cfg, start.UnixNano(), int64(10*time.Second))
+	if len(b.p.Comment) != 4 {
+		t.Fatalf("expected 4 degradation comments but got %d", len(b.p.Comment))
+	}
+	if c := b.p.StringTable[b.p.Comment[0]]; !strings.Contains(c, "stopped walking stacks at") {
+		t.Fatalf("unexpected comment %q", c)
+	}
+}
+
+func TestStacksResetWithSamples(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithShards(1))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	sh := &p.shards[0]
+	pcs := []uintptr{1, 2, 3}
+	p.addSample(sh.samples, &sh.stacks, 0, sampleKey{}, hashStack(pcs), pcs, sampleValue{reads: 1})
+	if len(sh.stacks.list) != 2 {
+		t.Fatalf("expected the stack to be interned but got %d stacks", len(sh.stacks.list))
+	}
+
+	p.Reset()
+	if len(sh.stacks.list) != 0 || p.memory() != 0 {
+		t.Fatalf("expected the stacks to be reset but got %d stacks of %d bytes", len(sh.stacks.list), p.memory())
+	}
+}
+
+func TestMergeSnapshots(t *testing.T) {
+	t.Parallel()
+
+	// Both windows intern their stack with the same ID.
+	window := func(pcs ...uintptr) Snapshot {
+		var stacks stackTable
+		id := stackID(0, stacks.insert(hashStack(pcs), pcs))
+		return Snapshot{
+			cfg:     &config{},
+			samples: map[sampleKey]*sampleValue{{stack: id}: {reads: 1}},
+			stacks:  stackIndex{stacks.list},
+		}
+	}
+	m := mergeSnapshots([]Snapshot{window(1, 2), window(3, 4), window(1, 2)})
+
+	reads := map[string]int64{}
+	for k, v := range m.samples {
+		reads[fmt.Sprint(m.stacks.pcs(k.stack))] += v.reads
+	}
+	if len(m.samples) != 2 || reads["[1 2]"] != 2 || reads["[3 4]"] != 1 {
+		t.Fatalf("unexpected merged samples %v", reads)
+	}
+}
+
+func TestStoppedReadsNotRecorded(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithValueTypes(ValueType{Type: "decoded", Unit: "count"}))
+	calls := 0
+	r := p.Reader(strings.NewReader("hello"), WithBatching(10, 0), WithReadValues(func(n int, values []int64) {
+		calls++
+	})).(*RprofReader)
+
+	ev := p.read(r.r, make([]byte, 2), &r.cfg, &r.eof)
+	if ev.n != 2 || ev.latency != 0 {
+		t.Fatalf("expected an untimed read of 2 bytes but got %d bytes in %v", ev.n, ev.latency)
+	}
+	if _, err := r.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 || r.cfg.batch.pending.ev.batched != 0 {
+		t.Fatalf("expected no values or batched reads while stopped but got %d calls and %d batched reads", calls, r.cfg.batch.pending.ev.batched)
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || r.cfg.batch.pending.ev.batched != 1 {
+		t.Fatalf("expected the read to be valued and batched once started but got %d calls and %d batched reads", calls, r.cfg.batch.pending.ev.batched)
+	}
+}
+
+func TestLocalBuffersEnabled(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler(WithLocalBuffers(), WithShards(1))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if _, err := io.ReadAll(p.Reader(strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.buffers) == 0 || len(p.shards[0].samples) != 0 {
+		t.Fatalf("expected the samples to be recorded in local buffers but got %d buffers and %d shard samples", len(p.buffers), len(p.shards[0].samples))
+	}
+}
+
+func TestAutoStart(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "{{.PID}}.pb.gz")
+
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		started bool
+		err     string
+	}{
+		{name: "unset"},
+		{name: "disabled", env: map[string]string{EnvEnable: "false"}},
+		{name: "invalid enable", env: map[string]string{EnvEnable: "yes"}, err: "parse RPROF_ENABLE"},
+		{name: "invalid interval", env: map[string]string{EnvEnable: "1", EnvInterval: "soon"}, err: "parse RPROF_INTERVAL"},
+		{name: "negative interval", env: map[string]string{EnvEnable: "1", EnvInterval: "-1s"}, err: "RPROF_INTERVAL must be positive"},
+		{name: "invalid output", env: map[string]string{EnvEnable: "1", EnvOutput: "{{.PID"}, err: "parse RPROF_OUTPUT"},
+		{name: "defaults", env: map[string]string{EnvEnable: "true"}, started: true},
+		{name: "configured", env: map[string]string{EnvEnable: "1", EnvInterval: "10ms", EnvOutput: output}, started: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := autoStart(func(key string) string {
+				return tc.env[key]
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q but got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if started := profiler.started.Load(); started != tc.started {
+				t.Fatalf("expected started %v but got %v", tc.started, started)
+			}
+			if tc.started {
+				defer profiler.Stop()
+			}
+			if tc.env[EnvOutput] == "" || !tc.started {
+				return
+			}
+
+			// The first window is written after the interval.
+			path := filepath.Join(dir, fmt.Sprintf("%d.pb.gz", os.Getpid()))
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				if _, err := os.Stat(path); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("expected a window to be written to %s", path)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBuffer(nil)
+	logger := slog.New(slog.NewJSONHandler(buf, nil))
+	p := NewProfiler()
+	p.logSummary(logger)
+	if buf.Len() != 0 {
+		t.Fatalf("expected no summary of a stopped profiler but got %s", buf.String())
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if _, err := io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 1000)))); err != nil {
+		t.Fatal(err)
+	}
+	p.logSummary(logger)
+
+	var summary struct {
+		Msg       string
+		Reads     int64
+		Bytes     int64
+		TopBucket int64 `json:"top_bucket"`
+		TopStacks map[string]struct {
+			Bytes int64
+			Reads int64
+			Stack []string
+		} `json:"top_stacks"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Msg != "rprof summary" || summary.Bytes != 1000 || summary.Reads == 0 || summary.TopBucket == 0 {
+		t.Fatalf("unexpected summary: %s", buf.String())
+	}
+	top, ok := summary.TopStacks["1"]
+	if !ok || len(summary.TopStacks) != 1 || top.Bytes != 1000 || top.Reads != summary.Reads {
+		t.Fatalf("expected a single top stack of all reads but got %s", buf.String())
+	}
+	if !strings.Contains(top.Stack[0], "io.ReadAll") {
+		t.Fatalf("expected the stack to start at io.ReadAll but got %v", top.Stack)
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1000, 0)
+	th := threshold{bytesPerSecond: 100, lastTime: start}
+	for i, tc := range []struct {
+		total int64
+		fired bool
+	}{
+		// At the threshold.
+		{total: 100},
+		// Above it, fires once.
+		{total: 300, fired: true},
+		{total: 500},
+		// Back below it.
+		{total: 550},
+		// Above it again.
+		{total: 1000, fired: true},
+	} {
+		if fired := th.tick(start.Add(time.Duration(i+1)*time.Second), tc.total); fired != tc.fired {
+			t.Fatalf("tick %d: expected fired %v but got %v", i, tc.fired, fired)
+		}
+	}
+}
+
+func TestTotalBytesOnlyWithThreshold(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler()
+	if _, err := io.ReadAll(p.Reader(strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.totalBytes.Load(); n != 0 {
+		t.Fatalf("expected no bytes to be counted without a threshold but got %d", n)
+	}
+
+	stop := p.OnThreshold(1<<30, func(Snapshot) {})
+	if _, err := io.ReadAll(p.Reader(strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if n := p.totalBytes.Load(); n != 5 {
+		t.Fatalf("expected 5 bytes to be counted with a threshold but got %d", n)
+	}
+}
+
+func TestLogSummariesInterval(t *testing.T) {
+	t.Parallel()
+
+	p := NewProfiler()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := p.LogSummaries(slog.Default(), interval); err == nil {
+			t.Fatalf("expected error for an interval of %v", interval)
+		}
+	}
+	stop, err := p.LogSummaries(slog.Default(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+}
@@ -0,0 +1,199 @@
+// Package rproftest provides helpers to profile the reads of tests and
+// benchmarks with rprof, and to assert on them.
+package rproftest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	protobuf "google.golang.org/protobuf/proto"
+
+	"github.com/polarsignals/rprof"
+)
+
+const (
+	// topStacks is the number of stacks logged by Profile.
+	topStacks = 5
+	// assertStacks is the number of stacks listed by a failed assertion.
+	assertStacks = 5
+)
+
+// Profile starts p, or the default profiler if p is nil, for the duration of
+// the test and stops it in the test's cleanup, writing the profile to
+// rprof.pb.gz in the test's artifact directory, or a new temporary directory
+// if the version of Go doesn't have them. The path of the profile is logged,
+// and so are the stacks that read the most bytes if the tests run with -v. If
+// a read budget is set and was exceeded the test fails. As the profiler can
+// only be started once, tests using the same profiler can't run in parallel.
+func Profile(t testing.TB, p *rprof.Rprof) {
+	t.Helper()
+	p = profiler(p)
+	if err := p.Start(); err != nil {
+		t.Fatalf("rprof: starting the profiler: %v", err)
+	}
+
+	t.Cleanup(func() {
+		var top []rprof.StackSummary
+		if testing.Verbose() {
+			top = p.Stacks(topStacks, rprof.MetricBytes)
+		}
+
+		prof, err := p.Stop()
+		var budgetErr *rprof.BudgetError
+		if errors.As(err, &budgetErr) {
+			t.Error(err)
+		} else if err != nil {
+			t.Errorf("rprof: stopping the profiler: %v", err)
+			return
+		}
+
+		path, err := writeProfile(t, prof)
+		if err != nil {
+			t.Errorf("rprof: writing the profile: %v", err)
+			return
+		}
+		t.Logf("rprof: profile written to %s", path)
+
+		for i, s := range top {
+			t.Logf("rprof: #%d: %d bytes in %d reads:\n\t%s", i+1, s.Bytes, s.Reads, strings.Join(s.Frames, "\n\t"))
+		}
+	})
+}
+
+// writeProfile writes the profile of the test to its artifact directory and
+// returns the path of the file.
+func writeProfile(t testing.TB, prof *proto.Profile) (string, error) {
+	var dir string
+	if a, ok := t.(interface{ ArtifactDir() string }); ok {
+		dir = a.ArtifactDir()
+	} else {
+		var err error
+		// Subtest names contain slashes.
+		dir, err = os.MkdirTemp("", "rprof-"+strings.ReplaceAll(t.Name(), "/", "_")+"-")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	content, err := protobuf.Marshal(prof)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(content); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "rprof.pb.gz")
+	return path, os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// ReportBenchmark profiles the benchmark with p, or the default profiler if p
+// is nil, and reports the bytes read and the reads per operation as the
+// read-B/op and reads/op metrics, so they are compared by benchstat. The reads
+// performed from the call until the benchmark function returns are counted,
+// so it should be called once the benchmark is set up, right before its loop.
+func ReportBenchmark(b *testing.B, p *rprof.Rprof) {
+	b.Helper()
+	p = profiler(p)
+	if err := p.Start(); err != nil {
+		b.Fatalf("rprof: starting the profiler: %v", err)
+	}
+
+	b.Cleanup(func() {
+		prof, err := p.Stop()
+		var budgetErr *rprof.BudgetError
+		if errors.As(err, &budgetErr) {
+			b.Error(err)
+		} else if err != nil {
+			b.Errorf("rprof: stopping the profiler: %v", err)
+			return
+		}
+		if b.N == 0 {
+			return
+		}
+
+		reads, read := totals(prof)
+		b.ReportMetric(float64(read)/float64(b.N), "read-B/op")
+		b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+	})
+}
+
+// AssertMaxBytes runs fn with a new profiler and fails the test if more than
+// limit bytes were read through the readers fn wraps with it. The failure
+// lists the stacks that read the most bytes.
+func AssertMaxBytes(t testing.TB, fn func(p *rprof.Rprof), limit int64) {
+	t.Helper()
+	assertMax(t, fn, limit, rprof.MetricBytes)
+}
+
+// AssertMaxReads runs fn with a new profiler and fails the test if more than
+// limit reads were performed on the readers fn wraps with it. The failure
+// lists the stacks that performed the most reads.
+func AssertMaxReads(t testing.TB, fn func(p *rprof.Rprof), limit int64) {
+	t.Helper()
+	assertMax(t, fn, limit, rprof.MetricReads)
+}
+
+// assertMax runs fn with a new profiler and fails the test if the total of
+// the given metric exceeds limit.
+func assertMax(t testing.TB, fn func(p *rprof.Rprof), limit int64, by rprof.Metric) {
+	t.Helper()
+	p := rprof.NewProfiler()
+	if err := p.Start(); err != nil {
+		t.Fatalf("rprof: starting the profiler: %v", err)
+	}
+	fn(p)
+	top := p.Stacks(assertStacks, by)
+	prof, err := p.Stop()
+	if err != nil {
+		t.Fatalf("rprof: stopping the profiler: %v", err)
+	}
+
+	reads, read := totals(prof)
+	total, unit := read, "bytes read"
+	if by == rprof.MetricReads {
+		total, unit = reads, "reads"
+	}
+	if total <= limit {
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "rprof: %d %s, more than the limit of %d; top stacks:", total, unit, limit)
+	for _, s := range top {
+		fmt.Fprintf(&sb, "\n%d bytes in %d reads:", s.Bytes, s.Reads)
+		for _, f := range s.Frames {
+			sb.WriteString("\n\t")
+			sb.WriteString(f)
+		}
+	}
+	t.Error(sb.String())
+}
+
+// totals returns the number of reads and of bytes read in the profile.
+func totals(prof *proto.Profile) (reads, read int64) {
+	for _, s := range prof.Sample {
+		reads += s.Value[0]
+		read += s.Value[1]
+	}
+	return reads, read
+}
+
+// profiler returns p, or the default profiler if p is nil.
+func profiler(p *rprof.Rprof) *rprof.Rprof {
+	if p == nil {
+		return rprof.Default()
+	}
+	return p
+}
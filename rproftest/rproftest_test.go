@@ -0,0 +1,128 @@
+package rproftest_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	profile "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/polarsignals/rprof"
+	"github.com/polarsignals/rprof/rproftest"
+)
+
+func readAll(r io.Reader) error {
+	_, err := io.ReadAll(r)
+	return err
+}
+
+// artifactTB is a test with an artifact directory, as tests have since Go
+// 1.26.
+type artifactTB struct {
+	testing.TB
+	dir string
+}
+
+func (t artifactTB) ArtifactDir() string {
+	return t.dir
+}
+
+func TestProfile(t *testing.T) {
+	p := rprof.NewProfiler()
+	dir := t.TempDir()
+	t.Run("profiled", func(t *testing.T) {
+		rproftest.Profile(artifactTB{TB: t, dir: dir}, p)
+		readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+	})
+
+	f, err := os.Open(filepath.Join(dir, "rprof.pb.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := &profile.Profile{}
+	if err := proto.Unmarshal(data, prof); err != nil {
+		t.Fatal(err)
+	}
+	var bytesRead int64
+	for _, s := range prof.Sample {
+		bytesRead += s.Value[1]
+	}
+	if bytesRead != 1024 {
+		t.Fatalf("expected 1024 bytes but got %d", bytesRead)
+	}
+
+	if _, err := p.Stop(); err == nil {
+		t.Fatal("expected the profiler to be stopped")
+	}
+}
+
+func TestReportBenchmark(t *testing.T) {
+	p := rprof.NewProfiler()
+	res := testing.Benchmark(func(b *testing.B) {
+		data := make([]byte, 1024)
+		rproftest.ReportBenchmark(b, p)
+		for range b.N {
+			readAll(p.Reader(bytes.NewReader(data)))
+		}
+	})
+
+	if got := res.Extra["read-B/op"]; got != 1024 {
+		t.Errorf("expected 1024 read-B/op but got %v", got)
+	}
+	// io.ReadAll reads until it gets io.EOF.
+	if got := res.Extra["reads/op"]; got < 2 {
+		t.Errorf("expected at least 2 reads/op but got %v", got)
+	}
+}
+
+// errorTB is a test that records its errors instead of failing.
+type errorTB struct {
+	testing.TB
+	errs []string
+}
+
+func (t *errorTB) Error(args ...any) {
+	t.errs = append(t.errs, fmt.Sprint(args...))
+}
+
+func TestAssertMax(t *testing.T) {
+	read := func(p *rprof.Rprof) {
+		readAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+	}
+
+	tb := &errorTB{TB: t}
+	rproftest.AssertMaxBytes(tb, read, 1024)
+	rproftest.AssertMaxReads(tb, read, 100)
+	if len(tb.errs) != 0 {
+		t.Fatalf("expected no errors but got %v", tb.errs)
+	}
+
+	rproftest.AssertMaxBytes(tb, read, 1000)
+	rproftest.AssertMaxReads(tb, read, 1)
+	if len(tb.errs) != 2 {
+		t.Fatalf("expected 2 errors but got %v", tb.errs)
+	}
+	for _, err := range tb.errs {
+		if !strings.Contains(err, "readAll") {
+			t.Errorf("expected the error to list the reading stack but got %q", err)
+		}
+	}
+	if !strings.HasPrefix(tb.errs[0], "rprof: 1024 bytes read, more than the limit of 1000") {
+		t.Errorf("unexpected error %q", tb.errs[0])
+	}
+}
@@ -0,0 +1,109 @@
+package rprof
+
+import (
+	"time"
+)
+
+// Sample is the aggregate of the reads sharing a stack, size bucket and
+// labels, as collected by a profiler, before it is turned into a profile.
+type Sample struct {
+	// Stack are the PCs of the stack, leaf first. It is nil in stackless
+	// mode and for the sample of dropped reads.
+	Stack []uintptr
+	// Truncated is true if the stack was deeper than the maximum depth and
+	// truncated.
+	Truncated bool
+	// Dropped is true for the sample aggregating the reads dropped once the
+	// maximum number of samples was reached.
+	Dropped bool
+	// Size is the upper bound in bytes of the size bucket of the reads, 0
+	// if reads are not bucketed or the sample isn't of reads, such as that
+	// of closes.
+	Size int64
+	// Labels are the labels of the reader, with numeric labels formatted as
+	// decimal strings. It must not be modified.
+	Labels map[string]string
+	// Goroutine is the ID of the reading goroutine if goroutine labels are
+	// enabled, 0 otherwise.
+	Goroutine uint64
+	// Time is the start of the time bucket if time buckets are enabled, the
+	// zero time otherwise.
+	Time time.Time
+
+	Reads     int64
+	Bytes     int64
+	Latency   time.Duration
+	Errors    int64
+	EOF       int64
+	Abandoned int64
+	Requested int64
+	Closes    int64
+	Leaked    int64
+	// Extra are the values of the additional sample types, in the order of
+	// WithValueTypes.
+	Extra [MaxValueTypes]int64
+}
+
+// Samples calls fn with each sample of the default profiler. See
+// Rprof.Samples.
+func Samples(fn func(Sample) bool) {
+	profiler.Samples(fn)
+}
+
+// Samples calls fn with each sample collected so far, in no particular
+// order, until fn returns false. It allows custom exporters and analyses of
+// the aggregated data without building a profile. If the profiler is not
+// running fn isn't called.
+func (p *Rprof) Samples(fn func(Sample) bool) {
+	s, _ := p.takeSnapshot()
+	s.Samples(fn)
+}
+
+// Samples calls fn with each sample in the snapshot, in no particular order,
+// until fn returns false.
+func (s Snapshot) Samples(fn func(Sample) bool) {
+	if s.cfg == nil {
+		return
+	}
+
+	buckets := s.cfg.buckets()
+	labels := map[string]map[string]string{}
+	for k, v := range s.samples {
+		l, ok := labels[k.labels]
+		if !ok && k.labels != "" {
+			l = map[string]string{}
+			decodeLabels(k.labels, func(lb label) {
+				l[lb.key] = lb.stringValue()
+			})
+			labels[k.labels] = l
+		}
+
+		sample := Sample{
+			Stack:     s.stacks.pcs(k.stack),
+			Truncated: k.truncated,
+			Dropped:   k.dropped,
+			Labels:    l,
+			Goroutine: k.goroutine,
+			Reads:     v.reads,
+			Bytes:     v.bytes,
+			Latency:   time.Duration(v.latency),
+			Errors:    v.errors,
+			EOF:       v.eof,
+			Abandoned: v.abandoned,
+			Requested: v.requested,
+			Closes:    v.closes,
+			Leaked:    v.leaked,
+			Extra:     v.extra,
+		}
+		if num, ok := buckets.label(k.sizeBucket); ok && !k.unsized {
+			sample.Size = num
+		}
+		if k.timeBucket != 0 {
+			sample.Time = time.Unix(0, k.timeBucket)
+		}
+
+		if !fn(sample) {
+			return
+		}
+	}
+}
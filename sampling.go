@@ -0,0 +1,117 @@
+package rprof
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// sample decides whether a read of the given size is recorded. If it is, it
+// returns the number of reads and bytes the read stands for, which are larger
+// than 1 and size when sampling.
+func (c *config) sample(size int) (reads, bytes int64, ok bool) {
+	switch {
+	case c.byteRate > 0:
+		// Probability that at least one of the read's bytes is the one
+		// sampled by a Poisson process with a mean of byteRate bytes.
+		prob := -math.Expm1(-float64(size) / float64(c.byteRate))
+		if rand.Float64() >= prob {
+			return 0, 0, false
+		}
+		return int64(math.Round(1 / prob)), int64(math.Round(float64(size) / prob)), true
+	default:
+		rate := max(c.sampleRate, c.limiter.rate())
+		if c.adaptive != nil {
+			rate = max(rate, c.adaptive.rate(time.Now()))
+		}
+		if rate <= 1 {
+			return 1, int64(size), true
+		}
+		if rand.IntN(rate) != 0 {
+			return 0, 0, false
+		}
+		return int64(rate), int64(size) * int64(rate), true
+	}
+}
+
+// WithAdaptiveSampling records at most about target reads per second by
+// sampling, keeping the cost of walking stacks within a budget without tuning
+// the sample rate per service. Each second, the rate is set such that the
+// reads of the previous second would have been recorded target times, and it
+// returns to recording every read once reads slow down. Values are scaled
+// like with WithSampleRate, which sets the lowest rate if given as well.
+// Byte sampling takes precedence. A target of 0 or less disables adaptive
+// sampling.
+func WithAdaptiveSampling(target int) Option {
+	return func(p *Rprof) {
+		if target <= 0 {
+			p.cfg.adaptive = nil
+			return
+		}
+		a := &adaptiveSampler{target: int64(target)}
+		a.current.Store(1)
+		p.cfg.adaptive = a
+	}
+}
+
+// adaptiveSampler adjusts the sample rate every second to the number of reads
+// in the previous second. See WithAdaptiveSampling.
+type adaptiveSampler struct {
+	target int64
+
+	// second is the current second since the epoch, count the number of
+	// reads within it and current the rate in effect during it.
+	second  atomic.Int64
+	count   atomic.Int64
+	current atomic.Int64
+}
+
+// rate counts a read at the given time and returns the rate to sample it
+// with.
+func (a *adaptiveSampler) rate(now time.Time) int {
+	sec := now.Unix()
+	if cur := a.second.Load(); cur != sec && a.second.CompareAndSwap(cur, sec) {
+		n := a.count.Swap(0)
+		if cur != sec-1 {
+			// Idle for more than a second.
+			n = 0
+		}
+		a.current.Store(max((n+a.target-1)/a.target, 1))
+	}
+	a.count.Add(1)
+	return int(a.current.Load())
+}
+
+// addSampling records the sampling parameters in the profile, so consumers
+// know its values are estimates. Like heap profiles, the period is the mean
+// number of bytes per recorded read with byte sampling, and the number of
+// reads per recorded read with read sampling.
+func (b *profileBuilder) addSampling() {
+	switch {
+	case b.cfg.byteRate > 0:
+		b.p.PeriodType = &proto.ValueType{
+			Type: 3, // "read" in the string table
+			Unit: 4, // "bytes" in the string table
+		}
+		b.p.Period = int64(b.cfg.byteRate)
+		b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+			"rprof: sampled reads of n bytes with probability 1-exp(-n/%d), values are scaled estimates of all reads",
+			b.cfg.byteRate,
+		)))
+	case b.cfg.adaptive != nil:
+		b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+			"rprof: adaptively sampled at most about %d reads per second, values are scaled estimates of all reads",
+			b.cfg.adaptive.target,
+		)))
+	case b.cfg.sampleRate > 1:
+		b.p.Period = int64(b.cfg.sampleRate)
+		b.p.Comment = append(b.p.Comment, b.addString(fmt.Sprintf(
+			"rprof: sampled one in %d reads, values are scaled estimates of all reads",
+			b.cfg.sampleRate,
+		)))
+	}
+}
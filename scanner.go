@@ -0,0 +1,74 @@
+package rprof
+
+import (
+	"bufio"
+	"io"
+)
+
+// Scanner returns a new scanner profiled by the default profiler. See
+// Rprof.Scanner.
+func Scanner(r io.Reader, opts ...WrapOption) *bufio.Scanner {
+	return profiler.Scanner(r, opts...)
+}
+
+// SplitScanner returns a new scanner with the given split function profiled
+// by the default profiler. See Rprof.SplitScanner.
+func SplitScanner(r io.Reader, split bufio.SplitFunc, opts ...WrapOption) *bufio.Scanner {
+	return profiler.SplitScanner(r, split, opts...)
+}
+
+// Scanner returns a new bufio.Scanner reading lines from r. See
+// Rprof.SplitScanner.
+func (p *Rprof) Scanner(r io.Reader, opts ...WrapOption) *bufio.Scanner {
+	return p.SplitScanner(r, bufio.ScanLines, opts...)
+}
+
+// SplitScanner returns a new bufio.Scanner reading tokens from r with the
+// given split function, and profiles the reads of r. The "tokens" sample type,
+// which is added to the profiles of the profiler once a scanner is created,
+// counts the tokens split off the data read, and samples with tokens carry
+// the average number of bytes read per token, delimiters included, as the
+// "token_size" label. Reads are recorded once the scanner is done with their
+// data, so the last read is not recorded if the scanner is abandoned before
+// reaching the end of the data. Calling Split on the scanner stops counting
+// tokens and recording the last read.
+func (p *Rprof) SplitScanner(r io.Reader, split bufio.SplitFunc, opts ...WrapOption) *bufio.Scanner {
+	src := p.newDeferredReader(r, opts)
+	s := bufio.NewScanner(src)
+	s.Split(countTokens(src, split, p.registerValueType(tokensType, &src.cfg)))
+	return s
+}
+
+// tokensType is the sample type of the tokens split off by scanners, with
+// the average number of bytes read per token as label.
+var tokensType = valueType{
+	ValueType: ValueType{Type: "tokens", Unit: "count"},
+	label:     "token_size",
+	unit:      "bytes",
+	derive:    perValue,
+}
+
+// countTokens returns a split function counting the tokens split off by split
+// in the values at index of the pending read of src, unless index is -1. The
+// last read is recorded once the scanner reaches the end of the data.
+func countTokens(src *deferredReader, split bufio.SplitFunc, index int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		if token != nil {
+			src.count(index)
+		}
+		if atEOF && (token == nil && advance == 0 || err != nil) {
+			src.flush()
+		}
+		return advance, token, err
+	}
+}
+
+// perValue returns the average number of bytes read per unit of value, such
+// as per token. It reports false if there is no value or nothing was read.
+func perValue(value, bytes int64) (int64, bool) {
+	if value <= 0 || bytes <= 0 {
+		return 0, false
+	}
+	return bytes / value, true
+}
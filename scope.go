@@ -0,0 +1,159 @@
+package rprof
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Scope is a profiler collecting the reads performed on behalf of a single
+// unit of work, such as a request, in addition to the profiler the readers
+// were created with. Readers created with a context carrying the scope, see
+// ContextWithScope, record into it, which answers what a specific slow
+// request read rather than only what the whole process read.
+type Scope struct {
+	p *Rprof
+
+	once sync.Once
+	snap Snapshot
+}
+
+// NewScope returns a new scope that collects reads until End is called. The
+// scope's profiler is configured with the given options.
+func NewScope(opts ...Option) *Scope {
+	p := NewProfiler(opts...)
+	// A new profiler is never started already.
+	_ = p.Start()
+	return &Scope{p: p}
+}
+
+// Profiler returns the profiler of the scope, which readers that aren't
+// created with the scope's context can be wrapped with directly.
+func (s *Scope) Profiler() *Rprof {
+	return s.p
+}
+
+// End stops collecting reads and returns a snapshot of the reads of the
+// scope, from which the totals, top call sites and a profile can be
+// obtained. Subsequent calls return the same snapshot.
+func (s *Scope) End() Snapshot {
+	s.once.Do(func() {
+		s.snap, _, _ = s.p.stop(nil)
+	})
+	return s.snap
+}
+
+type scopeContextKey struct{}
+
+// ContextWithScope returns a new context carrying the scope. Readers created
+// with context-aware constructors such as ReaderContext using that context,
+// and reads performed with ReadContext using it, are recorded in the scope
+// as well.
+func ContextWithScope(ctx context.Context, s *Scope) context.Context {
+	return context.WithValue(ctx, scopeContextKey{}, s)
+}
+
+// ScopeFromContext returns the scope of ctx, nil if it has none.
+func ScopeFromContext(ctx context.Context) *Scope {
+	s, _ := ctx.Value(scopeContextKey{}).(*Scope)
+	return s
+}
+
+// ScopeOption configures a ScopeHandler.
+type ScopeOption func(*scopeConfig)
+
+// scopeConfig is the configuration of a ScopeHandler.
+type scopeConfig struct {
+	opts     []Option
+	trailers bool
+	finish   []func(*http.Request, Snapshot)
+}
+
+// WithScopeProfilerOptions configures the profilers of the scopes with the
+// given options.
+func WithScopeProfilerOptions(opts ...Option) ScopeOption {
+	return func(cfg *scopeConfig) {
+		cfg.opts = append(cfg.opts, opts...)
+	}
+}
+
+// WithScopeCallback calls fn with the snapshot of the scope of each request
+// once the request is handled.
+func WithScopeCallback(fn func(r *http.Request, s Snapshot)) ScopeOption {
+	return func(cfg *scopeConfig) {
+		cfg.finish = append(cfg.finish, fn)
+	}
+}
+
+// WithScopeTrailers reports the number of reads and the bytes read of each
+// request in the Rprof-Reads and Rprof-Bytes trailers of its response.
+func WithScopeTrailers() ScopeOption {
+	return func(cfg *scopeConfig) {
+		cfg.trailers = true
+	}
+}
+
+// WithScopeLogger logs the number of reads, the bytes read and the top 3
+// call sites by bytes read of each request that read at least minBytes.
+func WithScopeLogger(logger *slog.Logger, minBytes int64) ScopeOption {
+	return WithScopeCallback(func(r *http.Request, s Snapshot) {
+		if s.Bytes < minBytes {
+			return
+		}
+
+		top := s.Top(3, MetricBytes)
+		sites := make([]any, 0, len(top))
+		for i, e := range top {
+			sites = append(sites, slog.Group(strconv.Itoa(i+1),
+				slog.Int64("bytes", e.Bytes),
+				slog.Int64("reads", e.Reads),
+				slog.String("function", e.Function),
+				slog.String("file", e.File),
+				slog.Int("line", e.Line),
+			))
+		}
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "rprof request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Duration("duration", s.Time.Sub(s.Start)),
+			slog.Int64("reads", s.Reads),
+			slog.Int64("bytes", s.Bytes),
+			slog.Group("top", sites...),
+		)
+	})
+}
+
+// ScopeHandler returns a handler that collects the reads of each request to
+// next in its own scope, which it adds to the context of the request. Once
+// next returns the scope is ended and its snapshot is reported as configured
+// by the options.
+func ScopeHandler(next http.Handler, opts ...ScopeOption) http.Handler {
+	var cfg scopeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.trailers {
+			// Trailers are only sent if they are declared before the
+			// header is written.
+			w.Header().Add("Trailer", "Rprof-Reads")
+			w.Header().Add("Trailer", "Rprof-Bytes")
+		}
+
+		s := NewScope(cfg.opts...)
+		next.ServeHTTP(w, r.WithContext(ContextWithScope(r.Context(), s)))
+		snap := s.End()
+
+		if cfg.trailers {
+			w.Header().Set("Rprof-Reads", strconv.FormatInt(snap.Reads, 10))
+			w.Header().Set("Rprof-Bytes", strconv.FormatInt(snap.Bytes, 10))
+		}
+		for _, fn := range cfg.finish {
+			fn(r, snap)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package rprof
+
+import (
+	"runtime"
+	"sync"
+)
+
+// shardBits is the number of low bits of a stack ID that identify the shard
+// the stack is interned in.
+const shardBits = 8
+
+// maxShards is the maximum number of shards of a profiler.
+const maxShards = 1 << shardBits
+
+// shard holds the samples of the stacks whose hash maps to it, so that reads
+// from different stacks don't contend on a single lock.
+type shard struct {
+	mu      sync.Mutex
+	samples map[sampleKey]*sampleValue
+	stacks  stackTable
+
+	// Pad shards to separate cache lines, so their locks don't contend
+	// through false sharing.
+	_ [64]byte
+}
+
+// memory estimates the memory in bytes held by the samples of all shards.
+// Samples in local buffers that weren't flushed yet aren't accounted for.
+func (p *Rprof) memory() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var res int64
+	for i := range p.shards {
+		sh := &p.shards[i]
+		sh.mu.Lock()
+		res += sampleMemory(sh.samples, stackIndex{sh.stacks.list})
+		sh.mu.Unlock()
+	}
+	return res
+}
+
+// shardFor returns the shard of the stack with hash h and its index.
+func (p *Rprof) shardFor(h uint64) (*shard, uint32) {
+	i := uint32(h % uint64(len(p.shards)))
+	return &p.shards[i], i
+}
+
+// resetSamples discards the samples and stacks of all shards. Snapshots keep
+// the stacks of their samples, since the tables are replaced rather than
+// cleared. p.mu must be held exclusively.
+func (p *Rprof) resetSamples() {
+	for i := range p.shards {
+		p.shards[i].samples = map[sampleKey]*sampleValue{}
+		p.shards[i].stacks = stackTable{}
+	}
+	p.resetBuffers()
+	p.numSamples.Store(0)
+	p.budget.reset()
+}
+
+// swapSamples returns the samples of all shards and local buffers merged into
+// a single map and discards them. p.mu must be held exclusively.
+func (p *Rprof) swapSamples() (map[sampleKey]*sampleValue, stackIndex) {
+	p.flushBuffers()
+	if len(p.shards) == 1 {
+		samples := p.shards[0].samples
+		stacks := p.stackIndex()
+		p.resetSamples()
+		return samples, stacks
+	}
+
+	samples := make(map[sampleKey]*sampleValue, p.numSamples.Load())
+	for i := range p.shards {
+		for k, v := range p.shards[i].samples {
+			// Only samples of the empty stack, such as the dropped sample,
+			// may exist in several shards.
+			if s, ok := samples[k]; ok {
+				s.add(*v)
+				continue
+			}
+			samples[k] = v
+		}
+	}
+	stacks := p.stackIndex()
+	p.resetSamples()
+	return samples, stacks
+}
+
+// copySamples returns a copy of the samples of all shards merged into a
+// single map. If lock is false, p.mu must be held exclusively, otherwise it
+// must be held shared and the shards are locked one at a time.
+func (p *Rprof) copySamples(lock bool) (map[sampleKey]*sampleValue, stackIndex) {
+	samples := make(map[sampleKey]*sampleValue, p.numSamples.Load())
+	stacks := make(stackIndex, len(p.shards))
+	for i := range p.shards {
+		sh := &p.shards[i]
+		if lock {
+			sh.mu.Lock()
+		}
+		for k, v := range sh.samples {
+			if s, ok := samples[k]; ok {
+				s.add(*v)
+				continue
+			}
+			v := *v
+			samples[k] = &v
+		}
+		stacks[i] = sh.stacks.list
+		if lock {
+			sh.mu.Unlock()
+		}
+	}
+	return samples, stacks
+}
+
+// stackIndex returns the stacks of all shards. p.mu must be held exclusively.
+func (p *Rprof) stackIndex() stackIndex {
+	stacks := make(stackIndex, len(p.shards))
+	for i := range p.shards {
+		stacks[i] = p.shards[i].stacks.list
+	}
+	return stacks
+}
+
+// numShards returns the configured number of shards, GOMAXPROCS by default.
+func (c *config) numShards() int {
+	n := c.shards
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return min(n, maxShards)
+}
@@ -0,0 +1,85 @@
+package rprof
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// DumpOnSignal writes a profile of the default profiler to path every time
+// one of sigs is received. See Rprof.DumpOnSignal.
+func DumpOnSignal(path string, d time.Duration, sigs ...os.Signal) (stop func()) {
+	return profiler.DumpOnSignal(path, d, sigs...)
+}
+
+// DumpOnSignal writes a profile to path every time one of sigs is received,
+// typically syscall.SIGUSR1 or syscall.SIGUSR2. If the profiler is running
+// then the samples collected so far are written without stopping it.
+// Otherwise, if d is greater than zero, the profiler is started and a fresh
+// profile covering d is written. The file is replaced atomically, so a
+// partially written profile is never observed at path.
+//
+// Errors are reported on stderr since there is no caller to return them to.
+// The returned function stops listening for the signals.
+func (p *Rprof) DumpOnSignal(path string, d time.Duration, sigs ...os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-c:
+				if err := p.dump(path, d); err != nil {
+					fmt.Fprintf(os.Stderr, "rprof: dumping profile to %s: %v\n", path, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// dump writes the current profile, or a fresh one covering d, to path.
+func (p *Rprof) dump(path string, d time.Duration) error {
+	prof, err := p.Snapshot()
+	if err != nil {
+		if d <= 0 {
+			return err
+		}
+		if prof, err = p.StartFor(d); err != nil {
+			return err
+		}
+	}
+
+	return writeProfileFile(path, prof)
+}
+
+// writeProfileFile writes the compressed profile to a temporary file next to
+// path and renames it to path once it is complete.
+func writeProfileFile(path string, prof *proto.Profile) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if err := writeProfile(f, prof); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(f.Name()))
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Join(err, os.Remove(f.Name()))
+	}
+
+	return os.Rename(f.Name(), path)
+}
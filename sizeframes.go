@@ -0,0 +1,48 @@
+package rprof
+
+import (
+	"fmt"
+	"math"
+)
+
+// WithSizeFrames shows the size bucket of reads as a synthetic leaf frame,
+// for example "bytes:[4097-8192]", instead of the "bytes" label. Most
+// flamegraph UIs ignore labels, so this makes the size of reads visible in
+// every pprof viewer, at the cost of one more frame per stack.
+func WithSizeFrames() Option {
+	return func(p *Rprof) {
+		p.cfg.sizeFrames = true
+	}
+}
+
+// sizeFrameName returns the name of the synthetic frame of the given size
+// bucket. It reports false if reads are not bucketed.
+func sizeFrameName(buckets sizeBuckets, bucket uint8) (string, bool) {
+	hi, ok := buckets.label(bucket)
+	if !ok {
+		return "", false
+	}
+	var lo int64
+	if bucket > 0 {
+		prev, _ := buckets.label(bucket - 1)
+		lo = prev + 1
+	}
+	if hi == math.MaxInt64 {
+		return fmt.Sprintf("bytes:[%d-]", lo), true
+	}
+	return fmt.Sprintf("bytes:[%d-%d]", lo, hi), true
+}
+
+// sizeLocation returns the ID of the synthetic location of the size bucket of
+// the sample with the given key. It reports false if size frames are
+// disabled or the sample has no size bucket.
+func (b *profileBuilder) sizeLocation(k sampleKey) (uint64, bool) {
+	if !b.cfg.sizeFrames || k.unsized {
+		return 0, false
+	}
+	name, ok := sizeFrameName(b.cfg.buckets(), k.sizeBucket)
+	if !ok {
+		return 0, false
+	}
+	return b.addSyntheticLocation(name), true
+}
@@ -0,0 +1,143 @@
+package rprof
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// Snapshot is a point-in-time copy of the samples aggregated by a profiler.
+type Snapshot struct {
+	// Start is the start of the collection window the snapshot was taken
+	// from. It is the zero time if the profiler was not running.
+	Start time.Time
+	// Time is the time the snapshot was taken.
+	Time time.Time
+	// Reads is the number of reads in the collection window so far.
+	Reads int64
+	// Bytes is the number of bytes read in the collection window so far.
+	Bytes int64
+
+	cfg *config
+	// overhead is the overhead of the profiler when the snapshot was taken,
+	// without the memory.
+	overhead OverheadStats
+	samples  map[sampleKey]*sampleValue
+	stacks   stackIndex
+	// writer is the writer given to StartWriting, if the snapshot is of the
+	// window ended by Stop.
+	writer io.Writer
+}
+
+// Profile builds a profile of the samples in the snapshot. The profile of a
+// snapshot of a stopped profiler, which has no start, is empty and has a zero
+// time and duration.
+func (s Snapshot) Profile() *proto.Profile {
+	var start, duration int64
+	if !s.Start.IsZero() {
+		start, duration = s.Start.UnixNano(), s.Time.Sub(s.Start).Nanoseconds()
+	}
+	b := newProfileBuilder(s.cfg, start, duration)
+	prof := b.build(s.samples, s.stacks)
+	overhead := s.overhead
+	overhead.Memory = sampleMemory(s.samples, s.stacks)
+	b.addOverheadComment(overhead)
+	for _, t := range s.cfg.transformers {
+		t.Transform(prof)
+	}
+	return prof
+}
+
+// takeSnapshot copies the samples collected so far without stopping the
+// profiler. It reports whether the profiler is running, if it isn't the
+// snapshot is empty.
+func (p *Rprof) takeSnapshot() (Snapshot, bool) {
+	p.flushBatches()
+	if p.cfg.localBuffers {
+		// Local buffers can only be flushed while no records are in flight.
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	} else {
+		// Records continue while the shards are copied one at a time.
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+	}
+
+	s := Snapshot{
+		Time:     time.Now(),
+		cfg:      &p.cfg,
+		overhead: p.overhead.stats(),
+	}
+	if p.startTime == 0 {
+		return s, false
+	}
+
+	s.Start = time.Unix(0, p.startTime)
+	p.flushBuffers()
+	s.samples, s.stacks = p.copySamples(!p.cfg.localBuffers)
+	for _, v := range s.samples {
+		s.Reads += v.reads
+		s.Bytes += v.bytes
+	}
+	return s, true
+}
+
+// Snapshot returns a profile of the samples collected so far without stopping
+// the profiler. The samples are copied while holding the profiler's lock,
+// building the profile happens after releasing it, so collection continues
+// mostly unaffected. If the profiler is not started then it returns an error.
+func (p *Rprof) Snapshot() (*proto.Profile, error) {
+	s, ok := p.takeSnapshot()
+	if !ok {
+		return nil, errors.New("profiler not started")
+	}
+	return s.Profile(), nil
+}
+
+// Delta returns a profile of the samples the default profiler collected since
+// prev was taken. See Rprof.Delta.
+func Delta(prev Snapshot) (*proto.Profile, Snapshot) {
+	return profiler.Delta(prev)
+}
+
+// Delta returns a profile of the samples collected since prev was taken,
+// along with a new snapshot to pass to the next call. It allows pull-based
+// scrapers to obtain profiles of the time since their last scrape from an
+// always-on profiler.
+//
+// If prev is the zero Snapshot, or was taken from an earlier collection
+// window because the profiler was restarted in the meantime, the profile
+// covers the whole current window. If the profiler is not started then the
+// profile is empty and has a zero time and duration.
+func (p *Rprof) Delta(prev Snapshot) (*proto.Profile, Snapshot) {
+	cur, _ := p.takeSnapshot()
+
+	d := Snapshot{
+		Start:   cur.Start,
+		Time:    cur.Time,
+		cfg:     cur.cfg,
+		samples: make(map[sampleKey]*sampleValue, len(cur.samples)),
+		stacks:  cur.stacks,
+	}
+	sameWindow := !cur.Start.IsZero() && cur.Start.Equal(prev.Start)
+	if sameWindow {
+		d.Start = prev.Time
+	}
+
+	for k, v := range cur.samples {
+		v := *v
+		if sameWindow {
+			if o, ok := prev.samples[k]; ok {
+				v.sub(*o)
+			}
+		}
+		if v == (sampleValue{}) {
+			continue
+		}
+		d.samples[k] = &v
+	}
+
+	return d.Profile(), cur
+}
@@ -0,0 +1,24 @@
+package rprof
+
+// SetStackless switches the default profiler in or out of stackless mode. See
+// Rprof.SetStackless.
+func SetStackless(stackless bool) {
+	profiler.SetStackless(stackless)
+}
+
+// SetStackless switches the profiler in or out of stackless mode. In
+// stackless mode reads are recorded without walking their stacks, only
+// counting reads and bytes by size bucket and, for readers created with
+// WithName, by name. This is cheap enough to leave always on in production,
+// and the profiler can be escalated to full stacks on demand, for example
+// when a read budget is exceeded, by calling SetStackless(false) without
+// restarting it. Reads in flight when the mode changes are recorded in
+// either mode.
+func (p *Rprof) SetStackless(stackless bool) {
+	p.stackless.Store(stackless)
+}
+
+// Stackless reports whether the profiler is in stackless mode.
+func (p *Rprof) Stackless() bool {
+	return p.stackless.Load()
+}
@@ -0,0 +1,135 @@
+package rprof
+
+import (
+	"hash/maphash"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+// stackTable interns the stacks of the samples of a shard, so that sample
+// keys refer to stacks by a small ID rather than holding their PCs, and each
+// distinct stack is stored once regardless of the number of size buckets,
+// labels and goroutines it is recorded with. Stacks are discarded along with
+// the samples at the end of each window, so memory is bounded by the stacks
+// of a single window, and IDs are only comparable within a window.
+type stackTable struct {
+	// byHash maps the hash of a stack to the IDs of the stacks with that
+	// hash, of which there is almost always exactly one.
+	byHash map[uint64][]uint32
+	// list holds the stacks by ID. It is only ever appended to, so copies of
+	// it remain valid.
+	list stackList
+}
+
+// stackList holds the raw memory of stacks by ID. The stack with ID 0 is the
+// empty stack.
+type stackList []string
+
+// lookup returns the ID of the stack of pcs with hash h, if it was interned.
+func (t *stackTable) lookup(h uint64, pcs []uintptr) (uint32, bool) {
+	if len(pcs) == 0 {
+		return 0, true
+	}
+
+	s := stackString(pcs)
+	for _, id := range t.byHash[h] {
+		if t.list[id] == s {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// insert interns the stack of pcs with hash h, which must not have been
+// interned yet, and returns its ID.
+func (t *stackTable) insert(h uint64, pcs []uintptr) uint32 {
+	if t.byHash == nil {
+		t.byHash = map[uint64][]uint32{}
+		t.list = stackList{""}
+	}
+
+	id := uint32(len(t.list))
+	// The string aliases pcs, so it must be copied before it is retained.
+	t.list = append(t.list, strings.Clone(stackString(pcs)))
+	t.byHash[h] = append(t.byHash[h], id)
+	return id
+}
+
+// memory estimates the memory in bytes held by the stacks.
+func (l stackList) memory() int64 {
+	var res int64
+	for _, s := range l {
+		res += int64(unsafe.Sizeof(s)) + int64(len(s))
+	}
+	return res
+}
+
+// stackSeed is the seed of the stack hashes. Hashes are only compared within
+// the process, so a random seed is fine.
+var stackSeed = maphash.MakeSeed()
+
+// hashStack returns the hash of pcs.
+func hashStack(pcs []uintptr) uint64 {
+	return maphash.String(stackSeed, stackString(pcs))
+}
+
+// stackString returns a string sharing the memory of pcs. The string must be
+// cloned before it is retained beyond the lifetime of pcs.
+func stackString(pcs []uintptr) string {
+	if len(pcs) == 0 {
+		return ""
+	}
+	return unsafe.String((*byte)(unsafe.Pointer(&pcs[0])), len(pcs)*int(unsafe.Sizeof(pcs[0])))
+}
+
+// stackIndex holds the stacks of all shards of a profiler by shard.
+type stackIndex []stackList
+
+// stackID returns the ID of the stack with the given ID local to the shard
+// with the given index.
+func stackID(shard, local uint32) uint32 {
+	if local == 0 {
+		// The empty stack has the same ID in all shards.
+		return 0
+	}
+	return local<<shardBits | shard
+}
+
+// pcs returns a copy of the PCs of the stack with the given ID.
+func (x stackIndex) pcs(id uint32) []uintptr {
+	return x.appendPCs(nil, id)
+}
+
+// appendPCs appends the PCs of the stack with the given ID to dst.
+func (x stackIndex) appendPCs(dst []uintptr, id uint32) []uintptr {
+	if id == 0 {
+		return dst
+	}
+
+	stack := x[id&(maxShards-1)][id>>shardBits]
+	n := len(stack) / int(unsafe.Sizeof(uintptr(0)))
+	start := len(dst)
+	dst = slices.Grow(dst, n)[:start+n]
+	if n > 0 {
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&dst[start])), len(stack)), stack)
+	}
+	return dst
+}
+
+// depth returns the number of PCs of the stack with the given ID.
+func (x stackIndex) depth(id uint32) int {
+	if id == 0 {
+		return 0
+	}
+	return len(x[id&(maxShards-1)][id>>shardBits]) / int(unsafe.Sizeof(uintptr(0)))
+}
+
+// memory estimates the memory in bytes held by the stacks of all shards.
+func (x stackIndex) memory() int64 {
+	var res int64
+	for _, l := range x {
+		res += l.memory()
+	}
+	return res
+}
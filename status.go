@@ -0,0 +1,314 @@
+package rprof
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+// stackTotal is the aggregate of all samples sharing the same stack,
+// regardless of their size bucket.
+type stackTotal struct {
+	stack []uintptr
+	reads int64
+	bytes int64
+}
+
+// topStacks returns at most n stacks ordered by the number of bytes read.
+func topStacks(samples map[sampleKey]*sampleValue, stacks stackIndex, n int) []stackTotal {
+	byStack := map[uint32]*stackTotal{}
+	for k, v := range samples {
+		if k.unsized {
+			// Not a read.
+			continue
+		}
+
+		s, ok := byStack[k.stack]
+		if !ok {
+			s = &stackTotal{stack: stacks.pcs(k.stack)}
+			byStack[k.stack] = s
+		}
+		s.reads += v.reads
+		s.bytes += v.bytes
+	}
+
+	res := make([]stackTotal, 0, len(byStack))
+	for _, s := range byStack {
+		res = append(res, *s)
+	}
+	slices.SortFunc(res, func(a, b stackTotal) int {
+		if c := cmp.Compare(b.bytes, a.bytes); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.reads, a.reads)
+	})
+
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// symbolize returns the frames of stack formatted as "function file:line",
+// leaf first.
+func symbolize(stack []uintptr) []string {
+	res := make([]string, 0, len(stack))
+	frames := runtime.CallersFrames(stack)
+	for {
+		f, more := frames.Next()
+		res = append(res, fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line))
+		if !more {
+			break
+		}
+	}
+	return res
+}
+
+// Stacks returns the top k stacks of the default profiler. See Rprof.Stacks.
+func Stacks(k int, by Metric) []StackSummary {
+	return profiler.Stacks(k, by)
+}
+
+// Stacks returns the top k stacks of the samples collected so far, ranked by
+// the given metric. If the profiler is not running it returns nil.
+func (p *Rprof) Stacks(k int, by Metric) []StackSummary {
+	s, _ := p.takeSnapshot()
+	return s.Stacks(k, by)
+}
+
+// Stacks returns the top k stacks in the snapshot, ranked by the given metric.
+// A negative k is treated as 0.
+func (s Snapshot) Stacks(k int, by Metric) []StackSummary {
+	top := topStacks(s.samples, s.stacks, len(s.samples))
+	if by == MetricReads {
+		slices.SortStableFunc(top, func(a, b stackTotal) int {
+			return cmp.Compare(b.reads, a.reads)
+		})
+	}
+	top = top[:min(max(k, 0), len(top))]
+
+	res := make([]StackSummary, 0, len(top))
+	for _, t := range top {
+		res = append(res, StackSummary{
+			Reads:  t.reads,
+			Bytes:  t.bytes,
+			Frames: symbolize(t.stack),
+		})
+	}
+	return res
+}
+
+// sampleMemory estimates the memory in bytes held by the entries of the sample
+// map and by the stacks they refer to, not accounting for the overhead of the
+// map itself.
+func sampleMemory(samples map[sampleKey]*sampleValue, stacks stackIndex) int64 {
+	res := stacks.memory()
+	for k := range samples {
+		res += int64(unsafe.Sizeof(k)+unsafe.Sizeof(sampleValue{})) + int64(len(k.labels))
+	}
+	return res
+}
+
+// status is the state of a profiler as shown on the status page.
+type status struct {
+	Running bool
+	Since   time.Time
+	Samples int
+	Memory  int64
+	Reads   int64
+	Bytes   int64
+	// TopBucket is the size bucket that the most bytes were read in, zero if
+	// reads are not bucketed.
+	TopBucket int64
+	Top       []StackSummary
+	// Packages are the top packages by bytes read, only set for the status
+	// page.
+	Packages []PackageEntry
+	// TinyReads are the top stacks by reads whose average read size is
+	// below TinySize, only set for the status page.
+	TinyReads []TinyRead
+	TinySize  int64
+	Refresh   int
+}
+
+// StackSummary is the aggregate of all reads performed from the same stack.
+type StackSummary struct {
+	// Reads is the number of reads.
+	Reads int64
+	// Bytes is the number of bytes read.
+	Bytes int64
+	// Frames are the symbolized frames of the stack formatted as
+	// "function file:line", leaf first.
+	Frames []string
+}
+
+// summarizeStacks returns the symbolized top n stacks by bytes read.
+func summarizeStacks(samples map[sampleKey]*sampleValue, stacks stackIndex, n int) []StackSummary {
+	top := topStacks(samples, stacks, n)
+	res := make([]StackSummary, 0, len(top))
+	for _, t := range top {
+		res = append(res, StackSummary{
+			Reads:  t.reads,
+			Bytes:  t.bytes,
+			Frames: symbolize(t.stack),
+		})
+	}
+	return res
+}
+
+// status returns the current state of the profiler including its top n stacks.
+func (p *Rprof) status(n int) status {
+	snap, running := p.takeSnapshot()
+	return snapshotStatus(snap, running, n)
+}
+
+// snapshotStatus returns the state of a profiler with the given snapshot
+// including its top n stacks.
+func snapshotStatus(snap Snapshot, running bool, n int) status {
+	s := status{
+		Running: running,
+		Since:   snap.Start,
+		Samples: len(snap.samples),
+		Memory:  sampleMemory(snap.samples, snap.stacks),
+		Reads:   snap.Reads,
+		Bytes:   snap.Bytes,
+	}
+	if !running {
+		return s
+	}
+
+	var bucketBytes [256]int64
+	for k, v := range snap.samples {
+		bucketBytes[k.sizeBucket] += v.bytes
+	}
+	topBucket := 0
+	for bucket, b := range bucketBytes {
+		if b > bucketBytes[topBucket] {
+			topBucket = bucket
+		}
+	}
+	s.TopBucket, _ = snap.cfg.buckets().label(uint8(topBucket))
+
+	s.Top = summarizeStacks(snap.samples, snap.stacks, n)
+	return s
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>rprof status</title>
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 0 1em 0 0; text-align: left; vertical-align: top; }
+pre { margin: 0; }
+</style>
+</head>
+<body>
+<h1>rprof status</h1>
+{{if .Running}}
+<table>
+<tr><th>Collecting since</th><td>{{.Since.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Distinct samples</th><td>{{.Samples}}</td></tr>
+<tr><th>Sample memory</th><td>{{.Memory}} bytes</td></tr>
+<tr><th>Reads</th><td>{{.Reads}}</td></tr>
+<tr><th>Bytes read</th><td>{{.Bytes}}</td></tr>
+{{if .TopBucket}}<tr><th>Top size bucket</th><td>{{.TopBucket}} bytes</td></tr>{{end}}
+</table>
+<h2>Top stacks by bytes read</h2>
+<table>
+<tr><th>Bytes</th><th>Reads</th><th>Stack</th></tr>
+{{range .Top}}<tr><td>{{.Bytes}}</td><td>{{.Reads}}</td><td><pre>{{range .Frames}}{{.}}
+{{end}}</pre></td></tr>
+{{end}}</table>
+<h2>Top packages by bytes read</h2>
+<table>
+<tr><th>Bytes</th><th>Reads</th><th>Package</th></tr>
+{{range .Packages}}<tr><td>{{.Bytes}}</td><td>{{.Reads}}</td><td>{{.Package}}</td></tr>
+{{end}}</table>
+{{if .TinySize}}<h2>Stacks reading less than {{.TinySize}} bytes per read</h2>
+{{if .TinyReads}}<table>
+<tr><th>Reads</th><th>Bytes</th><th>Average</th><th>Stack</th></tr>
+{{range .TinyReads}}<tr><td>{{.Reads}}</td><td>{{.Bytes}}</td><td>{{.AverageSize}}</td><td><pre>{{range .Frames}}{{.}}
+{{end}}</pre></td></tr>
+{{end}}</table>
+{{else}}<p>None.</p>
+{{end}}{{end}}{{else}}
+<p>No collection is running.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// StatusPage is an HTTP handler that serves an HTML page showing the current
+// state of a profiler.
+type StatusPage struct {
+	p *Rprof
+}
+
+// StatusHandler returns a new StatusPage that uses the default profiler.
+func StatusHandler() *StatusPage {
+	return &StatusPage{p: profiler}
+}
+
+// NewStatusHandler returns a new StatusPage that uses the given profiler.
+func NewStatusHandler(p *Rprof) *StatusPage {
+	return &StatusPage{p: p}
+}
+
+// ServeHTTP writes the status page. The page refreshes itself every 5 seconds
+// unless a different interval is given with the refresh parameter, 0 disables
+// refreshing. The page flags stacks whose reads are smaller than 512 bytes on
+// average unless a different size is given with the tiny parameter, 0
+// disables the check.
+// Implements http.Handler.
+func (h *StatusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Default to 5 seconds.
+	refresh := 5
+	if r.FormValue("refresh") != "" {
+		var err error
+		refresh, err = strconv.Atoi(r.FormValue("refresh"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tiny := int64(DefaultTinyReadSize)
+	if r.FormValue("tiny") != "" {
+		var err error
+		tiny, err = strconv.ParseInt(r.FormValue("tiny"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	snap, running := h.p.takeSnapshot()
+	s := snapshotStatus(snap, running, 10)
+	if running {
+		s.Packages = snap.Packages(10, MetricBytes)
+		if tiny > 0 {
+			s.TinyReads = snap.TinyReads(tiny, 10)
+			s.TinySize = tiny
+		}
+	}
+	s.Refresh = refresh
+
+	buf := bytes.NewBuffer(nil)
+	if err := statusTemplate.Execute(buf, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
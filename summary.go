@@ -0,0 +1,70 @@
+package rprof
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// LogSummaries logs a summary of the default profiler every interval. See
+// Rprof.LogSummaries.
+func LogSummaries(logger *slog.Logger, interval time.Duration) (stop func(), err error) {
+	return profiler.LogSummaries(logger, interval)
+}
+
+// LogSummaries logs a structured summary of the samples collected so far every
+// interval while the profiler is running. The summary contains the total number
+// of reads and bytes read, the size bucket that the most bytes were read in,
+// and the top 3 stacks by bytes read. The returned function stops logging. If
+// interval isn't positive then it returns an error.
+func (p *Rprof) LogSummaries(logger *slog.Logger, interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+
+	t := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				p.logSummary(logger)
+			}
+		}
+	}()
+
+	return func() {
+		t.Stop()
+		close(done)
+	}, nil
+}
+
+// logSummary logs a single summary, if the profiler is running.
+func (p *Rprof) logSummary(logger *slog.Logger) {
+	s := p.status(3)
+	if !s.Running {
+		return
+	}
+
+	top := make([]any, 0, len(s.Top))
+	for i, t := range s.Top {
+		top = append(top, slog.Group(strconv.Itoa(i+1),
+			slog.Int64("bytes", t.Bytes),
+			slog.Int64("reads", t.Reads),
+			slog.Any("stack", t.Frames),
+		))
+	}
+
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "rprof summary",
+		slog.Time("since", s.Since),
+		slog.Int64("reads", s.Reads),
+		slog.Int64("bytes", s.Bytes),
+		slog.Int64("top_bucket", s.TopBucket),
+		slog.Group("top_stacks", top...),
+	)
+}
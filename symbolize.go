@@ -0,0 +1,61 @@
+package rprof
+
+import (
+	"runtime"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// symbolizeLocations adds the functions, files and lines of the locations of the
+// profile, including inlined frames, from the symbol table of the running
+// binary. This makes the profile usable on its own, where the consumer can't
+// symbolize it from the binary, such as on wasm where there are no mappings.
+// Synthetic locations, which have lines already, are left as is.
+func (b *profileBuilder) symbolizeLocations() {
+	type funcKey struct {
+		name, file string
+	}
+	funcs := map[funcKey]uint64{}
+
+	for _, loc := range b.p.Location {
+		if len(loc.Line) > 0 {
+			continue
+		}
+
+		// The addresses are return addresses, which CallersFrames
+		// accounts for. Inlined frames come first.
+		frames := runtime.CallersFrames([]uintptr{uintptr(loc.Address)})
+		for {
+			frame, more := frames.Next()
+			if frame.Function != "" {
+				k := funcKey{frame.Function, frame.File}
+				id, ok := funcs[k]
+				if !ok {
+					id = uint64(len(b.p.Function)) + 1
+					name := b.addString(frame.Function)
+					b.p.Function = append(b.p.Function, &proto.Function{
+						Id:         id,
+						Name:       name,
+						SystemName: name,
+						Filename:   b.addString(frame.File),
+					})
+					funcs[k] = id
+				}
+				loc.Line = append(loc.Line, &proto.Line{
+					FunctionIndex: id,
+					Line:          int64(frame.Line),
+				})
+			}
+			if !more {
+				break
+			}
+		}
+	}
+
+	for _, m := range b.p.Mapping {
+		m.HasFunctions = true
+		m.HasFilenames = true
+		m.HasLineNumbers = true
+		m.HasInlineFrames = true
+	}
+}
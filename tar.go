@@ -0,0 +1,73 @@
+package rprof
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+)
+
+// tarEntryLabel is the label with the name of the archive entry a read
+// belongs to. See Rprof.TarReader.
+const tarEntryLabel = "tar.entry"
+
+// TarReader returns a new tar reader profiled by the default profiler. See
+// Rprof.TarReader.
+func TarReader(r io.Reader, opts ...WrapOption) *RprofTarReader {
+	return profiler.TarReader(r, opts...)
+}
+
+// RprofTarReader is a tar.Reader whose reads of the underlying stream are
+// profiled and labeled with the entry being read.
+type RprofTarReader struct {
+	tr  *tar.Reader
+	src *tarSource
+}
+
+// tarSource is the profiled stream of a tar archive.
+type tarSource struct {
+	p   *Rprof
+	r   io.Reader
+	cfg wrapConfig
+	// entry is the configuration labeled with the current entry, cfg
+	// before the first entry.
+	entry wrapConfig
+
+	// eof is true once a read returned io.EOF.
+	eof bool
+}
+
+// TarReader returns a new tar reader reading from r, which profiles the reads
+// of r and labels them with the name of the current entry as "tar.entry" as
+// the archive is traversed. Reads performed by Next, which skip the rest of
+// the current entry and read the next header, are labeled with the current
+// entry.
+func (p *Rprof) TarReader(r io.Reader, opts ...WrapOption) *RprofTarReader {
+	cfg := newWrapConfig(context.Background(), opts)
+	src := &tarSource{p: p, r: r, cfg: cfg, entry: cfg}
+	return &RprofTarReader{tr: tar.NewReader(src), src: src}
+}
+
+// Next advances to the next entry in the archive and labels the following
+// reads with its name. See tar.Reader.Next.
+func (r *RprofTarReader) Next() (*tar.Header, error) {
+	hdr, err := r.tr.Next()
+	if err != nil {
+		return hdr, err
+	}
+	r.src.entry = r.src.cfg.withLabels(Labels(tarEntryLabel, hdr.Name))
+	return hdr, nil
+}
+
+// Read reads from the current entry in the archive. See tar.Reader.Read.
+// Implements io.Reader.
+func (r *RprofTarReader) Read(b []byte) (int, error) {
+	return r.tr.Read(b)
+}
+
+// Read reads from the underlying reader and records the sample in the
+// profiler.
+func (s *tarSource) Read(buf []byte) (int, error) {
+	ev := s.p.read(s.r, buf, &s.entry, &s.eof)
+	s.p.recordSample(ev, &s.entry)
+	return ev.n, ev.err
+}
@@ -0,0 +1,75 @@
+package rprof
+
+import (
+	"time"
+)
+
+// OnThreshold calls fn with a snapshot of the default profiler when the read
+// throughput exceeds bytesPerSecond. See Rprof.OnThreshold.
+func OnThreshold(bytesPerSecond int64, fn func(Snapshot)) (stop func()) {
+	return profiler.OnThreshold(bytesPerSecond, fn)
+}
+
+// OnThreshold calls fn with a snapshot of the current aggregation when the
+// number of bytes read through the profiler's readers within a second exceeds
+// bytesPerSecond. Throughput is measured whether or not the profiler is
+// started, if it isn't the snapshot is empty.
+//
+// fn is called once when the throughput rises above the threshold, and not
+// again until it has dropped back to or below it. It is called from a separate
+// goroutine and should not block for long. The returned function stops
+// measuring.
+func (p *Rprof) OnThreshold(bytesPerSecond int64, fn func(Snapshot)) (stop func()) {
+	p.thresholds.Add(1)
+	t := time.NewTicker(time.Second)
+	done := make(chan struct{})
+
+	go func() {
+		th := threshold{bytesPerSecond: bytesPerSecond, last: p.totalBytes.Load(), lastTime: time.Now()}
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				if th.tick(now, p.totalBytes.Load()) {
+					s, _ := p.takeSnapshot()
+					fn(s)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		t.Stop()
+		close(done)
+		p.thresholds.Add(-1)
+	}
+}
+
+// threshold tracks the throughput of OnThreshold between ticks.
+type threshold struct {
+	bytesPerSecond int64
+	// last is the total number of bytes read at lastTime.
+	last     int64
+	lastTime time.Time
+	// exceeded is true while the throughput is above the threshold.
+	exceeded bool
+}
+
+// tick updates the throughput with the total number of bytes read at now. It
+// reports whether the throughput rose above the threshold since the previous
+// tick.
+func (t *threshold) tick(now time.Time, total int64) bool {
+	rate := float64(total-t.last) / now.Sub(t.lastTime).Seconds()
+	t.last, t.lastTime = total, now
+
+	if rate <= float64(t.bytesPerSecond) {
+		t.exceeded = false
+		return false
+	}
+	if t.exceeded {
+		return false
+	}
+	t.exceeded = true
+	return true
+}
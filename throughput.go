@@ -0,0 +1,134 @@
+package rprof
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultThroughputWindow is the window kept by NewThroughput when a window
+// of zero or less is given.
+const DefaultThroughputWindow = 5 * time.Minute
+
+// Throughput keeps the bytes read and reads performed through profiled
+// readers per second over a recent window. Like ReadSizeHistogram it is not
+// bound to a collection window, once set on a profiler every read is
+// observed.
+type Throughput struct {
+	seconds []throughputSecond
+}
+
+// throughputSecond is the totals of a single second.
+type throughputSecond struct {
+	// unix is the second the totals are of, in seconds since the epoch.
+	unix  atomic.Int64
+	bytes atomic.Int64
+	reads atomic.Int64
+}
+
+// ThroughputPoint is the totals of a single second.
+type ThroughputPoint struct {
+	// Time is the start of the second.
+	Time time.Time `json:"time"`
+	// Bytes is the number of bytes read within the second.
+	Bytes int64 `json:"bytes"`
+	// Reads is the number of reads within the second.
+	Reads int64 `json:"reads"`
+}
+
+// NewThroughput returns a new Throughput keeping the given window, rounded up
+// to whole seconds. If the window is zero or less DefaultThroughputWindow is
+// used.
+func NewThroughput(window time.Duration) *Throughput {
+	if window <= 0 {
+		window = DefaultThroughputWindow
+	}
+	// One more second holds the current, incomplete one.
+	n := int((window+time.Second-1)/time.Second) + 1
+	return &Throughput{seconds: make([]throughputSecond, n)}
+}
+
+// SetThroughput sets the throughput that observes every read performed
+// through readers of the default profiler. See Rprof.SetThroughput.
+func SetThroughput(t *Throughput) {
+	profiler.SetThroughput(t)
+}
+
+// SetThroughput sets the throughput that observes every read performed
+// through the profiler's readers, whether or not the profiler is started. A
+// nil throughput stops observing reads.
+func (p *Rprof) SetThroughput(t *Throughput) {
+	p.throughput.Store(t)
+}
+
+// Observe records a read of the given size at the current time.
+func (t *Throughput) Observe(size int) {
+	t.observe(time.Now().Unix(), size)
+}
+
+// observe records a read of the given size in the second unix. Reads racing
+// with the first read of a new second may be lost when it resets the totals
+// of the slot it reuses, so the totals are approximate at second boundaries.
+func (t *Throughput) observe(unix int64, size int) {
+	s := &t.seconds[unix%int64(len(t.seconds))]
+	if prev := s.unix.Load(); prev != unix && s.unix.CompareAndSwap(prev, unix) {
+		s.bytes.Store(0)
+		s.reads.Store(0)
+	}
+	s.bytes.Add(int64(size))
+	s.reads.Add(1)
+}
+
+// Points returns the totals of the seconds of the window, oldest first. The
+// current second is not complete yet and so not included. Seconds without
+// reads have zero totals.
+func (t *Throughput) Points() []ThroughputPoint {
+	return t.points(time.Now().Unix())
+}
+
+// points returns the totals of the seconds of the window before the second
+// now.
+func (t *Throughput) points(now int64) []ThroughputPoint {
+	res := make([]ThroughputPoint, 0, len(t.seconds)-1)
+	for unix := now - int64(len(t.seconds)) + 1; unix < now; unix++ {
+		p := ThroughputPoint{Time: time.Unix(unix, 0)}
+		s := &t.seconds[unix%int64(len(t.seconds))]
+		if s.unix.Load() == unix {
+			p.Bytes = s.bytes.Load()
+			p.Reads = s.reads.Load()
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// ServeHTTP writes the points of the window as a JSON array, oldest first,
+// so dashboards can graph the bytes read and reads per second without
+// parsing profiles. If the last parameter is given, for example last=1m, only
+// the points within that duration are written.
+// Implements http.Handler.
+func (t *Throughput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	points := t.Points()
+	if r.FormValue("last") != "" {
+		d, err := time.ParseDuration(r.FormValue("last"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n := int(d / time.Second); n < len(points) {
+			points = points[len(points)-max(n, 0):]
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(buf).Encode(points); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
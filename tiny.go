@@ -0,0 +1,66 @@
+package rprof
+
+import (
+	"cmp"
+	"slices"
+)
+
+// DefaultTinyReadSize is the average read size below which the status page
+// flags stacks as performing tiny reads.
+const DefaultTinyReadSize = 512
+
+// TinyRead is a stack whose reads are smaller than a threshold on average,
+// which usually means a buffer such as bufio.Reader is missing between the
+// stack and the profiled reader.
+type TinyRead struct {
+	// Reads is the number of reads.
+	Reads int64
+	// Bytes is the number of bytes read.
+	Bytes int64
+	// AverageSize is the average number of bytes per read.
+	AverageSize int64
+	// Frames are the symbolized frames of the stack formatted as
+	// "function file:line", leaf first.
+	Frames []string
+}
+
+// TinyReads returns the top k stacks of the default profiler with tiny reads.
+// See Rprof.TinyReads.
+func TinyReads(size int64, k int) []TinyRead {
+	return profiler.TinyReads(size, k)
+}
+
+// TinyReads returns the top k stacks of the samples collected so far whose
+// average read size is below size. If the profiler is not running it returns
+// nil. See Snapshot.TinyReads.
+func (p *Rprof) TinyReads(size int64, k int) []TinyRead {
+	s, _ := p.takeSnapshot()
+	return s.TinyReads(size, k)
+}
+
+// TinyReads returns the top k stacks in the snapshot whose average read size
+// is below size, ranked by their number of reads since fixing the stacks
+// with the most reads saves the most calls. A negative k is treated as 0.
+func (s Snapshot) TinyReads(size int64, k int) []TinyRead {
+	top := topStacks(s.samples, s.stacks, len(s.samples))
+	top = slices.DeleteFunc(top, func(t stackTotal) bool {
+		return t.stack == nil || t.reads == 0 || t.bytes >= size*t.reads
+	})
+	slices.SortStableFunc(top, func(a, b stackTotal) int {
+		return cmp.Compare(b.reads, a.reads)
+	})
+
+	if k = max(k, 0); len(top) > k {
+		top = top[:k]
+	}
+	res := make([]TinyRead, 0, len(top))
+	for _, t := range top {
+		res = append(res, TinyRead{
+			Reads:       t.reads,
+			Bytes:       t.bytes,
+			AverageSize: t.bytes / t.reads,
+			Frames:      symbolize(t.stack),
+		})
+	}
+	return res
+}
@@ -0,0 +1,101 @@
+package rprof
+
+import (
+	"cmp"
+	"runtime"
+	"slices"
+)
+
+// Metric is a value that aggregated entries can be ranked by.
+type Metric int
+
+const (
+	// MetricBytes ranks by the number of bytes read.
+	MetricBytes Metric = iota
+	// MetricReads ranks by the number of reads.
+	MetricReads
+)
+
+// TopEntry is the aggregate of all reads performed from the same call site,
+// that is the function that called Read on a profiled reader.
+type TopEntry struct {
+	// Function is the fully qualified name of the calling function.
+	Function string
+	// File is the source file of the call site.
+	File string
+	// Line is the line of the call site.
+	Line int
+	// Reads is the number of reads.
+	Reads int64
+	// Bytes is the number of bytes read.
+	Bytes int64
+}
+
+// Top returns the top k call sites of the default profiler. See Rprof.Top.
+func Top(k int, by Metric) []TopEntry {
+	return profiler.Top(k, by)
+}
+
+// Top returns the top k call sites of the samples collected so far, ranked by
+// the given metric. If the profiler is not running it returns nil.
+func (p *Rprof) Top(k int, by Metric) []TopEntry {
+	s, _ := p.takeSnapshot()
+	return s.Top(k, by)
+}
+
+// Top returns the top k call sites in the snapshot, ranked by the given metric.
+// A negative k is treated as 0.
+func (s Snapshot) Top(k int, by Metric) []TopEntry {
+	type callSite struct {
+		function string
+		file     string
+		line     int
+	}
+
+	frames := map[uintptr]runtime.Frame{}
+	entries := map[callSite]*TopEntry{}
+	for key, v := range s.samples {
+		if key.stack == 0 || key.unsized {
+			continue
+		}
+
+		pc := s.stacks.pcs(key.stack)[0]
+		f, ok := frames[pc]
+		if !ok {
+			f, _ = runtime.CallersFrames([]uintptr{pc}).Next()
+			frames[pc] = f
+		}
+
+		site := callSite{function: f.Function, file: f.File, line: f.Line}
+		e, ok := entries[site]
+		if !ok {
+			e = &TopEntry{Function: f.Function, File: f.File, Line: f.Line}
+			entries[site] = e
+		}
+		e.Reads += v.reads
+		e.Bytes += v.bytes
+	}
+
+	res := make([]TopEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, *e)
+	}
+	slices.SortFunc(res, func(a, b TopEntry) int {
+		return cmp.Compare(b.value(by), a.value(by))
+	})
+
+	if k = max(k, 0); len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+// value returns the value of the entry for the given metric.
+func (e TopEntry) value(m Metric) int64 {
+	switch m {
+	case MetricReads:
+		return e.Reads
+	default:
+		return e.Bytes
+	}
+}
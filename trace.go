@@ -0,0 +1,175 @@
+package rprof
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// Label keys of the trace and span IDs of the span that was active in the
+// context of a read. See WithoutTraceLabels.
+const (
+	traceIDLabel = "trace_id"
+	spanIDLabel  = "span_id"
+)
+
+// SetSpanEventThresholds sets the span event thresholds of the default
+// profiler. See Rprof.SetSpanEventThresholds.
+func SetSpanEventThresholds(t SpanEventThresholds) {
+	profiler.SetSpanEventThresholds(t)
+}
+
+// SpanEventThresholds configures when reads through context-aware readers add
+// events to the OpenTelemetry span that was active in their context.
+type SpanEventThresholds struct {
+	// Read is the size in bytes above which a single read adds an
+	// "rprof.large_read" event. Zero disables the event.
+	Read int64
+	// Total is the number of bytes above which the reads of all readers
+	// wrapped with the same span add an "rprof.read_threshold_exceeded"
+	// event. The event is added once per span. Zero disables the event.
+	Total int64
+}
+
+// SetSpanEventThresholds sets the thresholds above which reads add events to
+// the span of context-aware readers, such as those returned by ReaderContext.
+// Like the read size histogram this is independent of whether the profiler is
+// started.
+func (p *Rprof) SetSpanEventThresholds(t SpanEventThresholds) {
+	p.spans.thresholds.Store(&t)
+}
+
+// spanFromContext returns the span in ctx if it is recording, nil otherwise.
+func spanFromContext(ctx context.Context) trace.Span {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return nil
+	}
+	return span
+}
+
+// spanTracker keeps the cumulative number of bytes read per span.
+type spanTracker struct {
+	thresholds atomic.Pointer[SpanEventThresholds]
+
+	mu     sync.Mutex
+	totals map[trace.SpanID]*spanTotal
+	// sweepAt is the size of totals at which ended spans are removed next.
+	sweepAt int
+}
+
+// spanTotal is the number of bytes read within a span.
+type spanTotal struct {
+	span     trace.Span
+	bytes    int64
+	exceeded bool
+}
+
+// observe adds the events for a read of size n to span, if any of the
+// thresholds are exceeded.
+func (t *spanTracker) observe(span trace.Span, n int) {
+	thresholds := t.thresholds.Load()
+	if thresholds == nil {
+		return
+	}
+
+	if thresholds.Read > 0 && int64(n) > thresholds.Read {
+		span.AddEvent("rprof.large_read", trace.WithAttributes(
+			attribute.Int("rprof.read.bytes", n),
+		))
+	}
+
+	if thresholds.Total > 0 && t.add(span, n, thresholds.Total) {
+		span.AddEvent("rprof.read_threshold_exceeded", trace.WithAttributes(
+			attribute.Int64("rprof.read.threshold_bytes", thresholds.Total),
+		))
+	}
+}
+
+// add adds n bytes to the total of span and reports whether the total
+// exceeded the threshold for the first time.
+func (t *spanTracker) add(span trace.Span, n int, threshold int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.totals == nil {
+		t.totals = map[trace.SpanID]*spanTotal{}
+	}
+
+	id := span.SpanContext().SpanID()
+	total, ok := t.totals[id]
+	if !ok {
+		t.sweep()
+		total = &spanTotal{span: span}
+		t.totals[id] = total
+	}
+
+	total.bytes += int64(n)
+	if total.exceeded || total.bytes <= threshold {
+		return false
+	}
+	total.exceeded = true
+	return true
+}
+
+// sweep removes the totals of spans that have ended once the map has doubled
+// in size since the last sweep, so the cost is amortized across reads.
+func (t *spanTracker) sweep() {
+	if len(t.totals) < t.sweepAt {
+		return
+	}
+
+	for id, total := range t.totals {
+		if !total.span.IsRecording() {
+			delete(t.totals, id)
+		}
+	}
+	t.sweepAt = 2*len(t.totals) + 64
+}
+
+// traceLabel returns the trace and span IDs updated with l if it is one of
+// the trace labels.
+func traceLabel(l label, traceID, spanID string) (string, string) {
+	switch l.key {
+	case traceIDLabel:
+		return l.value, spanID
+	case spanIDLabel:
+		return traceID, l.value
+	}
+	return traceID, spanID
+}
+
+// addLink adds a link to the span with the given hex encoded IDs to the link
+// table of the profile and returns its index. If either ID is missing or
+// invalid it returns 0, the index of the empty link that indicates no link.
+func (b *profileBuilder) addLink(traceID, spanID string) uint64 {
+	if traceID == "" || spanID == "" {
+		return 0
+	}
+	key := traceID + spanID
+	if idx, ok := b.links[key]; ok {
+		return idx
+	}
+
+	tid, err := trace.TraceIDFromHex(traceID)
+	if err != nil {
+		return 0
+	}
+	sid, err := trace.SpanIDFromHex(spanID)
+	if err != nil {
+		return 0
+	}
+
+	if len(b.p.LinkTable) == 0 {
+		b.p.LinkTable = append(b.p.LinkTable, &proto.Link{})
+		b.links = map[string]uint64{}
+	}
+	idx := uint64(len(b.p.LinkTable))
+	b.p.LinkTable = append(b.p.LinkTable, &proto.Link{TraceId: tid[:], SpanId: sid[:]})
+	b.links[key] = idx
+	return idx
+}
@@ -0,0 +1,121 @@
+package rprof_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/polarsignals/rprof"
+)
+
+// recordingSpan is a span that records the names of the events added to it.
+type recordingSpan struct {
+	noop.Span
+	sc     trace.SpanContext
+	events []string
+}
+
+func (s *recordingSpan) IsRecording() bool              { return true }
+func (s *recordingSpan) SpanContext() trace.SpanContext { return s.sc }
+func (s *recordingSpan) AddEvent(name string, _ ...trace.EventOption) {
+	s.events = append(s.events, name)
+}
+
+func TestSpanEventThresholds(t *testing.T) {
+	p := rprof.NewProfiler()
+	p.SetSpanEventThresholds(rprof.SpanEventThresholds{
+		Read:  1024,
+		Total: 4096,
+	})
+
+	span := &recordingSpan{sc: trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1},
+		SpanID:  trace.SpanID{1},
+	})}
+	ctx := trace.ContextWithSpan(context.Background(), span)
+
+	// Two readers of the same span, 3000 bytes read in 512 byte reads each.
+	for i := 0; i < 2; i++ {
+		r := p.ReaderContext(ctx, bytes.NewReader(make([]byte, 3000)))
+		buf := make([]byte, 512)
+		for {
+			if _, err := r.Read(buf); err == io.EOF {
+				break
+			}
+		}
+	}
+
+	// A single large read.
+	if _, err := p.ReaderContext(ctx, bytes.NewReader(make([]byte, 2048))).Read(make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"rprof.read_threshold_exceeded", "rprof.large_read"}
+	if len(span.events) != len(expected) {
+		t.Fatalf("expected events %v but got %v", expected, span.events)
+	}
+	for i := range expected {
+		if span.events[i] != expected[i] {
+			t.Fatalf("expected events %v but got %v", expected, span.events)
+		}
+	}
+}
+
+func TestTraceLabels(t *testing.T) {
+	span := &recordingSpan{sc: trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3},
+		SpanID:  trace.SpanID{4, 5, 6},
+	})}
+	ctx := trace.ContextWithSpan(context.Background(), span)
+
+	for _, disabled := range []bool{false, true} {
+		var opts []rprof.Option
+		if disabled {
+			opts = append(opts, rprof.WithoutTraceLabels())
+		}
+		p := rprof.NewProfiler(opts...)
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(p.ReaderContext(ctx, bytes.NewReader(make([]byte, 1024))))
+		io.ReadAll(p.Reader(bytes.NewReader(make([]byte, 1024))))
+		prof, err := p.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var linked int64
+		for _, s := range prof.Sample {
+			labels := map[string]string{}
+			for _, l := range s.Label {
+				labels[prof.StringTable[l.Key]] = prof.StringTable[l.Str]
+			}
+			if s.Link == 0 {
+				if labels["trace_id"] != "" {
+					t.Fatalf("expected a link for labels %v", labels)
+				}
+				continue
+			}
+			linked += s.Value[1]
+			if labels["trace_id"] != span.sc.TraceID().String() || labels["span_id"] != span.sc.SpanID().String() {
+				t.Fatalf("unexpected trace labels %v", labels)
+			}
+			link := prof.LinkTable[s.Link]
+			if !bytes.Equal(link.TraceId, []byte{1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) || !bytes.Equal(link.SpanId, []byte{4, 5, 6, 0, 0, 0, 0, 0}) {
+				t.Fatalf("unexpected link %v", link)
+			}
+		}
+
+		want := int64(1024)
+		if disabled {
+			want = 0
+		}
+		if linked != want {
+			t.Fatalf("expected %d linked bytes but got %d", want, linked)
+		}
+	}
+}
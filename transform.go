@@ -0,0 +1,58 @@
+package rprof
+
+import (
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// Transformer post-processes profiles after the samples are aggregated and
+// before they are returned or serialized, for example to filter frames,
+// rewrite or drop labels, collapse buckets or anonymize data.
+type Transformer interface {
+	Transform(prof *proto.Profile)
+}
+
+// TransformerFunc is a function that implements Transformer.
+type TransformerFunc func(prof *proto.Profile)
+
+// Transform calls f(prof).
+func (f TransformerFunc) Transform(prof *proto.Profile) {
+	f(prof)
+}
+
+// WithTransformers adds transformers applied in order to every profile built
+// by the profiler, whether by Stop, Snapshot, Collect, the HTTP handler or
+// continuous profiling. Options may be repeated, later transformers run after
+// earlier ones.
+func WithTransformers(transformers ...Transformer) Option {
+	return func(p *Rprof) {
+		p.cfg.transformers = append(p.cfg.transformers, transformers...)
+	}
+}
+
+// DropLabels returns a transformer that removes the labels with the given
+// keys from all samples, such as labels carrying sensitive values.
+func DropLabels(keys ...string) Transformer {
+	return TransformerFunc(func(prof *proto.Profile) {
+		drop := make(map[int64]bool, len(keys))
+		for i, s := range prof.StringTable {
+			for _, k := range keys {
+				if s == k {
+					drop[int64(i)] = true
+				}
+			}
+		}
+		if len(drop) == 0 {
+			return
+		}
+
+		for _, s := range prof.Sample {
+			labels := s.Label[:0]
+			for _, l := range s.Label {
+				if !drop[l.Key] {
+					labels = append(labels, l)
+				}
+			}
+			s.Label = labels
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package rprof
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// Label keys and values attached to the samples of a profiled transport.
+const (
+	phaseLabel  = "http.phase"
+	phaseHeader = "header"
+	phaseBody   = "body"
+
+	connLabel  = "http.conn"
+	connNew    = "new"
+	connReused = "reused"
+
+	methodLabel = "http.method"
+	hostLabel   = "http.host"
+	pathLabel   = "http.path"
+)
+
+// Transport returns a new http.RoundTripper that profiles the responses of rt
+// with the default profiler. See Rprof.Transport.
+func Transport(rt http.RoundTripper, opts ...WrapOption) http.RoundTripper {
+	return profiler.Transport(rt, opts...)
+}
+
+// Transport returns a new http.RoundTripper that sends requests with rt, or
+// http.DefaultTransport if rt is nil, and profiles the bytes read of their
+// responses. The header of a response is recorded as a single read with the
+// "http.phase" label "header", of the size the header has in HTTP/1.1 and
+// the latency from writing the request to receiving the header. Reads of the
+// body are recorded with the label "body". Both are labeled with "http.conn",
+// which is "reused" if the request was sent on a connection that was used
+// before and "new" otherwise, telling apart protocol overhead and payload as
+// well as the cost of new connections. The context of each request is used
+// like that of ReadCloserContext.
+func (p *Rprof) Transport(rt http.RoundTripper, opts ...WrapOption) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &profiledTransport{p: p, rt: rt, opts: opts}
+}
+
+// Client returns a new http.Client whose responses are profiled by the
+// default profiler. See Rprof.Client.
+func Client(c *http.Client, opts ...WrapOption) *http.Client {
+	return profiler.Client(c, opts...)
+}
+
+// Client returns a copy of c, or of a zero http.Client if c is nil, whose
+// transport profiles the responses as described for Transport. The transport
+// of c, or http.DefaultTransport if it has none, sends the requests.
+func (p *Rprof) Client(c *http.Client, opts ...WrapOption) *http.Client {
+	var client http.Client
+	if c != nil {
+		client = *c
+	}
+	client.Transport = p.Transport(client.Transport, opts...)
+	return &client
+}
+
+// InstrumentDefaultHTTP profiles the responses of http.DefaultTransport with
+// the default profiler. See Rprof.InstrumentDefaultHTTP.
+func InstrumentDefaultHTTP(opts ...WrapOption) (restore func()) {
+	return profiler.InstrumentDefaultHTTP(opts...)
+}
+
+// InstrumentDefaultHTTP replaces http.DefaultTransport with a Transport
+// wrapping it, so all traffic of http.DefaultClient and of other clients
+// without a transport is profiled, including that of third-party libraries.
+// The returned function restores the original transport, unless
+// http.DefaultTransport was replaced again in the meantime. If
+// http.DefaultTransport is already profiled by p, it is left alone and
+// restore does nothing. Since http.DefaultTransport is a plain variable, it
+// should be called at startup, before requests are sent.
+func (p *Rprof) InstrumentDefaultHTTP(opts ...WrapOption) (restore func()) {
+	orig := http.DefaultTransport
+	if t, ok := orig.(*profiledTransport); ok && t.p == p {
+		return func() {}
+	}
+
+	instrumented := p.Transport(orig, opts...)
+	http.DefaultTransport = instrumented
+	return func() {
+		if http.DefaultTransport == instrumented {
+			http.DefaultTransport = orig
+		}
+	}
+}
+
+// ResponseBody profiles the body of resp with the default profiler. See
+// Rprof.ResponseBody.
+func ResponseBody(resp *http.Response, opts ...WrapOption) *http.Response {
+	return profiler.ResponseBody(resp, opts...)
+}
+
+// ResponseBody replaces the body of resp with a profiled io.ReadCloser and
+// returns resp, for code that can't change its transport but handles
+// responses in one place. The samples are labeled with the method as
+// "http.method", and the host and path of the URL as "http.host" and
+// "http.path", of the request of resp, whose context is used like for
+// ReaderContext. Since every distinct path gets its own samples, paths with
+// identifiers in them may need to be rewritten with a Transformer. Unlike
+// with Transport, the header of resp isn't recorded.
+// The bodies of 101 Switching Protocols responses are left alone.
+func (p *Rprof) ResponseBody(resp *http.Response, opts ...WrapOption) *http.Response {
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil {
+		return resp
+	}
+
+	ctx := context.Background()
+	if req := resp.Request; req != nil {
+		ctx = req.Context()
+		opts = append([]WrapOption{WithLabelSet(Labels(
+			methodLabel, req.Method,
+			hostLabel, req.URL.Host,
+			pathLabel, req.URL.Path,
+		))}, opts...)
+	}
+	resp.Body = p.newReadCloser(resp.Body, newWrapConfig(ctx, opts))
+	return resp
+}
+
+// profiledTransport is an http.RoundTripper profiling the responses of the
+// underlying RoundTripper.
+type profiledTransport struct {
+	p    *Rprof
+	rt   http.RoundTripper
+	opts []WrapOption
+}
+
+// RoundTrip sends the request with the underlying RoundTripper and records
+// the header of the response, and wraps its body, in the profiler.
+// Implements http.RoundTripper.
+func (t *profiledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var trace requestTrace
+	resp, err := t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace())))
+	if err != nil {
+		return resp, err
+	}
+
+	conn := connNew
+	if trace.reused.Load() {
+		conn = connReused
+	}
+
+	cfg := newWrapConfig(req.Context(), t.opts)
+	header := cfg.withLabels(Labels(phaseLabel, phaseHeader, connLabel, conn))
+	n := headerSize(resp)
+	var latency time.Duration
+	if wrote := trace.wrote.Load(); wrote != 0 {
+		latency = time.Since(time.Unix(0, wrote))
+	}
+	t.p.recordSample(readEvent{n: n, requested: n, latency: latency}, &header)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The body is the connection, which must remain writable.
+		return resp, nil
+	}
+	resp.Body = t.p.newReadCloser(resp.Body, cfg.withLabels(Labels(phaseLabel, phaseBody, connLabel, conn)))
+	return resp, nil
+}
+
+// requestTrace collects the events of a request relevant to its profile.
+type requestTrace struct {
+	// reused is true if the request was sent on a connection that was used
+	// before.
+	reused atomic.Bool
+	// wrote is the time the request was written in nanoseconds since the
+	// epoch, 0 if it wasn't written yet.
+	wrote atomic.Int64
+}
+
+// clientTrace returns the hooks collecting the events of the request, which
+// may be called concurrently.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.reused.Store(info.Reused)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.wrote.Store(time.Now().UnixNano())
+		},
+	}
+}
+
+// headerSize returns the size of the status line and header of the response
+// as written in HTTP/1.1. HTTP/2 and HTTP/3 compress headers, so for them
+// the size is an upper bound of the bytes on the wire.
+func headerSize(resp *http.Response) int {
+	// "HTTP/1.1 200 OK\r\n"
+	n := len(resp.Proto) + 1 + len(resp.Status) + 2
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			// "Key: value\r\n"
+			n += len(k) + 2 + len(v) + 2
+		}
+	}
+	// The blank line ending the header.
+	return n + 2
+}
@@ -0,0 +1,205 @@
+package rprof
+
+import (
+	"slices"
+	"sync"
+
+	proto "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+// MaxValueTypes is the maximum number of additional sample types of a
+// profiler, those added with WithValueTypes and those of the adapters, such
+// as Scanner, used with it.
+const MaxValueTypes = 8
+
+// ValueType is an additional sample type, such as decompressed bytes, rows
+// decoded or cache misses, whose values are contributed per read by wrappers
+// created with WithReadValues.
+type ValueType struct {
+	// Type is the name of the sample type, for example "decompressed".
+	Type string
+	// Unit is the unit of the values, for example "bytes" or "count".
+	Unit string
+}
+
+// WithValueTypes adds sample types to the profiles, after the built-in ones
+// and in the given order. It panics if more than MaxValueTypes types are
+// added, since the values of wrappers created with WithReadValues would
+// otherwise silently go missing.
+func WithValueTypes(types ...ValueType) Option {
+	if len(types) > MaxValueTypes {
+		panic("rprof: too many value types")
+	}
+	types = slices.Clone(types)
+
+	return func(p *Rprof) {
+		for _, t := range types {
+			p.cfg.valueTypes.add(valueType{ValueType: t})
+		}
+		p.cfg.valueTypes.user = len(p.cfg.valueTypes.types)
+	}
+}
+
+// WithReadValues calls fn after each read of the wrapper with the number of
+// bytes read, for it to set the values the read contributes to the sample
+// types added by WithValueTypes, values[i] for the i-th type. values has a
+// zeroed element per type. The values are aggregated per stack like the
+// built-in ones and scaled alike when reads are sampled. All profilers the
+// wrapper records to are expected to have the same value types.
+func WithReadValues(fn func(n int, values []int64)) WrapOption {
+	return func(c *wrapConfig) {
+		c.readValues = fn
+	}
+}
+
+// ValueTypes returns the additional sample types of the default profiler. See
+// Rprof.ValueTypes.
+func ValueTypes() []ValueType {
+	return profiler.ValueTypes()
+}
+
+// ValueTypes returns the additional sample types of the profiler in the order
+// of their values in Sample.Extra and SampleEvent.Extra: those added with
+// WithValueTypes, followed by those of the adapters used with the profiler
+// in the order they were first used.
+func (p *Rprof) ValueTypes() []ValueType {
+	types := p.cfg.valueTypes.list()
+	res := make([]ValueType, 0, len(types))
+	for _, t := range types {
+		res = append(res, t.ValueType)
+	}
+	return res
+}
+
+// valueType is an additional sample type along with the label derived from
+// its values per sample, if any.
+type valueType struct {
+	ValueType
+	// label is the key of the label derived from the value of the type of a
+	// sample, empty if none, and unit the unit of the label.
+	label, unit string
+	// derive returns the value of the label given the value of the type
+	// and the bytes read of a sample. It reports false if the sample gets
+	// no label.
+	derive func(value, bytes int64) (int64, bool)
+}
+
+// valueTypeSet holds the additional sample types of a profiler: those added
+// with WithValueTypes, followed by those registered by adapters when they
+// are created. Types are only ever appended, so the index of the values of a
+// type never changes, and profiles of programs that don't use an adapter
+// don't carry its always-zero type.
+type valueTypeSet struct {
+	mu    sync.Mutex
+	types []valueType
+	// user is the number of types added with WithValueTypes, which come
+	// first.
+	user int
+}
+
+// add appends t to the set. It panics if the set is full.
+func (s *valueTypeSet) add(t valueType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.types) == MaxValueTypes {
+		panic("rprof: too many value types")
+	}
+	s.types = append(s.types, t)
+}
+
+// index returns the index of the values of t, registering t if it isn't in
+// the set yet. It returns -1 if the set is full, in which case the values of
+// t aren't recorded.
+func (s *valueTypeSet) index(t valueType) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, u := range s.types {
+		if u.ValueType == t.ValueType {
+			return i
+		}
+	}
+	if len(s.types) == MaxValueTypes {
+		return -1
+	}
+	s.types = append(s.types, t)
+	return len(s.types) - 1
+}
+
+// list returns a copy of the types in the set. It returns nil for a nil set.
+func (s *valueTypeSet) list() []valueType {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.types)
+}
+
+// registerValueType registers t with the profiler and the additional
+// profilers of cfg, for an adapter to contribute values of t to its reads.
+// It returns the index of the values of t in the profiler, or -1 if the
+// profiler has MaxValueTypes types already.
+func (p *Rprof) registerValueType(t valueType, cfg *wrapConfig) int {
+	for _, q := range cfg.also {
+		if q != p {
+			q.cfg.valueTypes.index(t)
+		}
+	}
+	return p.cfg.valueTypes.index(t)
+}
+
+// setValue sets the value of the read at index, unless index is -1.
+func setValue(ev *readEvent, index int, value int64) {
+	if index >= 0 {
+		ev.extra[index] = value
+	}
+}
+
+// derivedLabel is a label derived from the values of an additional sample
+// type, with its strings added to the string table.
+type derivedLabel struct {
+	// index is the index of the values of the type.
+	index     int
+	key, unit int64
+	derive    func(value, bytes int64) (int64, bool)
+}
+
+// addValueTypes adds the additional sample types of the configuration to the
+// profile, and the strings of the labels derived from them to the string
+// table.
+func (b *profileBuilder) addValueTypes() {
+	b.valueTypes = b.cfg.valueTypes.list()
+	for i, t := range b.valueTypes {
+		b.p.SampleType = append(b.p.SampleType, &proto.ValueType{
+			Type: b.addString(t.Type),
+			Unit: b.addString(t.Unit),
+		})
+		if t.label != "" {
+			b.derived = append(b.derived, derivedLabel{
+				index:  i,
+				key:    b.addString(t.label),
+				unit:   b.addString(t.unit),
+				derive: t.derive,
+			})
+		}
+	}
+}
+
+// addDerivedLabels adds the labels derived from the values of v to the
+// sample, allocated from labels.
+func (b *profileBuilder) addDerivedLabels(sample *proto.Sample, v *sampleValue, labels *slab[proto.Label]) {
+	for _, d := range b.derived {
+		if num, ok := d.derive(v.extra[d.index], v.bytes); ok {
+			l := addLabel(sample, labels)
+			l.Key = d.key
+			l.Num = num
+			l.NumUnit = d.unit
+		}
+	}
+}
+
+// numValues returns the number of values per sample, the built-in ones and
+// those of the additional sample types.
+func (b *profileBuilder) numValues() int {
+	return numValues + len(b.valueTypes)
+}
@@ -0,0 +1,87 @@
+package rprof
+
+import (
+	"context"
+	"io"
+	"strconv"
+)
+
+// messageTypeLabel is the label with the type of a WebSocket message. See
+// Rprof.WebSocketMessage.
+const messageTypeLabel = "websocket.message"
+
+// WebSocket message types as defined by RFC 6455, which WebSocket packages
+// such as github.com/gorilla/websocket use for their message types.
+const (
+	textMessage   = 1
+	binaryMessage = 2
+	closeMessage  = 8
+	pingMessage   = 9
+	pongMessage   = 10
+)
+
+// MessageReader is a WebSocket connection that returns a reader per message,
+// such as a *websocket.Conn of github.com/gorilla/websocket.
+type MessageReader interface {
+	NextReader() (messageType int, r io.Reader, err error)
+}
+
+// WebSocketMessage returns a new reader of a WebSocket message profiled by the
+// default profiler. See Rprof.WebSocketMessage.
+func WebSocketMessage(messageType int, r io.Reader, opts ...WrapOption) io.Reader {
+	return profiler.WebSocketMessage(messageType, r, opts...)
+}
+
+// NextReader returns the reader of the next message of c profiled by the
+// default profiler. See Rprof.NextReader.
+func NextReader(c MessageReader, opts ...WrapOption) (int, io.Reader, error) {
+	return profiler.NextReader(c, opts...)
+}
+
+// WebSocketMessage returns a new reader that profiles the reads of r, the
+// reader of a WebSocket message of the given RFC 6455 type, labeled with the
+// type as "websocket.message": "text", "binary", "close", "ping", "pong" or
+// the number of other types. Profiling messages rather than the underlying
+// connection attributes reads to the code consuming each message, and the
+// "eof" sample type counts the messages read to the end. It works with any
+// WebSocket package, for example with github.com/nhooyr/websocket:
+//
+//	typ, r, err := conn.Reader(ctx)
+//	r = p.WebSocketMessage(int(typ), r)
+func (p *Rprof) WebSocketMessage(messageType int, r io.Reader, opts ...WrapOption) io.Reader {
+	opts = append([]WrapOption{WithLabelSet(Labels(messageTypeLabel, messageTypeName(messageType)))}, opts...)
+	return &RprofReader{
+		p:   p,
+		r:   r,
+		cfg: newWrapConfig(context.Background(), opts),
+	}
+}
+
+// NextReader returns the type and the profiled reader of the next message of
+// c, such as a *websocket.Conn of github.com/gorilla/websocket. See
+// WebSocketMessage.
+func (p *Rprof) NextReader(c MessageReader, opts ...WrapOption) (int, io.Reader, error) {
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		return messageType, r, err
+	}
+	return messageType, p.WebSocketMessage(messageType, r, opts...), nil
+}
+
+// messageTypeName returns the label value of a WebSocket message type.
+func messageTypeName(messageType int) string {
+	switch messageType {
+	case textMessage:
+		return "text"
+	case binaryMessage:
+		return "binary"
+	case closeMessage:
+		return "close"
+	case pingMessage:
+		return "ping"
+	case pongMessage:
+		return "pong"
+	default:
+		return strconv.Itoa(messageType)
+	}
+}
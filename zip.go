@@ -0,0 +1,191 @@
+package rprof
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// zipEntryLabel is the label with the name of the archive entry a read
+// belongs to. See Rprof.ZipReader.
+const zipEntryLabel = "zip.entry"
+
+const (
+	// zipHeaderSignature starts the local header of an entry.
+	zipHeaderSignature = 0x04034b50
+	// zipHeaderLen is the length of a local header without the name and
+	// extra field, which is what zip.File.Open reads first.
+	zipHeaderLen = 30
+)
+
+// ZipReader opens a zip archive profiled by the default profiler. See
+// Rprof.ZipReader.
+func ZipReader(r io.ReaderAt, size int64, opts ...WrapOption) (*zip.Reader, error) {
+	return profiler.ZipReader(r, size, opts...)
+}
+
+// zipReaderAt is the profiled io.ReaderAt of a zip archive, which labels the
+// reads with the entry they belong to.
+type zipReaderAt struct {
+	p     *Rprof
+	r     io.ReaderAt
+	cfg   wrapConfig
+	files []*zip.File
+
+	mu sync.RWMutex
+	// starts and ends are the offsets at which the data of the opened
+	// entries starts and ends, ordered by start, and entries the
+	// configurations labeled with the corresponding entries.
+	starts, ends []int64
+	entries      []*wrapConfig
+	// headers are the local headers read while opening entries, by the
+	// offset of the data they precede.
+	headers map[int64]zipHeader
+}
+
+// zipHeader is the part of a local header used to identify its entry.
+type zipHeader struct {
+	// offset is the offset of the header.
+	offset  int64
+	method  uint16
+	crc32   uint32
+	nameLen int
+}
+
+// ZipReader opens the zip archive of the given size in r and profiles the
+// reads of r. The reads of entries, whether opened with zip.File.Open or
+// through the archive's fs.FS, are labeled with the name of the entry as
+// "zip.entry", so services serving assets out of archives see which entries
+// drive their I/O. Entries are identified when they are opened, so opening
+// the archive reads nothing but its directory. Reads of the directory and
+// of the local headers of the entries are not labeled, and neither are the
+// reads of entries compressed with other methods than zip.Store and
+// zip.Deflate.
+func (p *Rprof) ZipReader(r io.ReaderAt, size int64, opts ...WrapOption) (*zip.Reader, error) {
+	ra := &zipReaderAt{
+		p:       p,
+		r:       r,
+		cfg:     newWrapConfig(context.Background(), opts),
+		headers: map[int64]zipHeader{},
+	}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	ra.files = zr.File
+	zr.RegisterDecompressor(zip.Store, ra.decompressor(io.NopCloser))
+	zr.RegisterDecompressor(zip.Deflate, ra.decompressor(flate.NewReader))
+	return zr, nil
+}
+
+// decompressor returns a decompressor that labels the reads of the entry it
+// is called for when the entry is opened, and then decompresses with dcomp.
+func (r *zipReaderAt) decompressor(dcomp zip.Decompressor) zip.Decompressor {
+	return func(rd io.Reader) io.ReadCloser {
+		if s, ok := rd.(*io.SectionReader); ok {
+			_, off, n := s.Outer()
+			r.open(off, n)
+		}
+		return dcomp(rd)
+	}
+}
+
+// open labels the reads of the entry whose data of n bytes starts at off.
+func (r *zipReaderAt) open(off, n int64) {
+	r.mu.Lock()
+	hdr, ok := r.headers[off]
+	delete(r.headers, off)
+	i, labeled := slices.BinarySearch(r.starts, off)
+	r.mu.Unlock()
+	if !ok || labeled {
+		return
+	}
+
+	f := r.entry(hdr, n)
+	if f == nil {
+		return
+	}
+	cfg := r.cfg.withLabels(Labels(zipEntryLabel, f.Name))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i, labeled = slices.BinarySearch(r.starts, off); !labeled {
+		r.starts = slices.Insert(r.starts, i, off)
+		r.ends = slices.Insert(r.ends, i, off+n)
+		r.entries = slices.Insert(r.entries, i, &cfg)
+	}
+}
+
+// entry returns the entry of the local header whose data has n bytes, or nil
+// if it can't be identified. Entries are told apart by the fields of the
+// header, only if several match is the name read from the header, unprofiled.
+func (r *zipReaderAt) entry(hdr zipHeader, n int64) *zip.File {
+	var candidates []*zip.File
+	for _, f := range r.files {
+		// The CRC-32 is zero in the header if it follows the data.
+		if f.CompressedSize64 == uint64(n) && f.Method == hdr.method && len(f.Name) == hdr.nameLen && (hdr.crc32 == 0 || f.CRC32 == hdr.crc32) {
+			candidates = append(candidates, f)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	name := make([]byte, hdr.nameLen)
+	if _, err := r.r.ReadAt(name, hdr.offset+zipHeaderLen); err != nil {
+		return nil
+	}
+	for _, f := range candidates {
+		if f.Name == string(name) {
+			return f
+		}
+	}
+	return nil
+}
+
+// ReadAt reads from the underlying reader and records the sample in the
+// profiler, labeled with the entry at off, if any.
+func (r *zipReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	cfg := &r.cfg
+	r.mu.RLock()
+	if i := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > off }) - 1; i >= 0 && off < r.ends[i] {
+		cfg = r.entries[i]
+	}
+	r.mu.RUnlock()
+
+	ev := r.p.readAt(r.r, buf, off, cfg)
+	if ev.n == zipHeaderLen && len(buf) == zipHeaderLen {
+		r.readHeader(buf, off)
+	}
+	r.p.recordSample(ev, cfg)
+	return ev.n, ev.err
+}
+
+// readHeader remembers the local header in buf, read at off, if it is one,
+// for open to identify its entry.
+func (r *zipReaderAt) readHeader(buf []byte, off int64) {
+	le := binary.LittleEndian
+	if le.Uint32(buf) != zipHeaderSignature {
+		return
+	}
+	hdr := zipHeader{
+		offset:  off,
+		method:  le.Uint16(buf[8:]),
+		crc32:   le.Uint32(buf[14:]),
+		nameLen: int(le.Uint16(buf[26:])),
+	}
+	data := off + zipHeaderLen + int64(hdr.nameLen) + int64(le.Uint16(buf[28:]))
+
+	r.mu.Lock()
+	r.headers[data] = hdr
+	r.mu.Unlock()
+}